@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/rtp"
+)
+
+// Bitrate adaptativo por espectador (-adaptive-bitrate): cada espectador del
+// video capturado recibe su propio encoder, cuyo bitrate sigue la estimación
+// de ancho de banda de su PeerConnection (GCC sobre el feedback TWCC o el REMB
+// que envíe el navegador), acotada por -min-bitrate y -max-bitrate. Con
+// bitrates bajos se reducen también la resolución y los fps.
+//
+// El encoder no permite cambiar el bitrate en marcha, así que se reconstruye
+// cuando el objetivo cambia lo suficiente; el espectador ve un flujo continuo
+// porque el empaquetador RTP se conserva.
+
+// adaptiveQuality es un escalón de calidad: se usa cuando el bitrate objetivo
+// es al menos minBitrate.
+type adaptiveQuality struct {
+	minBitrate int
+	scale      float64 // Factor sobre el ancho y alto capturados
+	frameRate  float32 // 0 = los fps de la captura
+}
+
+var adaptiveQualitySteps = []adaptiveQuality{
+	{minBitrate: 1_000_000, scale: 1},
+	{minBitrate: 600_000, scale: 0.75},
+	{minBitrate: 300_000, scale: 0.5, frameRate: 20},
+	{minBitrate: 0, scale: 0.5, frameRate: 12},
+}
+
+const (
+	adaptiveRestartThreshold = 0.15            // Cambio relativo mínimo para reconstruir el encoder
+	adaptiveRestartInterval  = 2 * time.Second // Tiempo mínimo entre reconstrucciones
+)
+
+func adaptiveQualityFor(bitrate int) adaptiveQuality {
+	for _, quality := range adaptiveQualitySteps {
+		if bitrate >= quality.minBitrate {
+			return quality
+		}
+	}
+	return adaptiveQualitySteps[len(adaptiveQualitySteps)-1]
+}
+
+// adaptiveVideoEncoder codifica el video capturado para un único espectador.
+type adaptiveVideoEncoder struct {
+	id         string
+	track      *mediadevices.VideoTrack
+	codec      videoCodecOption
+	rtpCodec   *codec.RTPCodec
+	minBitrate int
+	maxBitrate int
+	out        *FanoutTrack
+	packetizer rtp.Packetizer
+
+	mutex        sync.Mutex
+	encoder      codec.ReadCloser
+	bitrate      int // Bitrate con el que se construyó el encoder actual
+	gccEstimate  int // Última estimación GCC (0 = sin datos)
+	rembEstimate int // Último REMB recibido (0 = sin datos)
+	restartedAt  time.Time
+	closed       bool
+}
+
+func newAdaptiveVideoEncoder(id string, track *mediadevices.VideoTrack, videoCodec videoCodecOption, initialBitrate, minBitrate, maxBitrate int) (*adaptiveVideoEncoder, error) {
+	rtpCodec := videoCodec.rtpCodec
+	e := &adaptiveVideoEncoder{
+		id:         id,
+		track:      track,
+		codec:      videoCodec,
+		rtpCodec:   rtpCodec,
+		minBitrate: minBitrate,
+		maxBitrate: maxBitrate,
+		out:        NewFanoutTrack(rtpCodec.RTPCodecCapability, "video", streamID),
+	}
+	e.packetizer = rtp.NewPacketizer(rtpOutboundMTU, uint8(rtpCodec.PayloadType), rand.Uint32(), rtpCodec.Payloader, rtp.NewRandomSequencer(), rtpCodec.ClockRate)
+
+	bitrate := min(max(initialBitrate, minBitrate), maxBitrate)
+	encoder, quality, err := e.build(bitrate)
+	if err != nil {
+		return nil, err
+	}
+	e.encoder, e.bitrate, e.restartedAt = encoder, bitrate, time.Now()
+	e.out.OnKeyFrameRequest(e.forceKeyFrame)
+	e.out.OnBandwidthEstimate(e.SetREMBEstimate)
+	log.Printf("[%s] Bitrate adaptativo: Encoder %s iniciado a %d kbps (escala %.2f).", id, rtpCodec.MimeType, bitrate/1000, quality.scale)
+
+	go e.run()
+	return e, nil
+}
+
+// Track devuelve la pista que debe añadirse al PeerConnection del espectador.
+func (e *adaptiveVideoEncoder) Track() *FanoutTrack {
+	return e.out
+}
+
+// build crea un encoder para el bitrate indicado, con la resolución y los fps
+// del escalón correspondiente.
+func (e *adaptiveVideoEncoder) build(bitrate int) (codec.ReadCloser, adaptiveQuality, error) {
+	quality := adaptiveQualityFor(bitrate)
+	encoder, err := buildScaledVideoEncoder(e.track, e.codec, bitrate, func(width, height int) (int, int) {
+		return int(float64(width)*quality.scale) &^ 1, int(float64(height)*quality.scale) &^ 1
+	}, quality.frameRate)
+	return encoder, quality, err
+}
+
+// buildScaledVideoEncoder crea un encoder del codec indicado con un lector
+// propio de la pista capturada. size calcula el tamaño de salida a partir del capturado y
+// frameRate limita los fps (0 = sin límite).
+func buildScaledVideoEncoder(track *mediadevices.VideoTrack, videoCodec videoCodecOption, bitrate int, size func(width, height int) (int, int), frameRate float32) (codec.ReadCloser, error) {
+	var reader video.Reader = track.NewReader(false)
+
+	// Se descarta un frame para conocer el tamaño capturado.
+	img, _, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo leer el video capturado: %w", err)
+	}
+	width, height := size(img.Bounds().Dx(), img.Bounds().Dy())
+	if width != img.Bounds().Dx() || height != img.Bounds().Dy() {
+		reader = video.Scale(width, height, nil)(reader)
+	}
+	if frameRate > 0 {
+		reader = video.Throttle(frameRate)(reader)
+	}
+
+	encoder, err := videoCodec.params(bitrate).BuildVideoEncoder(reader, prop.Media{Video: prop.Video{Width: width, Height: height}})
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo crear el encoder %s: %w", videoCodec.rtpCodec.MimeType, err)
+	}
+	return encoder, nil
+}
+
+func (e *adaptiveVideoEncoder) run() {
+	last := time.Now()
+	for {
+		e.mutex.Lock()
+		encoder := e.encoder
+		e.mutex.Unlock()
+
+		data, release, err := encoder.Read()
+		if err != nil {
+			e.mutex.Lock()
+			closed, replaced := e.closed, e.encoder != encoder
+			e.mutex.Unlock()
+			if closed {
+				return
+			}
+			if !replaced {
+				log.Printf("[%s] Bitrate adaptativo: Encoder detenido: %v", e.id, err)
+				return
+			}
+			continue
+		}
+		now := time.Now()
+		samples := uint32(now.Sub(last).Seconds() * float64(e.rtpCodec.ClockRate))
+		last = now
+		for _, pkt := range e.packetizer.Packetize(data, samples) {
+			e.out.WriteRTP(pkt)
+		}
+		release()
+		e.adapt()
+	}
+}
+
+// adapt reconstruye el encoder si el objetivo se ha alejado lo suficiente del
+// bitrate actual y ha pasado el intervalo mínimo desde el último cambio. El
+// encoder nuevo se construye fuera de e.mutex porque lee un frame de la
+// captura; mientras tanto siguen llegando estimaciones y peticiones de
+// keyframe. Solo lo llama run, así que no hay dos reconstrucciones a la vez.
+func (e *adaptiveVideoEncoder) adapt() {
+	e.mutex.Lock()
+	if e.closed || time.Since(e.restartedAt) < adaptiveRestartInterval {
+		e.mutex.Unlock()
+		return
+	}
+	target := e.targetLocked()
+	if math.Abs(float64(target-e.bitrate)) < adaptiveRestartThreshold*float64(e.bitrate) {
+		e.mutex.Unlock()
+		return
+	}
+	e.restartedAt = time.Now()
+	e.mutex.Unlock()
+
+	encoder, quality, err := e.build(target)
+	if err != nil {
+		log.Printf("[%s] Bitrate adaptativo: %v", e.id, err)
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		encoder.Close()
+		return
+	}
+	e.encoder.Close()
+	log.Printf("[%s] Bitrate adaptativo: %d -> %d kbps (escala %.2f, fps %v).", e.id, e.bitrate/1000, target/1000, quality.scale, quality.frameRate)
+	e.encoder, e.bitrate = encoder, target
+}
+
+// targetLocked combina las estimaciones disponibles (la menor) y las acota.
+func (e *adaptiveVideoEncoder) targetLocked() int {
+	estimate := e.gccEstimate
+	if e.rembEstimate > 0 && (estimate == 0 || e.rembEstimate < estimate) {
+		estimate = e.rembEstimate
+	}
+	if estimate == 0 {
+		return e.bitrate
+	}
+	return min(max(estimate, e.minBitrate), e.maxBitrate)
+}
+
+// SetGCCEstimate recibe la estimación del controlador de congestión (bps).
+func (e *adaptiveVideoEncoder) SetGCCEstimate(bitrate int) {
+	e.mutex.Lock()
+	e.gccEstimate = bitrate
+	e.mutex.Unlock()
+}
+
+// SetREMBEstimate recibe el REMB enviado por el espectador (bps).
+func (e *adaptiveVideoEncoder) SetREMBEstimate(bitrate int) {
+	e.mutex.Lock()
+	e.rembEstimate = bitrate
+	e.mutex.Unlock()
+}
+
+func (e *adaptiveVideoEncoder) forceKeyFrame() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if keyFrameController, ok := e.encoder.Controller().(codec.KeyFrameController); ok {
+		if err := keyFrameController.ForceKeyFrame(); err != nil {
+			log.Printf("[%s] Bitrate adaptativo: Error forzando keyframe: %v", e.id, err)
+		}
+	}
+}
+
+func (e *adaptiveVideoEncoder) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.encoder.Close()
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// API de administración (-admin-token): permite cambiar en marcha los
+// parámetros del encoder de video compartido sin reiniciar el servidor ni
+// desconectar a los espectadores. Todas las peticiones deben llevar la
+// cabecera "Authorization: Bearer <token>".
+//
+//	GET   /admin/encoder  parámetros actuales y tamaño codificado por codec
+//	PATCH /admin/encoder  {"video-bitrate":800000,"fps":15} cambia solo los campos presentes
+//	GET   /admin/keyframes  peticiones de keyframe de cada pista de video (PLI, FIR, nuevos espectadores...)
+//	GET   /admin/recordings  grabaciones desde el arranque (ID, ficheros, duración y bytes)
+//	POST  /admin/recordings  {"name":"incidencia"} empieza una grabación bajo demanda (el cuerpo es opcional)
+//	GET   /admin/recordings/{id}  estado de una grabación
+//	POST  /admin/recordings/{id}/stop  detiene una grabación bajo demanda
+//	GET   /admin/clips  clips exportados del buffer DVR
+//	POST  /admin/clips  {"offset":30,"duration":10} exporta a WebM desde 30s por detrás del directo (sin duración, hasta el directo; máximo maxClipDuration)
+//	GET   /admin/clips/{id}  estado de un clip
+//	DELETE /admin/clips/{id}  borra un clip y su fichero
+//
+// Los clips se descargan sin token en la URL que devuelve la API (/clips/<id>.webm).
+
+const (
+	adminEncoderPath    = "/admin/encoder"
+	adminKeyFramesPath  = "/admin/keyframes"
+	adminRecordingsPath = "/admin/recordings"
+	adminClipsPath      = "/admin/clips"
+)
+
+// videoEncoderUpdate es el cuerpo de PATCH /admin/encoder.
+type videoEncoderUpdate struct {
+	Bitrate          *int     `json:"video-bitrate"`
+	Width            *int     `json:"width"`
+	Height           *int     `json:"height"`
+	FrameRate        *float64 `json:"fps"`
+	KeyFrameInterval *int     `json:"keyframe-interval"`
+}
+
+func (u videoEncoderUpdate) apply(settings videoEncoderSettings) videoEncoderSettings {
+	if u.Bitrate != nil {
+		settings.Bitrate = *u.Bitrate
+	}
+	if u.Width != nil {
+		settings.Width = *u.Width
+	}
+	if u.Height != nil {
+		settings.Height = *u.Height
+	}
+	if u.FrameRate != nil {
+		settings.FrameRate = *u.FrameRate
+	}
+	if u.KeyFrameInterval != nil {
+		settings.KeyFrameInterval = *u.KeyFrameInterval
+	}
+	return settings
+}
+
+// videoEncoderStatus es la respuesta de GET y PATCH /admin/encoder.
+type videoEncoderStatus struct {
+	videoEncoderSettings
+	Encoders map[string]encodedSize `json:"encoders"` // Por MIME type
+}
+
+// RegisterAdminHandlers habilita la API de administración con el token indicado.
+func (s *Server) RegisterAdminHandlers(token string) {
+	s.adminToken = token
+	http.HandleFunc("GET "+adminEncoderPath, s.handleAdminEncoderGet)
+	http.HandleFunc("PATCH "+adminEncoderPath, s.handleAdminEncoderPatch)
+	http.HandleFunc("GET "+adminKeyFramesPath, s.handleAdminKeyFrames)
+	http.HandleFunc("GET "+adminRecordingsPath, s.handleAdminRecordingsList)
+	http.HandleFunc("POST "+adminRecordingsPath, s.handleAdminRecordingsStart)
+	http.HandleFunc("GET "+adminRecordingsPath+"/{id}", s.handleAdminRecordingGet)
+	http.HandleFunc("POST "+adminRecordingsPath+"/{id}/stop", s.handleAdminRecordingStop)
+	http.HandleFunc("GET "+adminClipsPath, s.handleAdminClipsList)
+	http.HandleFunc("POST "+adminClipsPath, s.handleAdminClipsExport)
+	http.HandleFunc("GET "+adminClipsPath+"/{id}", s.handleAdminClipGet)
+	http.HandleFunc("DELETE "+adminClipsPath+"/{id}", s.handleAdminClipDelete)
+	log.Printf("Servidor: API de administración habilitada en %s, %s, %s y %s.", adminEncoderPath, adminKeyFramesPath, adminRecordingsPath, adminClipsPath)
+}
+
+func (s *Server) adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.adminToken == "" || !bearerTokenMatches(r, s.adminToken) {
+		log.Printf("Admin: Petición no autorizada de %s.", r.RemoteAddr)
+		http.Error(w, "no autorizado", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleAdminEncoderGet atiende GET /admin/encoder.
+func (s *Server) handleAdminEncoderGet(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	s.writeVideoEncoderStatus(w)
+}
+
+// handleAdminEncoderPatch atiende PATCH /admin/encoder: aplica los cambios y
+// responde con el nuevo estado.
+func (s *Server) handleAdminEncoderPatch(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	settings, _, err := s.mediaManager.VideoEncoderSettings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	var update videoEncoderUpdate
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&update); err != nil {
+		http.Error(w, "JSON inválido: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	settings = update.apply(settings)
+	if err := settings.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Admin: Reconfiguración del encoder pedida desde %s.", r.RemoteAddr)
+	if err := s.mediaManager.ReconfigureVideo(settings); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errVideoNotReconfigurable) {
+			status = http.StatusConflict
+		}
+		log.Printf("Admin: %v", err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	s.writeVideoEncoderStatus(w)
+}
+
+func (s *Server) writeVideoEncoderStatus(w http.ResponseWriter) {
+	settings, sizes, err := s.mediaManager.VideoEncoderSettings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(videoEncoderStatus{videoEncoderSettings: settings, Encoders: sizes})
+}
+
+// handleAdminKeyFrames atiende GET /admin/keyframes.
+func (s *Server) handleAdminKeyFrames(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.mediaManager.KeyFrameStats())
+}
+
+// recordingStartRequest es el cuerpo (opcional) de POST /admin/recordings.
+type recordingStartRequest struct {
+	Name string `json:"name"`
+}
+
+// handleAdminRecordingsList atiende GET /admin/recordings.
+func (s *Server) handleAdminRecordingsList(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, s.recordings.List())
+}
+
+// handleAdminRecordingsStart atiende POST /admin/recordings: empieza una
+// grabación y responde con su estado (201).
+func (s *Server) handleAdminRecordingsStart(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	var request recordingStartRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "JSON inválido: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Admin: Grabación pedida desde %s.", r.RemoteAddr)
+	info, err := s.recordings.Start(request.Name)
+	if err != nil {
+		log.Printf("Admin: %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeAdminJSON(w, http.StatusCreated, info)
+}
+
+// handleAdminRecordingGet atiende GET /admin/recordings/{id}.
+func (s *Server) handleAdminRecordingGet(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	info, err := s.recordings.Get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, info)
+}
+
+// handleAdminRecordingStop atiende POST /admin/recordings/{id}/stop: cierra
+// la grabación y responde con su estado final.
+func (s *Server) handleAdminRecordingStop(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	log.Printf("Admin: Parada de la grabación %s pedida desde %s.", r.PathValue("id"), r.RemoteAddr)
+	info, err := s.recordings.Stop(r.PathValue("id"))
+	if err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, errRecordingNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, info)
+}
+
+// clipExportRequest es el cuerpo de POST /admin/clips.
+type clipExportRequest struct {
+	Name     string  `json:"name"`
+	Offset   float64 `json:"offset"`   // Segundos por detrás del directo en que empieza
+	Duration float64 `json:"duration"` // Segundos; 0 = hasta el directo
+}
+
+// handleAdminClipsList atiende GET /admin/clips.
+func (s *Server) handleAdminClipsList(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, s.clips.List())
+}
+
+// handleAdminClipsExport atiende POST /admin/clips: exporta el intervalo
+// pedido del buffer DVR y responde con el clip (201).
+func (s *Server) handleAdminClipsExport(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	var request clipExportRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(w, "JSON inválido: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Offset <= 0 || request.Duration < 0 || request.Duration > request.Offset {
+		http.Error(w, "offset debe ser positivo y duration estar entre 0 y offset", http.StatusBadRequest)
+		return
+	}
+	// El clip se escribe durante la petición: su duración está acotada.
+	length := request.Duration
+	if length == 0 {
+		length = request.Offset
+	}
+	if length > maxClipDuration.Seconds() {
+		http.Error(w, fmt.Sprintf("un clip no puede durar más de %v", maxClipDuration), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Admin: Clip de %gs por detrás del directo pedido desde %s.", request.Offset, r.RemoteAddr)
+	clip, err := s.clips.Export(request.Name, time.Duration(request.Offset*float64(time.Second)), time.Duration(request.Duration*float64(time.Second)))
+	if err != nil {
+		log.Printf("Admin: %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeAdminJSON(w, http.StatusCreated, clip)
+}
+
+// handleAdminClipGet atiende GET /admin/clips/{id}.
+func (s *Server) handleAdminClipGet(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	clip, err := s.clips.Get(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, clip)
+}
+
+// handleAdminClipDelete atiende DELETE /admin/clips/{id}.
+func (s *Server) handleAdminClipDelete(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		return
+	}
+	if err := s.clips.Delete(r.PathValue("id")); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errClipNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/driver"
+	"github.com/pion/mediadevices/pkg/frame"
+	"github.com/pion/mediadevices/pkg/prop"
+)
+
+// Formato de captura (-width, -height, -fps, -pixel-format): se piden al
+// dispositivo como valores ideales, así que GetUserMedia elige el modo más
+// cercano que ofrezca. Al arrancar se informa del modo elegido y de lo que
+// llega realmente (tamaño y fps medidos sobre los primeros frames).
+
+var pixelFormats = map[string]frame.Format{
+	"i420":  frame.FormatI420,
+	"i444":  frame.FormatI444,
+	"nv12":  frame.FormatNV12,
+	"nv21":  frame.FormatNV21,
+	"yuy2":  frame.FormatYUY2,
+	"yuyv":  frame.FormatYUYV,
+	"uyvy":  frame.FormatUYVY,
+	"rgba":  frame.FormatRGBA,
+	"mjpeg": frame.FormatMJPEG,
+}
+
+// pixelFormatPreference es una constraint de formato de pixel por orden de
+// preferencia: los formatos de la lista se prefieren (antes cuanto más
+// arriba), pero cualquier otro sigue siendo aceptable.
+type pixelFormatPreference []frame.Format
+
+func (p pixelFormatPreference) Compare(format frame.Format) (float64, bool) {
+	for i, preferred := range p {
+		if preferred == format {
+			return float64(i) / float64(len(p)), true
+		}
+	}
+	return 1, true
+}
+
+func (p pixelFormatPreference) Value() (frame.Format, bool) { return "", false }
+
+func (p pixelFormatPreference) String() string {
+	names := make([]string, len(p))
+	for i, format := range p {
+		names[i] = string(format)
+	}
+	return strings.Join(names, " > ") + " (preferencia)"
+}
+
+// parsePixelFormats interpreta una lista como "mjpeg,yuyv".
+func parsePixelFormats(list string) (pixelFormatPreference, error) {
+	var preference pixelFormatPreference
+	for _, name := range splitList(strings.ToLower(list)) {
+		format, ok := pixelFormats[name]
+		if !ok {
+			return nil, fmt.Errorf("formato de pixel desconocido '%s'", name)
+		}
+		preference = append(preference, format)
+	}
+	return preference, nil
+}
+
+// negotiatedProp repite la elección de GetUserMedia entre los dispositivos ya
+// abiertos (el modo más cercano a las constraints) para saber qué formato se
+// ha pedido realmente al dispositivo.
+func negotiatedProp(filter driver.FilterFn, constraints mediadevices.MediaTrackConstraints) (prop.Media, bool) {
+	var best prop.Media
+	bestDistance, found := math.Inf(1), false
+	for _, d := range driver.GetManager().Query(filter) {
+		if d.Status() == driver.StateClosed {
+			continue
+		}
+		for _, p := range d.Properties() {
+			distance, ok := constraints.MediaConstraints.FitnessDistance(p)
+			if !ok {
+				continue
+			}
+			if distance -= float64(d.Info().Priority); distance < bestDistance {
+				best, bestDistance, found = p, distance, true
+			}
+		}
+	}
+	return best, found
+}
+
+// reportVideoFormat informa del modo de captura elegido y mide, en segundo
+// plano, el tamaño y los fps de los frames que llegan.
+func reportVideoFormat(track mediadevices.Track, constraints mediadevices.MediaTrackConstraints) {
+	if p, ok := negotiatedProp(driver.FilterVideoRecorder(), constraints); ok {
+		log.Printf("MediaManager: Modo de captura de video: %dx%d @ %.4g fps, formato %s.", p.Width, p.Height, p.FrameRate, p.FrameFormat)
+	}
+	videoTrack, ok := track.(*mediadevices.VideoTrack)
+	if !ok {
+		return
+	}
+	go func() {
+		reader := videoTrack.NewReader(false)
+		img, _, err := reader.Read()
+		if err != nil {
+			return
+		}
+		frames, start := 0, time.Now()
+		for time.Since(start) < 2*time.Second {
+			if img, _, err = reader.Read(); err != nil {
+				return
+			}
+			frames++
+		}
+		fps := float64(frames) / time.Since(start).Seconds()
+		log.Printf("MediaManager: Video recibido: %dx%d a %.1f fps (%T).", img.Bounds().Dx(), img.Bounds().Dy(), fps, img)
+	}()
+}
+
+// reportAudioFormat informa del modo de captura de audio elegido.
+func reportAudioFormat(constraints mediadevices.MediaTrackConstraints) {
+	if p, ok := negotiatedProp(driver.FilterAudioRecorder(), constraints); ok {
+		log.Printf("MediaManager: Modo de captura de audio: %d Hz, %d canal(es), latencia %v.", p.SampleRate, p.ChannelCount, p.Latency)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Clips del buffer DVR (/admin/clips): exportan a un fichero WebM un
+// intervalo de lo que guarda -dvr-window, p.ej. "los últimos 30 segundos",
+// con el mismo video y audio que graba -record. El clip empieza en el
+// keyframe anterior al instante pedido y se descarga en /clips/<id>.webm; el
+// ID es aleatorio, así que la URL se puede compartir sin el token de la API.
+// El clip se escribe mientras se atiende la petición, así que su duración
+// está limitada a maxClipDuration.
+
+const (
+	clipsURLPath    = "/clips/"
+	maxClipDuration = 5 * time.Minute
+)
+
+var (
+	errClipNotFound       = errors.New("clip no encontrado")
+	errClipsNeedDVR       = errors.New("los clips se exportan del buffer DVR: hace falta -dvr-window")
+	errClipsNeedWebMVideo = errors.New("no hay ningún video VP8 ni VP9 en marcha con buffer DVR del que exportar el clip")
+	errClipEmpty          = errors.New("el buffer DVR no tiene datos de ese intervalo")
+)
+
+// clipInfo describe un clip exportado.
+type clipInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	URL       string    `json:"url"` // Descarga, relativa al servidor
+	Path      string    `json:"path"`
+	Start     time.Time `json:"start"`    // Llegada del primer frame del clip
+	Duration  float64   `json:"duration"` // Segundos
+	Bytes     int64     `json:"bytes"`
+	CreatedAt time.Time `json:"created-at"`
+}
+
+// fileName es el nombre con el que se descarga el clip.
+func (c clipInfo) fileName() string {
+	return "clip-" + c.Start.Local().Format("20060102-150405") + ".webm"
+}
+
+// clipManager exporta y lleva los clips del buffer DVR.
+type clipManager struct {
+	media *MediaManager
+	dir   string // -clips-path
+
+	mutex sync.Mutex
+	clips map[string]clipInfo
+}
+
+func newClipManager(media *MediaManager, dir string) *clipManager {
+	return &clipManager{media: media, dir: dir, clips: make(map[string]clipInfo)}
+}
+
+// Export escribe en un WebM lo que guarda el buffer DVR desde offset por
+// detrás del directo durante duration (0 = hasta el directo).
+func (m *clipManager) Export(name string, offset, duration time.Duration) (clipInfo, error) {
+	name = strings.TrimSpace(name)
+	if len(name) > maxRecordingNameLen {
+		return clipInfo{}, fmt.Errorf("el nombre no puede tener más de %d caracteres", maxRecordingNameLen)
+	}
+	if m.media.DVRWindow() == 0 {
+		return clipInfo{}, errClipsNeedDVR
+	}
+	video, audio, channels, err := m.media.GetClipTracks()
+	if err != nil {
+		return clipInfo{}, err
+	}
+	if audio != nil && !audio.DVREnabled() {
+		return clipInfo{}, errClipsNeedDVR
+	}
+	now := time.Now()
+	from, to := now.Add(-offset), now
+	if duration > 0 && from.Add(duration).Before(now) {
+		to = from.Add(duration)
+	}
+
+	// El video marca el principio (un keyframe); el audio empieza con él.
+	var packets []recorderPacket
+	if video != nil {
+		for _, p := range video.DVRRange(0, from, to) {
+			packets = append(packets, recorderPacket{video: true, pkt: p.pkt, at: p.at})
+		}
+		if len(packets) == 0 {
+			return clipInfo{}, errClipEmpty
+		}
+		from = packets[0].at
+	}
+	if audio != nil {
+		for _, p := range audio.DVRRange(0, from, to) {
+			packets = append(packets, recorderPacket{pkt: p.pkt, at: p.at})
+		}
+	}
+	if len(packets) == 0 {
+		return clipInfo{}, errClipEmpty
+	}
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].at.Before(packets[j].at) })
+
+	id := uuid.NewString()
+	files, err := writeRecording(recorderConfig{
+		id:           "clip-" + id[:8],
+		pathTemplate: filepath.Join(m.dir, id+".webm"),
+		literalPath:  true, // -clips-path puede contener '%'
+		single:       true,
+	}, video, audio, channels, packets)
+	if err != nil {
+		return clipInfo{}, err
+	}
+	if len(files) == 0 {
+		return clipInfo{}, errClipEmpty
+	}
+	clip := clipInfo{
+		ID:        id,
+		Name:      name,
+		URL:       clipsURLPath + id + ".webm",
+		Path:      files[0].Path,
+		Start:     from,
+		Duration:  files[0].Duration,
+		Bytes:     files[0].Bytes,
+		CreatedAt: now,
+	}
+	m.mutex.Lock()
+	m.clips[id] = clip
+	m.mutex.Unlock()
+	log.Printf("Clips: Clip %s exportado en '%s' (%.1fs, %.1f MB).", id, clip.Path, clip.Duration, float64(clip.Bytes)/(1024*1024))
+	return clip, nil
+}
+
+// Get devuelve un clip.
+func (m *clipManager) Get(id string) (clipInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	clip, ok := m.clips[id]
+	if !ok {
+		return clipInfo{}, errClipNotFound
+	}
+	return clip, nil
+}
+
+// List devuelve los clips exportados desde el arranque, por orden de creación.
+func (m *clipManager) List() []clipInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := make([]clipInfo, 0, len(m.clips))
+	for _, clip := range m.clips {
+		list = append(list, clip)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Delete borra un clip y su fichero.
+func (m *clipManager) Delete(id string) error {
+	m.mutex.Lock()
+	clip, ok := m.clips[id]
+	delete(m.clips, id)
+	m.mutex.Unlock()
+	if !ok {
+		return errClipNotFound
+	}
+	if err := os.Remove(clip.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no se pudo borrar '%s': %w", clip.Path, err)
+	}
+	log.Printf("Clips: Clip %s borrado.", id)
+	return nil
+}
+
+// SetClips asocia el gestor de clips que exponen la API de administración y
+// las descargas de /clips/.
+func (s *Server) SetClips(clips *clipManager) {
+	s.clips = clips
+}
+
+// handleClipDownload atiende GET /clips/<id>.webm.
+func (s *Server) handleClipDownload(w http.ResponseWriter, r *http.Request) {
+	if s.clips == nil {
+		http.NotFound(w, r)
+		return
+	}
+	id, ok := strings.CutSuffix(r.PathValue("file"), ".webm")
+	clip, err := s.clips.Get(id)
+	if !ok || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/webm")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", clip.fileName()))
+	http.ServeFile(w, r, clip.Path)
+}
@@ -1,12 +1,38 @@
 package main
 
-import "flag"
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // Constantes que podrían ser configurables o usadas en múltiples lugares.
 const (
 	htmlFilePath                = "./client.html" // Ruta al archivo HTML del cliente
 	mediaCaptureRetries         = 5               // Número de reintentos para GetUserMedia
 	mediaCaptureRetryDelaySeconds = 5               // Retraso en segundos entre reintentos de captura
+	rtpOutboundMTU              = 1200            // Tamaño máximo de los paquetes RTP generados por el encoder
+	rtcpInboundMTU              = 1500            // Tamaño del buffer de lectura de RTCP de los espectadores
+	streamID                    = "webrtc-streamer" // StreamID común de las pistas compartidas
+	defaultICEServers           = "stun:stun.l.google.com:19302"
+	defaultVideoBitrate         = 1_500_000       // Bitrate del encoder de video compartido (bps)
+	defaultAudioBitrate         = 32_000          // Bitrate del encoder Opus (bps)
+	defaultKeyFrameInterval     = 60              // Frames entre keyframes del video capturado
+	defaultKeyFrameMinInterval  = time.Second     // Mínimo entre keyframes forzados por peticiones de los espectadores
+	defaultGOPCacheSize         = 4096            // KB de la caché de GOP por capa de video
+	defaultDVRMaxSize           = 256             // MB del buffer DVR por capa
+	defaultOpusPacketLoss       = 10              // Pérdidas esperadas (%) para dimensionar la FEC de Opus
+	defaultOpusComplexity       = 10              // Complejidad del encoder Opus (0-10)
+	defaultOpusFrameDuration    = 20 * time.Millisecond
+	defaultVideoCodecs          = "vp8,h264"      // Codecs del video capturado, por preferencia
+	defaultRecordingsPath       = "grabaciones/%Y%m%d-%H%M%S-%i.webm" // Plantilla de las grabaciones bajo demanda
+	defaultClipsPath            = "clips"         // Directorio de los clips exportados del buffer DVR
+	wsWriteTimeout              = 5 * time.Second // Plazo de escritura de los mensajes WebSocket
 )
 
 // Config almacena la configuración obtenida de los flags de línea de comandos.
@@ -16,19 +42,237 @@ type Config struct {
 	AudioIdentifier string // Identificador (ID o Label) para el audio del flag -a
 	VideoDeviceID   string // El DeviceID real resuelto para el video
 	AudioDeviceID   string // El DeviceID real resuelto para el audio
+	Loop            bool          // Reproducir en bucle las fuentes file:
+	StartOffset     time.Duration // Posición inicial en las fuentes file:
+	WHIPToken       string        // Bearer token exigido a los publicadores WHIP
+	AdminToken      string        // Bearer token de la API de administración (vacío = deshabilitada)
+	RecordPath      string        // Plantilla de los ficheros WebM grabados (vacío = sin grabación)
+	RecordMaxDuration time.Duration // Duración máxima de cada fichero grabado (0 = sin límite)
+	RecordMaxSize   int           // Tamaño máximo de cada fichero grabado en MB (0 = sin límite)
+	RecordingsPath  string        // Plantilla de las grabaciones bajo demanda de la API de administración
+	ICEServerURLs   []string      // URLs STUN/TURN para servidor y clientes (vacío = solo candidatos host)
+	TURNUsername    string        // Usuario TURN estático (o sufijo del usuario con -turn-secret)
+	TURNCredential  string        // Contraseña TURN estática
+	TURNSecret      string        // Secreto compartido para credenciales TURN temporales (REST API)
+	TURNCredentialTTL time.Duration // Validez de las credenciales temporales
+	TURNListen      string        // Dirección del servidor TURN embebido (vacío = desactivado)
+	TURNRealm       string        // Realm del servidor TURN embebido
+	TURNPublicIP    string        // IP anunciada en los relays del servidor TURN embebido
+	TURNAllowPrivatePeers bool    // Permite relays hacia direcciones loopback, privadas o link-local
+	ICEUDPPort      int           // Puerto UDP único para todo el tráfico ICE/media (0 = puertos efímeros)
+	ICETCPPort      int           // Puerto ICE-TCP pasivo (0 = desactivado)
+	NAT1To1IPs      []string      // IPs públicas que sustituyen a las locales en los candidatos host
+	NACK            bool          // Retransmisiones NACK
+	NACKBufferSize  int           // Paquetes guardados por espectador para retransmitir (potencia de 2)
+	RTX             bool          // Retransmitir por un flujo RTX separado
+	RTCPReports     bool          // Sender/Receiver Reports RTCP
+	RTCPReportInterval time.Duration
+	TWCC            bool          // Transport-wide congestion control (extensión y feedback)
+	AudioRED        int           // Tramas Opus anteriores repetidas en cada paquete (RED, 0 = sin RED)
+	VideoFEC        int           // Paquetes de video protegidos por cada paquete FlexFEC (0 = sin FEC)
+	AdaptiveBitrate bool          // Un encoder por espectador guiado por su estimación de ancho de banda
+	MinBitrate      int           // Suelo del bitrate adaptativo (bps)
+	MaxBitrate      int           // Techo del bitrate adaptativo (bps)
+	Renditions      string        // Escalera de calidades, p.ej. "720p:2M,360p:600k" (vacío = una sola)
+	SVC             bool          // Reenviar a cada espectador solo las capas VP9 SVC que admite
+	VideoCodecs     string        // Codecs del video capturado por preferencia, p.ej. "h264,vp8"
+	Width           int           // Ancho de captura deseado (0 = el del dispositivo)
+	Height          int           // Alto de captura deseado (0 = el del dispositivo)
+	FrameRate       float64       // FPS de captura deseados (0 = los del dispositivo)
+	PixelFormats    string        // Formatos de pixel preferidos, p.ej. "mjpeg,yuyv"
+	KeyFrameInterval int          // Frames entre keyframes del video capturado
+	KeyFrameMinInterval time.Duration // Mínimo entre keyframes forzados por PLI/FIR o nuevos espectadores
+	KeyFrameOnJoin  bool          // Forzar un keyframe cuando se conecta un espectador
+	GOPCacheSize    int           // KB de la caché de GOP por capa de video (0 = sin caché)
+	DVRWindow       time.Duration // Tiempo que guarda el buffer DVR (0 = sin time-shift)
+	DVRMaxSize      int           // MB máximos del buffer DVR por capa
+	ClipsPath       string        // Directorio de los clips exportados del buffer DVR
+	VideoBitrate    int           // Bitrate del video capturado (bps)
+	AudioBitrate    int           // Bitrate del audio capturado (bps)
+	AudioChannels   int           // Canales del audio capturado: 1 (mono) o 2 (estéreo)
+	OpusFEC         bool          // FEC en banda de Opus
+	OpusPacketLoss  int           // Pérdidas esperadas (%) con -opus-fec
+	OpusDTX         bool          // No enviar tramas de silencio
+	OpusComplexity  int           // Complejidad del encoder Opus (0-10)
+	OpusFrameDuration time.Duration // Duración de cada trama Opus
 }
 
 // loadConfig parsea los flags de línea de comandos y devuelve un struct Config.
 func loadConfig() *Config {
 	listDevicesFlag := flag.Bool("list-devices", false, "Lista dispositivos multimedia detectados por mediadevices y sale.")
-	videoDeviceArg := flag.String("v", "", "ID o Label del dispositivo de video a usar.")
-	audioDeviceArg := flag.String("a", "", "ID o Label del dispositivo de audio a usar.")
+	videoDeviceArg := flag.String("v", "", "ID o Label del dispositivo de video a usar, o patrón de prueba testsrc:<bars|clock|noise>[:<ancho>x<alto>[@<fps>]], file:<clip.ivf>, rtp:<puerto>:<vp8|vp9|h264|av1>, sdp:<fichero.sdp> o whip[:<vp8|vp9|h264|av1>].")
+	audioDeviceArg := flag.String("a", "", "ID o Label del dispositivo de audio a usar, o fuente de prueba tone:<hz>, sweep:<desde>-<hasta>[@s], pink-noise, white-noise, beep[:<hz>], file:<clip.ogg>, rtp:<puerto>:opus, sdp:<fichero.sdp> o whip.")
+	loopFlag := flag.Bool("loop", true, "Repite en bucle las fuentes de fichero (file:).")
+	startOffsetFlag := flag.Duration("start-offset", 0, "Posición inicial de las fuentes de fichero, p.ej. 30s (también al repetir).")
+	whipTokenFlag := flag.String("whip-token", "", "Bearer token que deben enviar los publicadores WHIP (vacío = sin autenticación).")
+	recordFlag := flag.String("record", "", "Graba el directo (video VP8/VP9 y audio Opus) en ficheros WebM con esta plantilla: %Y %m %d %H %M %S (inicio del fichero), %n (número de fichero), p.ej. grabaciones/%Y%m%d/directo-%H%M%S.webm (vacío = sin grabación).")
+	recordMaxDurationFlag := flag.Duration("record-max-duration", time.Hour, "Duración máxima de cada fichero grabado; al alcanzarla se empieza otro en el siguiente keyframe (0 = sin límite).")
+	recordMaxSizeFlag := flag.Int("record-max-size", 0, "Tamaño máximo (MB) de cada fichero grabado; al alcanzarlo se empieza otro en el siguiente keyframe (0 = sin límite).")
+	recordingsPathFlag := flag.String("recordings-path", defaultRecordingsPath, "Plantilla de las grabaciones bajo demanda (/admin/recordings): admite los mismos campos que -record y %i (ID de la grabación).")
+	adminTokenFlag := flag.String("admin-token", "", "Bearer token de la API de administración (/admin/encoder, /admin/keyframes, /admin/recordings, /admin/clips; vacío = API deshabilitada).")
+	iceServersFlag := flag.String("ice-servers", defaultICEServers, "Lista separada por comas de URLs STUN/TURN (stun:, turn:, turns:, ?transport=tcp). Vacío para redes sin salida a Internet.")
+	turnUsernameFlag := flag.String("turn-username", "", "Usuario para los servidores TURN de -ice-servers.")
+	turnCredentialFlag := flag.String("turn-credential", "", "Contraseña para los servidores TURN de -ice-servers.")
+	turnSecretFlag := flag.String("turn-secret", "", "Secreto compartido (use-auth-secret de coturn) para generar credenciales TURN temporales por sesión.")
+	turnTTLFlag := flag.Duration("turn-ttl", 24*time.Hour, "Validez de las credenciales TURN temporales (-turn-secret y servidor TURN embebido).")
+	turnListenFlag := flag.String("turn-listen", "", "Inicia un servidor TURN embebido en esta dirección (UDP y TCP), p.ej. :3478.")
+	turnRealmFlag := flag.String("turn-realm", "webrtc-streamer", "Realm del servidor TURN embebido.")
+	turnPublicIPFlag := flag.String("turn-public-ip", "", "IPv4 pública que anuncia el servidor TURN embebido (por defecto, la primera IPv4 local).")
+	turnAllowPrivateFlag := flag.Bool("turn-allow-private-peers", false, "Permite que el servidor TURN embebido haga relay hacia direcciones loopback, privadas (RFC 1918) o link-local (por defecto se rechazan).")
+	iceUDPPortFlag := flag.Int("ice-udp-port", 0, "Puerto UDP único por el que se multiplexan todos los PeerConnections (0 = un puerto efímero por conexión).")
+	iceTCPPortFlag := flag.Int("ice-tcp-port", 0, "Puerto TCP para candidatos ICE-TCP pasivos (0 = desactivado).")
+	nat1To1Flag := flag.String("nat-1to1-ips", "", "IPs públicas (separadas por comas, o pública/local) anunciadas en lugar de las locales en los candidatos host, p.ej. detrás de NAT 1:1 o en contenedores.")
+	nackFlag := flag.Bool("nack", true, "Retransmite los paquetes perdidos que pidan los espectadores (NACK).")
+	nackBufferFlag := flag.Int("nack-buffer", 1024, "Paquetes enviados que se guardan por espectador para responder a NACK (potencia de 2, máx. 32768).")
+	rtxFlag := flag.Bool("rtx", true, "Envía las retransmisiones NACK por un flujo RTX separado si el cliente lo soporta.")
+	rtcpReportsFlag := flag.Bool("rtcp-reports", true, "Genera Sender/Receiver Reports RTCP.")
+	rtcpReportIntervalFlag := flag.Duration("rtcp-report-interval", time.Second, "Intervalo de los Sender/Receiver Reports RTCP.")
+	twccFlag := flag.Bool("twcc", true, "Añade números de secuencia de transporte (TWCC) para que los clientes envíen feedback de congestión.")
+	audioREDFlag := flag.Int("audio-red", 0, "Redundancia RED del audio Opus: tramas anteriores que se repiten en cada paquete (0-3, 0 = sin RED). Solo para los espectadores que negocien audio/red.")
+	videoFECFlag := flag.Int("video-fec", 0, "FEC del video: un paquete FlexFEC por cada N paquetes de video (1-15, 0 = sin FEC). Solo para los espectadores que negocien flexfec-03.")
+	adaptiveBitrateFlag := flag.Bool("adaptive-bitrate", false, "Codifica el video capturado por separado para cada espectador, ajustando bitrate, resolución y fps a su ancho de banda estimado (GCC/REMB).")
+	minBitrateFlag := flag.Int("min-bitrate", 150_000, "Bitrate mínimo (bps) del video adaptativo y de la estimación de ancho de banda (con -renditions, el de la rendición más baja).")
+	maxBitrateFlag := flag.Int("max-bitrate", 2_500_000, "Bitrate máximo (bps) del video adaptativo y de la estimación de ancho de banda (con -renditions, el de la más alta más un 30 %).")
+	renditionsFlag := flag.String("renditions", "", "Escalera de calidades del video capturado, p.ej. 1080p:4M,720p:2M,360p:600k. Cada espectador recibe una según su ancho de banda.")
+	svcFlag := flag.Bool("svc", false, "Con una fuente VP9 con capas espaciales/temporales (whip, rtp, sdp), reenvía a cada espectador solo las capas que admite su ancho de banda.")
+	videoCodecFlag := flag.String("video-codec", defaultVideoCodecs, "Codecs del video capturado por orden de preferencia (vp8, vp9, h264; AV1 solo se reenvía desde fuentes whip, rtp o sdp). Cada espectador recibe el primero que admita su navegador.")
+	widthFlag := flag.Int("width", 0, "Ancho de captura deseado; el dispositivo da el más cercano que tenga (0 = el suyo por defecto).")
+	heightFlag := flag.Int("height", 0, "Alto de captura deseado; el dispositivo da el más cercano que tenga (0 = el suyo por defecto).")
+	frameRateFlag := flag.Float64("fps", 0, "FPS de captura deseados (0 = los del dispositivo).")
+	pixelFormatFlag := flag.String("pixel-format", "", "Formatos de pixel de captura por orden de preferencia, p.ej. mjpeg,yuyv (i420, i444, nv12, nv21, yuy2, yuyv, uyvy, rgba, mjpeg).")
+	keyFrameIntervalFlag := flag.Int("keyframe-interval", defaultKeyFrameInterval, "Frames entre keyframes del video capturado.")
+	keyFrameMinIntervalFlag := flag.Duration("keyframe-min-interval", defaultKeyFrameMinInterval, "Tiempo mínimo entre keyframes forzados por PLI/FIR o nuevos espectadores; las peticiones intermedias se agrupan en uno al final del intervalo (0 = sin límite).")
+	gopCacheSizeFlag := flag.Int("gop-cache-size", defaultGOPCacheSize, "KB por capa de video para guardar el GOP en curso y enviarlo a los espectadores nuevos, que ven imagen al instante (0 = sin caché).")
+	dvrWindowFlag := flag.Duration("dvr-window", 0, "Tiempo del directo que se guarda en memoria para que los espectadores puedan verlo con retraso (time-shift), p.ej. 10m (0 = deshabilitado).")
+	dvrMaxSizeFlag := flag.Int("dvr-max-size", defaultDVRMaxSize, "MB máximos del buffer de -dvr-window por pista y capa de video; si no llega, se guarda menos tiempo.")
+	clipsPathFlag := flag.String("clips-path", defaultClipsPath, "Directorio donde se escriben los clips exportados del buffer de -dvr-window (/admin/clips).")
+	keyFrameOnJoinFlag := flag.Bool("keyframe-on-join", true, "Fuerza un keyframe cuando se conecta un espectador para que vea imagen sin esperar al siguiente keyframe periódico.")
+	videoBitrateFlag := flag.Int("video-bitrate", defaultVideoBitrate, "Bitrate (bps) del video capturado.")
+	audioBitrateFlag := flag.Int("audio-bitrate", defaultAudioBitrate, "Bitrate (bps) del audio capturado (Opus).")
+	audioChannelsFlag := flag.Int("audio-channels", 1, "Canales del audio capturado: 1 (mono) o 2 (estéreo).")
+	opusFECFlag := flag.Bool("opus-fec", false, "FEC en banda de Opus: cada paquete lleva una copia de baja calidad del anterior.")
+	opusPacketLossFlag := flag.Int("opus-packet-loss", defaultOpusPacketLoss, "Pérdidas esperadas (%) con las que Opus dimensiona la FEC (-opus-fec).")
+	opusDTXFlag := flag.Bool("opus-dtx", false, "DTX de Opus: no se envían tramas durante los silencios.")
+	opusComplexityFlag := flag.Int("opus-complexity", defaultOpusComplexity, "Complejidad del encoder Opus (0-10): más calidad a cambio de CPU.")
+	opusFrameDurationFlag := flag.Duration("opus-frame-duration", defaultOpusFrameDuration, "Duración de trama Opus: 2.5ms, 5ms, 10ms, 20ms, 40ms o 60ms.")
+	configFileFlag := flag.String("config", "", "Fichero JSON con valores para los flags, p.ej. {\"width\": 1280, \"fps\": 30}. Los flags de la línea de comandos tienen prioridad.")
 	flag.Parse()
+	if *configFileFlag != "" {
+		if err := applyConfigFile(*configFileFlag); err != nil {
+			log.Fatalf("Error: Fichero de configuración '%s': %v", *configFileFlag, err)
+		}
+	}
 
 	return &Config{
 		ListDevices:     *listDevicesFlag,
 		VideoIdentifier: *videoDeviceArg,
 		AudioIdentifier: *audioDeviceArg,
+		Loop:            *loopFlag,
+		StartOffset:     *startOffsetFlag,
+		WHIPToken:       *whipTokenFlag,
+		AdminToken:      *adminTokenFlag,
+		RecordPath:      *recordFlag,
+		RecordMaxDuration: *recordMaxDurationFlag,
+		RecordMaxSize:   *recordMaxSizeFlag,
+		RecordingsPath:  *recordingsPathFlag,
+		ICEServerURLs:   splitList(*iceServersFlag),
+		TURNUsername:    *turnUsernameFlag,
+		TURNCredential:  *turnCredentialFlag,
+		TURNSecret:      *turnSecretFlag,
+		TURNCredentialTTL: *turnTTLFlag,
+		TURNListen:      *turnListenFlag,
+		TURNRealm:       *turnRealmFlag,
+		TURNPublicIP:    *turnPublicIPFlag,
+		TURNAllowPrivatePeers: *turnAllowPrivateFlag,
+		ICEUDPPort:      *iceUDPPortFlag,
+		ICETCPPort:      *iceTCPPortFlag,
+		NAT1To1IPs:      splitList(*nat1To1Flag),
+		NACK:            *nackFlag,
+		NACKBufferSize:  *nackBufferFlag,
+		RTX:             *rtxFlag,
+		RTCPReports:     *rtcpReportsFlag,
+		RTCPReportInterval: *rtcpReportIntervalFlag,
+		TWCC:            *twccFlag,
+		AudioRED:        *audioREDFlag,
+		VideoFEC:        *videoFECFlag,
+		AdaptiveBitrate: *adaptiveBitrateFlag,
+		MinBitrate:      *minBitrateFlag,
+		MaxBitrate:      *maxBitrateFlag,
+		Renditions:      *renditionsFlag,
+		SVC:             *svcFlag,
+		VideoCodecs:     *videoCodecFlag,
+		Width:           *widthFlag,
+		Height:          *heightFlag,
+		FrameRate:       *frameRateFlag,
+		PixelFormats:    *pixelFormatFlag,
+		KeyFrameInterval: *keyFrameIntervalFlag,
+		KeyFrameMinInterval: *keyFrameMinIntervalFlag,
+		KeyFrameOnJoin:  *keyFrameOnJoinFlag,
+		GOPCacheSize:    *gopCacheSizeFlag,
+		DVRWindow:       *dvrWindowFlag,
+		DVRMaxSize:      *dvrMaxSizeFlag,
+		ClipsPath:       *clipsPathFlag,
+		VideoBitrate:    *videoBitrateFlag,
+		AudioBitrate:    *audioBitrateFlag,
+		AudioChannels:   *audioChannelsFlag,
+		OpusFEC:         *opusFECFlag,
+		OpusPacketLoss:  *opusPacketLossFlag,
+		OpusDTX:         *opusDTXFlag,
+		OpusComplexity:  *opusComplexityFlag,
+		OpusFrameDuration: *opusFrameDurationFlag,
 		// VideoDeviceID y AudioDeviceID se llenarán en main.go después de la validación
 	}
-}
\ No newline at end of file
+}
+
+// applyConfigFile da a los flags los valores de un fichero JSON cuyas claves
+// son nombres de flag ("width", "ice-servers"...). Los valores pueden ser
+// cadenas, números, booleanos o listas (se unen con comas). Los flags dados en
+// la línea de comandos no se modifican.
+func applyConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("JSON inválido: %w", err)
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for name, value := range values {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("opción desconocida '%s'", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		var text string
+		switch value := value.(type) {
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			text = strings.Join(items, ",")
+		case float64:
+			text = strconv.FormatFloat(value, 'f', -1, 64) // 1500000, no 1.5e+06
+		default:
+			text = fmt.Sprint(value)
+		}
+		if err := flag.Set(name, text); err != nil {
+			return fmt.Errorf("valor inválido para '%s': %w", name, err)
+		}
+	}
+	return nil
+}
+
+// splitList separa una lista de valores por comas, descartando los vacíos.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
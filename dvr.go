@@ -0,0 +1,440 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Time-shift (DVR, -dvr-window): cada pista compartida guarda en memoria, por
+// capa, los paquetes de los últimos minutos con su instante de llegada. Un
+// espectador puede pedir por WebSocket ver el directo con retraso
+// ({"type":"timeshift","offset":30}): sus pistas dejan de recibir el directo y
+// reproducen el buffer desde el keyframe anterior a ese instante, cada paquete
+// el mismo tiempo después de su llegada, así que audio y video siguen
+// sincronizados. Con "offset":0 vuelve al directo: el video se reproduce desde
+// el último keyframe del buffer a dvrCatchUpSpeedup veces su velocidad hasta
+// alcanzarlo y entonces pasa a recibir los paquetes en directo, sin pedir un
+// keyframe al encoder.
+//
+// El buffer se recorta por tiempo (-dvr-window) y por tamaño (-dvr-max-size
+// por capa). Si el recorte por tamaño alcanza a un espectador que va muy por
+// detrás, salta al primer keyframe que queda.
+
+const (
+	dvrCatchUpSpeedup = gopPrimeSpeedup       // Velocidad al volver al directo
+	dvrReadBatch      = 64                    // Paquetes que se leen del buffer de una vez
+	dvrPollInterval   = 20 * time.Millisecond // Espera cuando no hay paquetes nuevos
+	dvrBurst          = 10 * time.Millisecond // Adelanto permitido antes de esperar
+)
+
+var errDVRNotReady = errors.New("el buffer DVR aún no tiene ningún keyframe")
+
+// dvrPacket es un paquete del buffer con su instante de llegada.
+type dvrPacket struct {
+	pkt        *rtp.Packet
+	descriptor vp9Descriptor
+	at         time.Time
+	size       int
+	keyFrame   bool // Primer paquete de un keyframe (en audio, todos)
+}
+
+// dvrBuffer guarda los últimos paquetes de cada capa de una FanoutTrack.
+type dvrBuffer struct {
+	trackID  string
+	mimeType string
+	video    bool
+	window   time.Duration
+	maxBytes int
+
+	mutex  sync.Mutex
+	layers []dvrLayer
+}
+
+type dvrLayer struct {
+	packets []dvrPacket
+	first   uint64 // Índice absoluto de packets[0]
+	bytes   int
+	full    bool // Ya se avisó de que maxBytes no llega a window
+}
+
+func newDVRBuffer(trackID, mimeType string, video bool, layers int, window time.Duration, maxBytes int) *dvrBuffer {
+	return &dvrBuffer{
+		trackID:  trackID,
+		mimeType: mimeType,
+		video:    video,
+		window:   window,
+		maxBytes: maxBytes,
+		layers:   make([]dvrLayer, layers),
+	}
+}
+
+// add guarda una copia del paquete y descarta los que han salido de la
+// ventana o no caben.
+func (d *dvrBuffer) add(layer int, pkt *rtp.Packet, descriptor vp9Descriptor, at time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if layer < 0 || layer >= len(d.layers) {
+		return
+	}
+	l := &d.layers[layer]
+
+	// Como en la caché de GOP, un frame clave que continúa (SPS/PPS y después
+	// el IDR en H.264) o una capa espacial superior de VP9 no es un punto de
+	// arranque.
+	keyFrame := !d.video
+	if d.video && isKeyFrameStart(d.mimeType, pkt.Payload) && !(descriptor.hasLayers && descriptor.spatial > 0) {
+		last := len(l.packets) - 1
+		keyFrame = last < 0 || l.packets[last].pkt.SSRC != pkt.SSRC || l.packets[last].pkt.Timestamp != pkt.Timestamp
+	}
+	size := pkt.MarshalSize()
+	l.packets = append(l.packets, dvrPacket{pkt: pkt.Clone(), descriptor: descriptor, at: at, size: size, keyFrame: keyFrame})
+	l.bytes += size
+
+	cut := 0
+	for cut < len(l.packets)-1 && (at.Sub(l.packets[cut].at) > d.window || l.bytes > d.maxBytes) {
+		if !l.full && at.Sub(l.packets[cut].at) <= d.window {
+			log.Printf("FanoutTrack(%s): El buffer DVR llega a %d MB con %v; guarda menos que -dvr-window.",
+				d.trackID, d.maxBytes/(1024*1024), at.Sub(l.packets[cut].at).Round(time.Second))
+			l.full = true
+		}
+		l.bytes -= l.packets[cut].size
+		l.packets[cut] = dvrPacket{} // Libera el paquete aunque el array siga en uso
+		cut++
+	}
+	l.packets = l.packets[cut:]
+	l.first += uint64(cut)
+}
+
+// seek devuelve el índice y la llegada del punto desde el que reproducir la
+// capa para ver el instante indicado: el último keyframe anterior o, si el
+// buffer empieza después, el primero. ok es false si no hay ninguno.
+func (d *dvrBuffer) seek(layer int, at time.Time) (index uint64, start time.Time, ok bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.seekLocked(layer, at)
+}
+
+func (d *dvrBuffer) seekLocked(layer int, at time.Time) (index uint64, start time.Time, ok bool) {
+	if layer < 0 || layer >= len(d.layers) {
+		return 0, time.Time{}, false
+	}
+	packets := d.layers[layer].packets
+	i := sort.Search(len(packets), func(i int) bool { return packets[i].at.After(at) }) - 1
+	for i >= 0 && !packets[i].keyFrame {
+		i--
+	}
+	if i < 0 {
+		for i = 0; i < len(packets) && !packets[i].keyFrame; i++ {
+		}
+		if i == len(packets) {
+			return 0, time.Time{}, false
+		}
+	}
+	return d.layers[layer].first + uint64(i), packets[i].at, true
+}
+
+// read devuelve hasta max paquetes de la capa a partir del índice next, y el
+// índice siguiente al último guardado. trimmed indica que next ya no está en
+// el buffer.
+func (d *dvrBuffer) read(layer int, next uint64, max int) (packets []dvrPacket, end uint64, trimmed bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	l := &d.layers[layer]
+	end = l.first + uint64(len(l.packets))
+	if next < l.first {
+		return nil, end, true
+	}
+	if next >= end {
+		return nil, end, false
+	}
+	from := int(next - l.first)
+	to := min(from+max, len(l.packets))
+	return append([]dvrPacket(nil), l.packets[from:to]...), end, false
+}
+
+// slice devuelve los paquetes de la capa desde el punto de arranque para ver
+// el instante from (ver seek) hasta los que llegaron en to.
+func (d *dvrBuffer) slice(layer int, from, to time.Time) []dvrPacket {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	index, _, ok := d.seekLocked(layer, from)
+	if !ok {
+		return nil
+	}
+	l := &d.layers[layer]
+	first := int(index - l.first)
+	last := sort.Search(len(l.packets), func(i int) bool { return l.packets[i].at.After(to) })
+	if last <= first {
+		return nil
+	}
+	return append([]dvrPacket(nil), l.packets[first:last]...)
+}
+
+// dvrPlayback es la reproducción del buffer para una vinculación.
+type dvrPlayback struct {
+	layer    int
+	delay    time.Duration // Retraso respecto a la llegada; 0 = alcanzando el directo
+	stopped  chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func (p *dvrPlayback) stop() {
+	p.stopOnce.Do(func() { close(p.stopped) })
+}
+
+// wait espera d o hasta que se detiene la reproducción; devuelve false en
+// ese caso.
+func (p *dvrPlayback) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-p.stopped:
+		return false
+	}
+}
+
+// EnableDVR guarda los paquetes de la fuente de los últimos window (hasta
+// maxBytes por capa) para que los espectadores puedan verlos con retraso.
+func (t *FanoutTrack) EnableDVR(window time.Duration, maxBytes int) {
+	if window <= 0 || maxBytes <= 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.dvr = newDVRBuffer(t.id, t.codec.MimeType, t.kind == webrtc.RTPCodecTypeVideo, t.layers, window, maxBytes)
+}
+
+// DVREnabled indica si la pista guarda un buffer DVR.
+func (t *FanoutTrack) DVREnabled() bool {
+	return t.dvrBuffer() != nil
+}
+
+func (t *FanoutTrack) dvrBuffer() *dvrBuffer {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.dvr
+}
+
+// DVRStart devuelve la llegada del keyframe desde el que la vinculación con
+// el SSRC indicado reproduciría el buffer para ver el instante at (el más
+// antiguo si at es anterior al buffer).
+func (t *FanoutTrack) DVRStart(ssrc uint32, at time.Time) (time.Time, bool) {
+	binding, dvr := t.bindingBySSRC(ssrc), t.dvrBuffer()
+	if binding == nil || dvr == nil {
+		return time.Time{}, false
+	}
+	_, start, ok := dvr.seek(int(binding.layer.Load()), at)
+	return start, ok
+}
+
+// DVRRange devuelve los paquetes guardados de la capa desde el keyframe
+// anterior a from hasta to, p.ej. para exportar un clip.
+func (t *FanoutTrack) DVRRange(layer int, from, to time.Time) []dvrPacket {
+	dvr := t.dvrBuffer()
+	if dvr == nil {
+		return nil
+	}
+	return dvr.slice(layer, from, to)
+}
+
+// TimeShift hace que la vinculación con el SSRC indicado reciba, en lugar del
+// directo, los paquetes del buffer desde el keyframe anterior a from, cada
+// uno delay después de su llegada. Con delay 0 vuelve al directo.
+func (t *FanoutTrack) TimeShift(ssrc uint32, from time.Time, delay time.Duration) bool {
+	binding, dvr := t.bindingBySSRC(ssrc), t.dvrBuffer()
+	if binding == nil || dvr == nil {
+		return false
+	}
+	previous := binding.timeshift.Load()
+	if delay <= 0 && previous == nil {
+		return true // Ya está en directo
+	}
+	layer := int(binding.layer.Load())
+	var index uint64
+	ok := false
+	if delay > 0 {
+		if index, _, ok = dvr.seek(layer, from); !ok {
+			return false
+		}
+	} else if t.kind == webrtc.RTPCodecTypeVideo {
+		index, _, ok = dvr.seek(layer, time.Now())
+	}
+	if previous != nil {
+		previous.stop()
+		<-previous.done
+	}
+
+	if !ok {
+		// Al directo sin pasar por el buffer: el audio no lo necesita y el
+		// video, sin keyframe en el buffer, espera al siguiente.
+		binding.writeMutex.Lock()
+		binding.timeshift.Store(nil)
+		binding.rewriter.restart()
+		binding.writeMutex.Unlock()
+		if t.kind == webrtc.RTPCodecTypeVideo {
+			t.requestKeyFrame(layer, keyFrameReasonTimeShift, binding.id)
+		}
+		return true
+	}
+	playback := &dvrPlayback{layer: layer, delay: max(delay, 0), stopped: make(chan struct{}), done: make(chan struct{})}
+	binding.writeMutex.Lock()
+	binding.timeshift.Store(playback)
+	binding.writeMutex.Unlock()
+	go t.playDVR(binding, dvr, playback, index)
+	return true
+}
+
+// playDVR envía a la vinculación los paquetes del buffer desde el índice
+// next: con retraso, cada uno playback.delay después de su llegada; al volver
+// al directo, a dvrCatchUpSpeedup veces su ritmo hasta alcanzar el final del
+// buffer. Termina al detenerse la reproducción o al devolver la vinculación
+// al directo.
+func (t *FanoutTrack) playDVR(b *fanoutBinding, dvr *dvrBuffer, playback *dvrPlayback, next uint64) {
+	defer close(playback.done)
+	begin := time.Now()
+	var origin, start time.Time // Llegada del primer paquete y cuándo se envió
+	restarted, sent := false, 0
+	for {
+		packets, _, trimmed := dvr.read(playback.layer, next, dvrReadBatch)
+		if trimmed {
+			index, _, ok := dvr.seek(playback.layer, time.Time{})
+			if !ok {
+				if !playback.wait(dvrPollInterval) {
+					return
+				}
+				continue
+			}
+			log.Printf("FanoutTrack(%s): El buffer DVR se ha recortado por delante de %s; salta %d paquetes.", t.id, b.id, index-next)
+			next = index
+			continue
+		}
+		if len(packets) == 0 {
+			if playback.delay == 0 && t.handOver(b, dvr, playback, next) {
+				log.Printf("FanoutTrack(%s): %s ha vuelto al directo (%d paquetes del buffer en %v).",
+					t.id, b.id, sent, time.Since(begin).Round(time.Millisecond))
+				return
+			}
+			if !playback.wait(dvrPollInterval) {
+				return
+			}
+			continue
+		}
+
+		for _, packet := range packets {
+			if origin.IsZero() {
+				origin, start = packet.at, time.Now()
+			}
+			due := packet.at.Add(playback.delay)
+			if playback.delay == 0 {
+				due = start.Add(packet.at.Sub(origin) / dvrCatchUpSpeedup)
+			}
+			if wait := time.Until(due); wait > dvrBurst && !playback.wait(wait) {
+				return
+			}
+
+			b.writeMutex.Lock()
+			if b.timeshift.Load() != playback {
+				b.writeMutex.Unlock()
+				return
+			}
+			if !restarted {
+				b.rewriter.restart()
+				restarted = true
+			}
+			if t.writePacket(b, packet.pkt, packet.descriptor, time.Now()) > 0 {
+				b.primed = true
+			}
+			b.writeMutex.Unlock()
+			next++
+			sent++
+		}
+	}
+}
+
+// handOver devuelve la vinculación al directo si la reproducción ha llegado
+// al final del buffer. Con t.mutex bloqueado no hay ningún paquete de la
+// fuente a medio repartir, así que el siguiente paquete en directo es el
+// primero que no se ha reproducido. Devuelve true si la reproducción debe
+// terminar.
+func (t *FanoutTrack) handOver(b *fanoutBinding, dvr *dvrBuffer, playback *dvrPlayback, next uint64) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, end, _ := dvr.read(playback.layer, next, 0); end != next {
+		return false
+	}
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	if b.timeshift.Load() == playback {
+		b.timeshift.Store(nil)
+	}
+	return true
+}
+
+// dvrViewer lleva el time-shift de las pistas de un espectador.
+type dvrViewer struct {
+	clientID string
+	tracks   []dvrViewerTrack // La primera (el video, si hay) marca el punto de arranque
+
+	mutex  sync.Mutex
+	offset time.Duration
+}
+
+type dvrViewerTrack struct {
+	track *FanoutTrack
+	ssrc  uint32
+}
+
+func newDVRViewer(clientID string, tracks []dvrViewerTrack) *dvrViewer {
+	return &dvrViewer{clientID: clientID, tracks: tracks}
+}
+
+// Seek pasa a ver el directo offset por detrás (0 = en directo). Como la
+// reproducción empieza en un keyframe, devuelve el retraso real.
+func (v *dvrViewer) Seek(offset time.Duration) (time.Duration, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if offset <= 0 {
+		for _, t := range v.tracks {
+			t.track.TimeShift(t.ssrc, time.Time{}, 0)
+		}
+		if v.offset > 0 {
+			log.Printf("[%s] Time-shift: volviendo al directo.", v.clientID)
+		}
+		v.offset = 0
+		return 0, nil
+	}
+
+	now := time.Now()
+	from, ok := v.tracks[0].track.DVRStart(v.tracks[0].ssrc, now.Add(-offset))
+	if !ok {
+		return v.offset, errDVRNotReady
+	}
+	delay := now.Sub(from)
+	for _, t := range v.tracks {
+		if !t.track.TimeShift(t.ssrc, from, delay) {
+			log.Printf("[%s] Time-shift: la pista %s no tiene datos desde ese instante.", v.clientID, t.track.ID())
+		}
+	}
+	v.offset = delay
+	log.Printf("[%s] Time-shift: viendo el directo %v por detrás (pedido %v).", v.clientID, delay.Round(100*time.Millisecond), offset)
+	return delay, nil
+}
+
+// Available devuelve cuánto puede retroceder el espectador: la antigüedad del
+// primer keyframe del buffer.
+func (v *dvrViewer) Available() time.Duration {
+	from, ok := v.tracks[0].track.DVRStart(v.tracks[0].ssrc, time.Time{})
+	if !ok {
+		return 0
+	}
+	return time.Since(from)
+}
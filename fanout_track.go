@@ -0,0 +1,614 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// FanoutTrack es una pista local (webrtc.TrackLocal) alimentada por una única
+// fuente de paquetes RTP ya codificados. Cada PeerConnection que la usa recibe
+// una copia de los paquetes con su propio SSRC, payload type, número de
+// secuencia y timestamp, de modo que el coste de codificar no crece con el
+// número de espectadores.
+//
+// Una FanoutTrack puede tener varias capas (rendiciones de la misma fuente,
+// 0 = la de más calidad): cada vinculación recibe solo los paquetes de su capa
+// y cambia de capa en el siguiente keyframe de la nueva.
+//
+// Con EnableSVC, los paquetes VP9 con capas espaciales/temporales se filtran
+// por vinculación según las capas máximas fijadas con SetBindingMaxLayers.
+//
+// Con EnableGOPCache, cada vinculación nueva empieza recibiendo el GOP en
+// caché de su capa (ver gop_cache.go).
+//
+// Con EnableDVR, la pista guarda los últimos minutos de cada capa y cada
+// vinculación puede recibirlos con retraso en lugar del directo (ver dvr.go).
+type FanoutTrack struct {
+	id       string
+	streamID string
+	codec    webrtc.RTPCodecCapability
+	kind     webrtc.RTPCodecType
+	layers   int
+
+	mutex               sync.RWMutex
+	bindings            map[string]*fanoutBinding
+	defaultLayer        int
+	onKeyFrameRequest   func(layer int)
+	onBandwidthEstimate func(bitrate int)
+	svc                 *svcLayerCounters // nil si no se filtran capas SVC
+	keyFrames           *keyFrameLimiter
+	gop                 *gopCache  // nil si no hay caché de GOP
+	dvr                 *dvrBuffer // nil sin -dvr-window
+	sinks               map[*fanoutSink]struct{}
+}
+
+// fanoutSink recibe los paquetes de la fuente de una capa (p.ej. el grabador).
+type fanoutSink struct {
+	layer int
+	write func(pkt *rtp.Packet)
+}
+
+// fanoutBinding guarda el estado de una vinculación (un PeerConnection).
+type fanoutBinding struct {
+	id          string
+	ssrc        uint32
+	payloadType uint8
+	writeStream webrtc.TrackLocalWriter
+
+	writeMutex sync.Mutex // Protege rewriter y svc (las capas se escriben desde varias goroutines)
+	rewriter   rtpRewriter
+	svc        *vp9LayerFilter // nil si no se filtran capas SVC
+	primed     bool            // Ya ha recibido algún paquete (del GOP en caché o en directo)
+	priming    bool            // Se le está enviando el GOP en caché
+	backlog    []gopPacket     // Paquetes en directo que esperan a que termine el GOP
+	backlogLen int             // Bytes en backlog
+	backlogMax int             // Bytes de backlog a partir de los que se abandona el GOP
+	waitKey    bool            // Se abandonó el GOP; espera al siguiente keyframe en directo
+
+	timeshift atomic.Pointer[dvrPlayback] // Reproducción del buffer DVR (nil = en directo)
+
+	layer        atomic.Int32  // Capa que recibe
+	pendingLayer atomic.Int32  // Capa a la que pasará en su próximo keyframe (-1 = ninguna)
+	fractionLost atomic.Uint32 // Último "fraction lost" de sus Receiver Reports (x/256)
+	remb         atomic.Int64  // Último REMB recibido (bps)
+}
+
+// FanoutBindingStats resume el estado de una vinculación.
+type FanoutBindingStats struct {
+	Layer        int
+	PendingLayer int     // -1 si no hay cambio pendiente
+	FractionLost float64 // 0..1
+	REMB         int     // bps, 0 si el espectador no envía REMB
+}
+
+func NewFanoutTrack(codec webrtc.RTPCodecCapability, id, streamID string) *FanoutTrack {
+	return NewLayeredFanoutTrack(codec, id, streamID, 1)
+}
+
+// NewLayeredFanoutTrack crea una FanoutTrack con el número de capas indicado,
+// que se alimentan con WriteLayerRTP.
+func NewLayeredFanoutTrack(codec webrtc.RTPCodecCapability, id, streamID string, layers int) *FanoutTrack {
+	kind := webrtc.RTPCodecTypeVideo
+	if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
+		kind = webrtc.RTPCodecTypeAudio
+	}
+	return &FanoutTrack{
+		id:        id,
+		streamID:  streamID,
+		codec:     codec,
+		kind:      kind,
+		layers:    max(layers, 1),
+		bindings:  make(map[string]*fanoutBinding),
+		keyFrames: newKeyFrameLimiter(id),
+	}
+}
+
+func (t *FanoutTrack) ID() string                       { return t.id }
+func (t *FanoutTrack) RID() string                      { return "" }
+func (t *FanoutTrack) StreamID() string                 { return t.streamID }
+func (t *FanoutTrack) Kind() webrtc.RTPCodecType        { return t.kind }
+func (t *FanoutTrack) Codec() webrtc.RTPCodecCapability { return t.codec }
+
+// Bind se llama desde el PeerConnection cuando termina la negociación.
+// Busca nuestro codec entre los negociados y registra la vinculación.
+func (t *FanoutTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	var selected *webrtc.RTPCodecParameters
+	for _, c := range ctx.CodecParameters() {
+		if strings.EqualFold(c.MimeType, t.codec.MimeType) {
+			selected = &c
+			break
+		}
+	}
+	if selected == nil {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+	// Si el espectador negoció RED para nuestro Opus, la pista se vincula como
+	// audio/red: seguimos escribiendo con el payload type de Opus y el
+	// interceptor RED encapsula los paquetes.
+	bound := *selected
+	if red, ok := redCodecFor(ctx.CodecParameters(), *selected); ok {
+		bound = red
+	}
+
+	binding := &fanoutBinding{
+		id:          ctx.ID(),
+		ssrc:        uint32(ctx.SSRC()),
+		payloadType: uint8(selected.PayloadType),
+		writeStream: ctx.WriteStream(),
+		rewriter:    rtpRewriter{clockRate: t.codec.ClockRate},
+	}
+	binding.pendingLayer.Store(-1)
+
+	t.mutex.Lock()
+	binding.layer.Store(int32(t.defaultLayer))
+	if t.svc != nil {
+		binding.svc = newVP9LayerFilter()
+	}
+	t.bindings[binding.id] = binding
+	total := len(t.bindings)
+	t.mutex.Unlock()
+
+	go t.readRTCP(binding, ctx.RTCPReader())
+	log.Printf("FanoutTrack(%s): Vinculación %s añadida (SSRC=%d, PT=%d). Total: %d", t.id, binding.id, binding.ssrc, binding.payloadType, total)
+	if bound.PayloadType != selected.PayloadType {
+		log.Printf("FanoutTrack(%s): %s recibe %s encapsulado en RED (PT=%d).", t.id, binding.id, t.codec.MimeType, bound.PayloadType)
+	}
+	return bound, nil
+}
+
+// Unbind elimina la vinculación; el bucle RTCP termina solo cuando el
+// PeerConnection cierra su lector.
+func (t *FanoutTrack) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mutex.Lock()
+	binding, exists := t.bindings[ctx.ID()]
+	delete(t.bindings, ctx.ID())
+	total := len(t.bindings)
+	t.mutex.Unlock()
+
+	if !exists {
+		return webrtc.ErrUnbindFailed
+	}
+	if playback := binding.timeshift.Load(); playback != nil {
+		playback.stop()
+	}
+	log.Printf("FanoutTrack(%s): Vinculación %s eliminada. Total: %d", t.id, ctx.ID(), total)
+	return nil
+}
+
+// OnKeyFrameRequest registra la función que se invoca cuando algún
+// espectador pide un keyframe (PLI/FIR).
+func (t *FanoutTrack) OnKeyFrameRequest(f func()) {
+	t.OnLayerKeyFrameRequest(func(int) { f() })
+}
+
+// OnLayerKeyFrameRequest es como OnKeyFrameRequest pero indica la capa que
+// necesita el keyframe.
+func (t *FanoutTrack) OnLayerKeyFrameRequest(f func(layer int)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.onKeyFrameRequest = f
+}
+
+// SetKeyFramePolicy fija el intervalo mínimo entre keyframes forzados y si
+// se pide uno cuando se conecta un espectador.
+func (t *FanoutTrack) SetKeyFramePolicy(policy keyFramePolicy) {
+	t.keyFrames.setPolicy(policy)
+}
+
+// KeyFrameStats devuelve los contadores de peticiones de keyframe.
+func (t *FanoutTrack) KeyFrameStats() keyFrameStats {
+	return t.keyFrames.stats()
+}
+
+// RequestJoinKeyFrame pide un keyframe de la capa que recibe (o espera) la
+// vinculación con el SSRC indicado, si la política lo pide al conectarse.
+func (t *FanoutTrack) RequestJoinKeyFrame(ssrc uint32) {
+	binding := t.bindingBySSRC(ssrc)
+	if binding == nil || !t.keyFrames.onJoin() {
+		return
+	}
+	// Con un GOP en caché el espectador ya arranca con un keyframe.
+	t.mutex.RLock()
+	gop := t.gop
+	t.mutex.RUnlock()
+	layer := binding.keyFrameLayer()
+	if gop != nil && gop.ready(layer) {
+		return
+	}
+	t.requestKeyFrame(layer, keyFrameReasonJoin, binding.id)
+}
+
+// EnableGOPCache guarda el GOP en curso de cada capa (hasta maxBytes por
+// capa) para que los espectadores nuevos arranquen con él.
+func (t *FanoutTrack) EnableGOPCache(maxBytes int) {
+	if t.kind != webrtc.RTPCodecTypeVideo || maxBytes <= 0 {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.gop = newGOPCache(t.id, t.codec.MimeType, t.layers, maxBytes)
+}
+
+// AddSink registra una función que recibe los paquetes de la fuente de la
+// capa indicada antes de reenviarlos. Se llama desde el bucle de reparto, así
+// que no debe bloquear ni conservar el paquete. Devuelve la función que la
+// elimina; después de llamarla ya no se recibe ningún paquete.
+func (t *FanoutTrack) AddSink(layer int, write func(pkt *rtp.Packet)) (remove func()) {
+	sink := &fanoutSink{layer: layer, write: write}
+	t.mutex.Lock()
+	if t.sinks == nil {
+		t.sinks = make(map[*fanoutSink]struct{})
+	}
+	t.sinks[sink] = struct{}{}
+	t.mutex.Unlock()
+	return func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		delete(t.sinks, sink)
+	}
+}
+
+// RequestKeyFrame pide un keyframe de la capa indicada a través del limitador,
+// para usos internos como la grabación.
+func (t *FanoutTrack) RequestKeyFrame(layer int, reason string) {
+	t.requestKeyFrame(layer, reason, "")
+}
+
+// SetDefaultLayer fija la capa con la que empiezan las nuevas vinculaciones.
+func (t *FanoutTrack) SetDefaultLayer(layer int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.defaultLayer = min(max(layer, 0), t.layers-1)
+}
+
+// SwitchLayer pasa la vinculación con el SSRC indicado a otra capa a partir
+// del siguiente keyframe de esa capa, que se pide en el momento.
+func (t *FanoutTrack) SwitchLayer(ssrc uint32, layer int) bool {
+	binding := t.bindingBySSRC(ssrc)
+	if binding == nil || layer < 0 || layer >= t.layers {
+		return false
+	}
+	if int(binding.layer.Load()) == layer {
+		binding.pendingLayer.Store(-1)
+		return true
+	}
+	binding.pendingLayer.Store(int32(layer))
+	t.requestKeyFrame(layer, keyFrameReasonLayer, binding.id)
+	return true
+}
+
+// BindingStats devuelve el estado de la vinculación con el SSRC indicado.
+func (t *FanoutTrack) BindingStats(ssrc uint32) (FanoutBindingStats, bool) {
+	binding := t.bindingBySSRC(ssrc)
+	if binding == nil {
+		return FanoutBindingStats{}, false
+	}
+	return FanoutBindingStats{
+		Layer:        int(binding.layer.Load()),
+		PendingLayer: int(binding.pendingLayer.Load()),
+		FractionLost: float64(binding.fractionLost.Load()) / 256,
+		REMB:         int(binding.remb.Load()),
+	}, true
+}
+
+func (t *FanoutTrack) bindingBySSRC(ssrc uint32) *fanoutBinding {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, b := range t.bindings {
+		if b.ssrc == ssrc {
+			return b
+		}
+	}
+	return nil
+}
+
+// EnableSVC activa el filtrado de capas VP9 SVC por vinculación. Debe
+// llamarse antes de que se vincule ningún espectador.
+func (t *FanoutTrack) EnableSVC() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.svc = &svcLayerCounters{}
+}
+
+// SetBindingMaxLayers fija las capas SVC (índices espacial y temporal) más
+// altas que recibe la vinculación con el SSRC indicado. Subir de capa
+// espacial necesita un keyframe, que se pide en el momento.
+func (t *FanoutTrack) SetBindingMaxLayers(ssrc uint32, spatial, temporal int) bool {
+	binding := t.bindingBySSRC(ssrc)
+	if binding == nil || binding.svc == nil {
+		return false
+	}
+	spatial = min(max(spatial, 0), svcMaxLayers-1)
+	temporal = min(max(temporal, 0), svcMaxLayers-1)
+	previous := int(binding.svc.targetSpatial.Swap(int32(spatial)))
+	binding.svc.targetTemporal.Store(int32(temporal))
+	if spatial > previous {
+		t.requestKeyFrame(int(binding.layer.Load()), keyFrameReasonLayer, binding.id)
+	}
+	return true
+}
+
+// svcBytes devuelve los bytes recibidos de la fuente por capa SVC.
+func (t *FanoutTrack) svcBytes() [svcMaxLayers][svcMaxLayers]int64 {
+	t.mutex.RLock()
+	counters := t.svc
+	t.mutex.RUnlock()
+	if counters == nil {
+		return [svcMaxLayers][svcMaxLayers]int64{}
+	}
+	return counters.snapshot()
+}
+
+// OnBandwidthEstimate registra la función que recibe los REMB (bps) de los
+// espectadores.
+func (t *FanoutTrack) OnBandwidthEstimate(f func(bitrate int)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.onBandwidthEstimate = f
+}
+
+// BindingCount devuelve el número de PeerConnection vinculados.
+func (t *FanoutTrack) BindingCount() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return len(t.bindings)
+}
+
+// WriteRTP reenvía un paquete de la fuente a todas las vinculaciones. El
+// paquete original no se modifica.
+func (t *FanoutTrack) WriteRTP(pkt *rtp.Packet) error {
+	return t.WriteLayerRTP(0, pkt)
+}
+
+// WriteLayerRTP reenvía un paquete de la capa indicada a las vinculaciones
+// que la reciben o que esperan un keyframe suyo para cambiarse a ella.
+func (t *FanoutTrack) WriteLayerRTP(layer int, pkt *rtp.Packet) error {
+	now := time.Now()
+	keyFrameChecked, keyFrame := false, false
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	var descriptor vp9Descriptor
+	if t.svc != nil {
+		descriptor = parseVP9Descriptor(pkt.Payload)
+		if descriptor.hasLayers {
+			t.svc.add(descriptor, len(pkt.Payload))
+		}
+	}
+	if t.gop != nil {
+		t.gop.add(layer, pkt, descriptor)
+	}
+	if t.dvr != nil {
+		t.dvr.add(layer, pkt, descriptor, now)
+	}
+	for sink := range t.sinks {
+		if sink.layer == layer {
+			sink.write(pkt)
+		}
+	}
+
+	for _, b := range t.bindings {
+		if b.timeshift.Load() != nil {
+			continue // Recibe el buffer DVR; los cambios de capa esperan a que vuelva
+		}
+		if int(b.layer.Load()) != layer {
+			if int(b.pendingLayer.Load()) != layer {
+				continue
+			}
+			if !keyFrameChecked {
+				keyFrameChecked, keyFrame = true, isKeyFrameStart(t.codec.MimeType, pkt.Payload)
+			}
+			if !keyFrame || !b.pendingLayer.CompareAndSwap(int32(layer), -1) {
+				continue
+			}
+			b.layer.Store(int32(layer))
+		}
+		t.writeBinding(b, layer, pkt, descriptor, now)
+	}
+	return nil
+}
+
+func (t *FanoutTrack) writeBinding(b *fanoutBinding, layer int, pkt *rtp.Packet, descriptor vp9Descriptor, now time.Time) {
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+
+	if b.timeshift.Load() != nil {
+		return
+	}
+	if b.priming {
+		b.backlog = append(b.backlog, gopPacket{pkt: pkt.Clone(), descriptor: descriptor})
+		b.backlogLen += pkt.MarshalSize()
+		if b.backlogLen > b.backlogMax {
+			t.abandonPrime(b)
+		}
+		return
+	}
+	if b.waitKey {
+		if !isKeyFrameStart(t.codec.MimeType, pkt.Payload) {
+			return
+		}
+		b.waitKey = false
+		b.rewriter.restart() // Continúa la numeración sin el hueco de lo descartado
+	}
+	if !b.primed && t.prime(b, layer, pkt, now) {
+		return
+	}
+	if t.writePacket(b, pkt, descriptor, now) > 0 {
+		b.primed = true
+	}
+}
+
+// writePacket reescribe un paquete de la fuente para la vinculación y lo
+// escribe; devuelve los bytes escritos (0 si se descartó).
+func (t *FanoutTrack) writePacket(b *fanoutBinding, pkt *rtp.Packet, descriptor vp9Descriptor, now time.Time) int {
+	header := pkt.Header
+	if b.svc != nil {
+		forward, marker := b.svc.filter(descriptor, header.Marker)
+		if !forward {
+			b.rewriter.skip()
+			return 0
+		}
+		header.Marker = marker
+	}
+	// Las extensiones de la fuente no tienen sentido en la sesión del espectador;
+	// los interceptores añaden las que se hayan negociado.
+	header.Extension = false
+	header.ExtensionProfile = 0
+	header.Extensions = nil
+	header.SSRC = b.ssrc
+	header.PayloadType = b.payloadType
+	b.rewriter.rewrite(&header, pkt.SSRC, now)
+
+	n, err := b.writeStream.WriteRTP(&header, pkt.Payload)
+	if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		log.Printf("FanoutTrack(%s): Error escribiendo RTP a %s: %v", t.id, b.id, err)
+	}
+	return n
+}
+
+// requestKeyFrame pide un keyframe de la capa indicada a través del
+// limitador; bindingID es quien lo pide, para las estadísticas.
+func (t *FanoutTrack) requestKeyFrame(layer int, reason, bindingID string) {
+	t.mutex.RLock()
+	f := t.onKeyFrameRequest
+	t.mutex.RUnlock()
+	if f != nil {
+		t.keyFrames.request(layer, reason, bindingID, f)
+	}
+}
+
+// keyFrameLayer devuelve la capa para la que la vinculación necesita un
+// keyframe: aquella a la que está cambiando o, si no, la que recibe.
+func (b *fanoutBinding) keyFrameLayer() int {
+	if layer := b.pendingLayer.Load(); layer >= 0 {
+		return int(layer)
+	}
+	return int(b.layer.Load())
+}
+
+func (t *FanoutTrack) bandwidthEstimate(bitrate int) {
+	t.mutex.RLock()
+	f := t.onBandwidthEstimate
+	t.mutex.RUnlock()
+	if f != nil {
+		f(bitrate)
+	}
+}
+
+// readRTCP atiende el RTCP de un espectador: reenvía las peticiones de
+// keyframe a la fuente compartida (a la capa que recibe o espera) y guarda
+// las pérdidas y los REMB que informa. Un FIR repetido con el mismo número de
+// secuencia es una retransmisión de la misma petición (RFC 5104) y se ignora.
+func (t *FanoutTrack) readRTCP(binding *fanoutBinding, reader interceptor.RTCPReader) {
+	bindingID := binding.id
+	lastFIR := -1
+	buf := make([]byte, rtcpInboundMTU)
+	for {
+		n, _, err := reader.Read(buf, interceptor.Attributes{})
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+				log.Printf("FanoutTrack(%s): Lector RTCP de %s terminado: %v", t.id, bindingID, err)
+			}
+			return
+		}
+		pkts, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, pkt := range pkts {
+			switch pkt := pkt.(type) {
+			case *rtcp.PictureLossIndication:
+				// Un keyframe en directo no sirve a quien ve el buffer DVR.
+				if binding.timeshift.Load() == nil {
+					t.requestKeyFrame(binding.keyFrameLayer(), keyFrameReasonPLI, bindingID)
+				}
+			case *rtcp.FullIntraRequest:
+				for _, entry := range pkt.FIR {
+					if binding.timeshift.Load() != nil {
+						break
+					}
+					if entry.SSRC == binding.ssrc && int(entry.SequenceNumber) != lastFIR {
+						lastFIR = int(entry.SequenceNumber)
+						t.requestKeyFrame(binding.keyFrameLayer(), keyFrameReasonFIR, bindingID)
+					}
+				}
+			case *rtcp.ReceiverReport:
+				for _, report := range pkt.Reports {
+					if report.SSRC == binding.ssrc {
+						binding.fractionLost.Store(uint32(report.FractionLost))
+					}
+				}
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				binding.remb.Store(int64(pkt.Bitrate))
+				t.bandwidthEstimate(int(pkt.Bitrate))
+			}
+		}
+	}
+}
+
+// rtpRewriter traduce números de secuencia y timestamps de la fuente al
+// espacio propio de un espectador. Cuando la fuente cambia (otro SSRC, por
+// ejemplo al reiniciar el encoder) recalcula los desplazamientos para que el
+// espectador vea un flujo continuo.
+type rtpRewriter struct {
+	clockRate uint32
+	started   bool
+	srcSSRC   uint32
+	seqOffset uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTS    uint32
+	lastAt    time.Time
+	jump      bool // El siguiente paquete no sigue al anterior (time-shift)
+}
+
+func (r *rtpRewriter) rewrite(h *rtp.Header, srcSSRC uint32, now time.Time) {
+	if !r.started || srcSSRC != r.srcSSRC || r.jump {
+		var tsDelta uint32 = 1
+		if !r.started {
+			r.lastSeq = uint16(rand.Uint32())
+			r.lastTS = rand.Uint32()
+		} else if elapsed := now.Sub(r.lastAt); elapsed > 0 {
+			tsDelta = uint32(elapsed.Seconds()*float64(r.clockRate)) + 1
+		}
+		r.seqOffset = r.lastSeq + 1 - h.SequenceNumber
+		r.tsOffset = r.lastTS + tsDelta - h.Timestamp
+		r.srcSSRC = srcSSRC
+		r.started = true
+		r.jump = false
+	}
+
+	h.SequenceNumber += r.seqOffset
+	h.Timestamp += r.tsOffset
+	if int16(h.SequenceNumber-r.lastSeq) > 0 {
+		r.lastSeq = h.SequenceNumber
+		r.lastTS = h.Timestamp
+		r.lastAt = now
+	}
+}
+
+// skip descuenta un paquete de la fuente que no se reenvía, para que el
+// espectador no vea un hueco en los números de secuencia.
+func (r *rtpRewriter) skip() {
+	if r.started {
+		r.seqOffset--
+	}
+}
+
+// restart hace que el siguiente paquete se trate como el de una fuente nueva,
+// p.ej. al pasar del directo al buffer DVR con el mismo SSRC.
+func (r *rtpRewriter) restart() {
+	r.jump = true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Caché de GOP (-gop-cache-size): cada pista de video guarda, por capa, los
+// paquetes desde el último keyframe. Un espectador nuevo recibe primero ese
+// GOP y después el flujo en directo, así que muestra imagen en cuanto se
+// conecta sin esperar al siguiente keyframe ni forzar uno para todos.
+//
+// El GOP se envía con sus timestamps originales a gopPrimeSpeedup veces su
+// bitrate (enviarlo de golpe desborda los buffers UDP y se pierde buena parte)
+// y los paquetes en directo de ese espectador esperan en cola hasta que lo
+// alcanza; el navegador decodifica los frames atrasados más deprisa hasta
+// llegar al directo.
+//
+// Si un GOP supera el tamaño máximo la caché se vacía hasta el siguiente
+// keyframe, y mientras tanto los espectadores nuevos arrancan como sin caché.
+
+const (
+	gopPrimeSpeedup = 4                     // Velocidad de envío del GOP respecto a su bitrate
+	gopPrimeMinRate = 256 * 1024            // Mínimo de bytes/s al enviar el GOP
+	gopPrimeBurst   = 10 * time.Millisecond // Adelanto permitido antes de esperar
+)
+
+// gopPacket es un paquete guardado con su descriptor VP9 (para el filtrado SVC).
+type gopPacket struct {
+	pkt        *rtp.Packet
+	descriptor vp9Descriptor
+}
+
+// gopCache guarda el GOP en curso de cada capa de una FanoutTrack.
+type gopCache struct {
+	trackID  string
+	mimeType string
+	maxBytes int
+
+	mutex  sync.Mutex
+	layers []gopLayer
+}
+
+type gopLayer struct {
+	packets  []gopPacket
+	bytes    int
+	valid    bool // Empieza en un keyframe y no ha superado maxBytes
+	overflow bool // Ya se avisó de que este GOP no cabe
+}
+
+func newGOPCache(trackID, mimeType string, layers, maxBytes int) *gopCache {
+	return &gopCache{
+		trackID:  trackID,
+		mimeType: mimeType,
+		maxBytes: maxBytes,
+		layers:   make([]gopLayer, layers),
+	}
+}
+
+// add guarda una copia del paquete. Un keyframe empieza un GOP nuevo salvo
+// que continúe el mismo frame (p.ej. SPS/PPS y después el IDR en H.264) o sea
+// una capa espacial superior de VP9 SVC.
+func (c *gopCache) add(layer int, pkt *rtp.Packet, descriptor vp9Descriptor) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if layer < 0 || layer >= len(c.layers) {
+		return
+	}
+	l := &c.layers[layer]
+
+	keyFrame := isKeyFrameStart(c.mimeType, pkt.Payload) && !(descriptor.hasLayers && descriptor.spatial > 0)
+	sameFrame := len(l.packets) > 0 && l.packets[0].pkt.SSRC == pkt.SSRC && l.packets[0].pkt.Timestamp == pkt.Timestamp
+	if keyFrame && !(l.valid && sameFrame) {
+		l.packets, l.bytes, l.valid, l.overflow = l.packets[:0], 0, true, false
+	}
+	if !l.valid {
+		return
+	}
+	size := pkt.MarshalSize()
+	if l.bytes+size > c.maxBytes {
+		if !l.overflow {
+			log.Printf("FanoutTrack(%s): El GOP supera %d KB; sin caché hasta el próximo keyframe.", c.trackID, c.maxBytes/1024)
+		}
+		l.packets, l.bytes, l.valid, l.overflow = nil, 0, false, true
+		return
+	}
+	l.packets = append(l.packets, gopPacket{pkt: pkt.Clone(), descriptor: descriptor})
+	l.bytes += size
+}
+
+// snapshot devuelve los paquetes guardados de la capa (nil si no hay GOP
+// completo desde su keyframe).
+func (c *gopCache) snapshot(layer int) []gopPacket {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if layer < 0 || layer >= len(c.layers) || !c.layers[layer].valid {
+		return nil
+	}
+	return append([]gopPacket(nil), c.layers[layer].packets...)
+}
+
+// ready indica si la capa tiene un GOP con el que arrancar a un espectador.
+func (c *gopCache) ready(layer int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return layer >= 0 && layer < len(c.layers) && c.layers[layer].valid && len(c.layers[layer].packets) > 0
+}
+
+// prime empieza a enviar a una vinculación que aún no ha recibido nada el GOP
+// en caché de su capa, que termina en el paquete actual. Devuelve false si no
+// hay GOP con el que arrancar y el paquete debe escribirse normalmente. Se
+// llama con b.writeMutex bloqueado.
+//
+// Hasta que el transporte está listo (SRTP establecido) pion descarta los
+// paquetes y WriteRTP devuelve 0 bytes; en ese caso se reintenta con el
+// siguiente paquete, para que el keyframe no se pierda.
+func (t *FanoutTrack) prime(b *fanoutBinding, layer int, pkt *rtp.Packet, now time.Time) bool {
+	if t.gop == nil {
+		return false
+	}
+	cached := t.gop.snapshot(layer)
+	last := len(cached) - 1
+	if last < 0 || cached[last].pkt.SSRC != pkt.SSRC || cached[last].pkt.SequenceNumber != pkt.SequenceNumber {
+		return false
+	}
+	if t.writePacket(b, cached[0].pkt, cached[0].descriptor, now) == 0 {
+		return true
+	}
+	b.priming, b.backlogMax = true, t.gop.maxBytes
+	go t.sendGOP(b, cached)
+	return true
+}
+
+// sendGOP envía el resto del GOP y después los paquetes en directo que se han
+// acumulado mientras tanto, al ritmo de gopPrimeRate. Termina cuando la cola
+// se vacía, la vinculación desaparece o se abandona el arranque.
+func (t *FanoutTrack) sendGOP(b *fanoutBinding, cached []gopPacket) {
+	rate := gopPrimeRate(cached, t.codec.ClockRate)
+	start := time.Now()
+	queue, sent, total := cached[1:], cached[0].pkt.MarshalSize(), 1
+	for {
+		t.mutex.RLock()
+		_, bound := t.bindings[b.id]
+		t.mutex.RUnlock()
+
+		b.writeMutex.Lock()
+		if !b.priming {
+			b.writeMutex.Unlock()
+			return // abandonPrime
+		}
+		if len(queue) == 0 {
+			queue, b.backlog, b.backlogLen = b.backlog, nil, 0
+		}
+		if len(queue) == 0 || !bound || b.timeshift.Load() != nil {
+			b.priming, b.primed, b.backlog, b.backlogLen = false, true, nil, 0
+			b.writeMutex.Unlock()
+			log.Printf("FanoutTrack(%s): %s arrancó con el GOP en caché (%d paquetes, %d KB en %v).",
+				t.id, b.id, total, sent/1024, time.Since(start).Round(time.Millisecond))
+			return
+		}
+		for len(queue) > 0 && time.Duration(float64(sent)/rate*float64(time.Second)) <= time.Since(start)+gopPrimeBurst {
+			t.writePacket(b, queue[0].pkt, queue[0].descriptor, time.Now())
+			sent += queue[0].pkt.MarshalSize()
+			queue = queue[1:]
+			total++
+		}
+		b.writeMutex.Unlock()
+
+		if wait := time.Duration(float64(sent)/rate*float64(time.Second)) - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// abandonPrime deja de enviar el GOP a una vinculación cuyo backlog supera
+// backlogMax (el espectador no consume al ritmo del directo) y descarta lo
+// acumulado; recibirá el directo desde el siguiente keyframe. Se llama con
+// b.writeMutex bloqueado.
+func (t *FanoutTrack) abandonPrime(b *fanoutBinding) {
+	log.Printf("FanoutTrack(%s): %s acumuló %d KB en directo sin terminar el GOP en caché; se abandona y espera al siguiente keyframe.",
+		t.id, b.id, b.backlogLen/1024)
+	b.priming, b.primed, b.waitKey = false, true, true
+	b.backlog, b.backlogLen = nil, 0
+}
+
+// gopPrimeRate devuelve el ritmo de envío (bytes/s) de un GOP: gopPrimeSpeedup
+// veces el bitrate que indican sus timestamps, con un mínimo de gopPrimeMinRate.
+func gopPrimeRate(cached []gopPacket, clockRate uint32) float64 {
+	bytes := 0
+	for _, c := range cached {
+		bytes += c.pkt.MarshalSize()
+	}
+	rate := float64(gopPrimeMinRate)
+	span := cached[len(cached)-1].pkt.Timestamp - cached[0].pkt.Timestamp
+	if span > 0 && clockRate > 0 {
+		rate = max(rate, gopPrimeSpeedup*float64(bytes)*float64(clockRate)/float64(span))
+	}
+	return rate
+}
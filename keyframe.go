@@ -0,0 +1,101 @@
+package main
+
+import "strings"
+
+// isKeyFrameStart indica si el payload RTP es el primer paquete de un
+// keyframe. Se usa para cambiar a un espectador de rendición sin que reciba
+// frames que dependan de otros que no tiene. Para codecs no reconocidos
+// devuelve true (el cambio no espera).
+func isKeyFrameStart(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case "video/vp8":
+		return isVP8KeyFrameStart(payload)
+	case "video/vp9":
+		return isVP9KeyFrameStart(payload)
+	case "video/h264":
+		return isH264KeyFrameStart(payload)
+	case "video/av1":
+		return isAV1KeyFrameStart(payload)
+	}
+	return true
+}
+
+// isVP8KeyFrameStart analiza el descriptor de payload VP8 (RFC 7741) y el bit
+// P de la cabecera del frame.
+func isVP8KeyFrameStart(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	start, partition := payload[0]&0x10 != 0, payload[0]&0x07
+	offset := 1
+	if payload[0]&0x80 != 0 { // X: campos extendidos
+		if len(payload) < 2 {
+			return false
+		}
+		extension := payload[1]
+		offset = 2
+		if extension&0x80 != 0 { // I: PictureID de 7 o 15 bits
+			if len(payload) <= offset {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+		if extension&0x40 != 0 { // L: TL0PICIDX
+			offset++
+		}
+		if extension&0x30 != 0 { // T/K: TID y KEYIDX
+			offset++
+		}
+	}
+	if !start || partition != 0 || len(payload) <= offset {
+		return false
+	}
+	return payload[offset]&0x01 == 0
+}
+
+// isVP9KeyFrameStart usa el descriptor de payload VP9: inicio de frame (B) sin
+// referencias a frames anteriores (P).
+func isVP9KeyFrameStart(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	interPicture, beginning := payload[0]&0x40 != 0, payload[0]&0x08 != 0
+	return beginning && !interPicture
+}
+
+// isH264KeyFrameStart busca un IDR o un SPS en NAL simples, STAP-A o el
+// primer fragmento FU-A.
+func isH264KeyFrameStart(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	isKey := func(nalType byte) bool { return nalType == 5 || nalType == 7 }
+	switch nalType := payload[0] & 0x1f; nalType {
+	case 24: // STAP-A
+		for offset := 1; offset+2 < len(payload); {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			if isKey(payload[offset+2] & 0x1f) {
+				return true
+			}
+			offset += 2 + size
+		}
+		return false
+	case 28: // FU-A
+		return len(payload) > 1 && payload[1]&0x80 != 0 && isKey(payload[1]&0x1f)
+	default:
+		return isKey(nalType)
+	}
+}
+
+// isAV1KeyFrameStart usa la cabecera de agregación AV1: primer paquete de una
+// unidad temporal (Z a 0) que inicia una nueva secuencia de video (N).
+func isAV1KeyFrameStart(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	return payload[0]&0x80 == 0 && payload[0]&0x08 != 0
+}
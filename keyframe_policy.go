@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Peticiones de keyframe a la fuente compartida. Todas pasan por el
+// keyFrameLimiter de la FanoutTrack, que aplica -keyframe-min-interval por
+// capa: la primera petición se atiende en el momento y las que llegan dentro
+// del intervalo se agrupan en un único keyframe al final de este. Así un
+// espectador con muchas pérdidas no dispara el bitrate de todos los demás, y
+// quien pidió el keyframe lo recibe como mucho un intervalo después.
+//
+// Los motivos se cuentan por separado (GET /admin/keyframes) y, si hay
+// peticiones, cada keyFrameLogInterval se registra un resumen con el
+// espectador que más ha pedido, para detectar tormentas de PLI.
+
+const keyFrameLogInterval = 10 * time.Second
+
+// Motivos de una petición de keyframe.
+const (
+	keyFrameReasonPLI       = "pli"       // Picture Loss Indication del espectador
+	keyFrameReasonFIR       = "fir"       // Full Intra Request del espectador
+	keyFrameReasonJoin      = "join"      // Espectador recién conectado (-keyframe-on-join)
+	keyFrameReasonLayer     = "layer"     // Cambio de rendición o subida de capa SVC
+	keyFrameReasonRecord    = "record"    // Inicio de una grabación o de su siguiente fichero
+	keyFrameReasonTimeShift = "timeshift" // Vuelta al directo desde el buffer DVR sin keyframe guardado
+)
+
+// keyFramePolicy configura cómo se atienden las peticiones de keyframe.
+type keyFramePolicy struct {
+	minInterval time.Duration // Mínimo entre keyframes forzados de una capa (0 = sin límite)
+	onJoin      bool          // Pedir un keyframe cuando se conecta un espectador
+}
+
+// keyFrameStats son los contadores de peticiones de una pista desde el arranque.
+type keyFrameStats struct {
+	MinInterval string           `json:"min-interval"`
+	OnJoin      bool             `json:"on-join"`
+	Requests    map[string]int64 `json:"requests"`  // Por motivo
+	Forced      int64            `json:"forced"`    // Keyframes pedidos a la fuente
+	Coalesced   int64            `json:"coalesced"` // Peticiones agrupadas por el intervalo mínimo
+}
+
+// keyFrameLimiter limita y cuenta las peticiones de keyframe de una FanoutTrack.
+type keyFrameLimiter struct {
+	trackID string
+
+	mutex   sync.Mutex
+	policy  keyFramePolicy
+	layers  map[int]*keyFrameLayer
+	totals  keyFrameStats
+	window  keyFrameStats    // Desde el último resumen
+	byPeer  map[string]int64 // Peticiones de cada vinculación desde el último resumen
+	logging bool             // Hay un resumen programado
+}
+
+// keyFrameLayer es el estado de una capa de la fuente.
+type keyFrameLayer struct {
+	last    time.Time // Último keyframe forzado
+	pending bool      // Hay un keyframe diferido programado
+}
+
+func newKeyFrameLimiter(trackID string) *keyFrameLimiter {
+	return &keyFrameLimiter{
+		trackID: trackID,
+		layers:  make(map[int]*keyFrameLayer),
+		totals:  keyFrameStats{Requests: make(map[string]int64)},
+		window:  keyFrameStats{Requests: make(map[string]int64)},
+		byPeer:  make(map[string]int64),
+	}
+}
+
+func (l *keyFrameLimiter) setPolicy(policy keyFramePolicy) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.policy = policy
+}
+
+func (l *keyFrameLimiter) onJoin() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.policy.onJoin
+}
+
+// request atiende una petición de keyframe de la capa indicada: llama a force
+// en el momento, la difiere al final del intervalo mínimo o la descarta si ya
+// hay un keyframe diferido para esa capa.
+func (l *keyFrameLimiter) request(layer int, reason, bindingID string, force func(layer int)) {
+	l.mutex.Lock()
+	l.totals.Requests[reason]++
+	l.window.Requests[reason]++
+	if bindingID != "" {
+		l.byPeer[bindingID]++
+	}
+	if !l.logging {
+		l.logging = true
+		time.AfterFunc(keyFrameLogInterval, l.logSummary)
+	}
+
+	state, ok := l.layers[layer]
+	if !ok {
+		state = &keyFrameLayer{}
+		l.layers[layer] = state
+	}
+	now := time.Now()
+	wait := state.last.Add(l.policy.minInterval).Sub(now)
+	if l.policy.minInterval <= 0 || wait <= 0 {
+		state.last = now
+		l.totals.Forced++
+		l.window.Forced++
+		l.mutex.Unlock()
+		force(layer)
+		return
+	}
+	l.totals.Coalesced++
+	l.window.Coalesced++
+	if state.pending {
+		l.mutex.Unlock()
+		return
+	}
+	state.pending = true
+	l.mutex.Unlock()
+
+	time.AfterFunc(wait, func() {
+		l.mutex.Lock()
+		state.pending = false
+		state.last = time.Now()
+		l.totals.Forced++
+		l.window.Forced++
+		l.mutex.Unlock()
+		force(layer)
+	})
+}
+
+// stats devuelve una copia de los contadores acumulados.
+func (l *keyFrameLimiter) stats() keyFrameStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	stats := l.totals
+	stats.MinInterval = l.policy.minInterval.String()
+	stats.OnJoin = l.policy.onJoin
+	stats.Requests = make(map[string]int64, len(l.totals.Requests))
+	for reason, count := range l.totals.Requests {
+		stats.Requests[reason] = count
+	}
+	return stats
+}
+
+// logSummary registra las peticiones del último periodo y reinicia el periodo.
+func (l *keyFrameLimiter) logSummary() {
+	l.mutex.Lock()
+	window, byPeer := l.window, l.byPeer
+	l.window = keyFrameStats{Requests: make(map[string]int64)}
+	l.byPeer = make(map[string]int64)
+	l.logging = false
+	l.mutex.Unlock()
+
+	var total int64
+	reasons := make([]string, 0, len(window.Requests))
+	for reason, count := range window.Requests {
+		total += count
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	parts := make([]string, len(reasons))
+	for i, reason := range reasons {
+		parts[i] = fmt.Sprintf("%s=%d", reason, window.Requests[reason])
+	}
+	top, topCount := "", int64(0)
+	for bindingID, count := range byPeer {
+		if count > topCount || (count == topCount && bindingID < top) {
+			top, topCount = bindingID, count
+		}
+	}
+	summary := ""
+	if top != "" {
+		summary = fmt.Sprintf("; más activo: %s (%d)", top, topCount)
+	}
+	log.Printf("FanoutTrack(%s): Keyframes en %v: %d peticiones (%s), %d forzados, %d agrupados%s.",
+		l.trackID, keyFrameLogInterval, total, strings.Join(parts, ", "), window.Forced, window.Coalesced, summary)
+}
+
+// requestJoinKeyFrames pide un keyframe de las pistas de video de un
+// espectador que acaba de conectarse, para que no tenga que esperar al
+// siguiente keyframe periódico.
+func requestJoinKeyFrames(pc *webrtc.PeerConnection) {
+	for _, sender := range pc.GetSenders() {
+		track, ok := sender.Track().(*FanoutTrack)
+		if !ok || track.Kind() != webrtc.RTPCodecTypeVideo {
+			continue
+		}
+		for _, encoding := range sender.GetParameters().Encodings {
+			track.RequestJoinKeyFrame(uint32(encoding.SSRC))
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/rtp"
+)
+
+// Encoder compartido del video capturado, reconfigurable en marcha desde la
+// API de administración (/admin/encoder). Un cambio de bitrate, fps,
+// resolución o intervalo de keyframes reconstruye el encoder detrás de la
+// misma FanoutTrack y conservando el empaquetador RTP: los RTPSender de los
+// espectadores siguen enviando la misma pista (sin ReplaceTrack ni
+// renegociación) y ven un flujo continuo que cambia en un keyframe.
+
+// videoEncoderSettings son los parámetros del encoder compartido. Las claves
+// JSON coinciden con los flags de línea de comandos.
+type videoEncoderSettings struct {
+	Bitrate          int     `json:"video-bitrate"`
+	Width            int     `json:"width"`  // 0 = el de la captura
+	Height           int     `json:"height"` // 0 = el de la captura
+	FrameRate        float64 `json:"fps"`    // 0 = los de la captura
+	KeyFrameInterval int     `json:"keyframe-interval"`
+}
+
+func (s videoEncoderSettings) validate() error {
+	if s.Bitrate <= 0 || s.KeyFrameInterval <= 0 || s.Width < 0 || s.Height < 0 || s.FrameRate < 0 {
+		return errors.New("video-bitrate y keyframe-interval deben ser positivos; width, height y fps, positivos o 0")
+	}
+	return nil
+}
+
+// size calcula el tamaño codificado a partir del capturado. Si solo se indica
+// una dimensión se conserva la proporción, y nunca se escala hacia arriba.
+func (s videoEncoderSettings) size(width, height int) (int, int) {
+	w, h := s.Width, s.Height
+	switch {
+	case w == 0 && h == 0:
+		return width, height
+	case w == 0:
+		w = width * h / height
+	case h == 0:
+		h = height * w / width
+	}
+	if w >= width || h >= height {
+		return width, height
+	}
+	return w &^ 1, h &^ 1
+}
+
+// liveVideoEncoder codifica el video capturado para todos los espectadores de
+// un codec.
+type liveVideoEncoder struct {
+	track      *mediadevices.VideoTrack
+	codec      videoCodecOption
+	out        *FanoutTrack
+	packetizer rtp.Packetizer
+
+	mutex   sync.Mutex
+	encoder codec.ReadCloser
+	width   int // Tamaño codificado con los settings actuales
+	height  int
+	closed  bool
+}
+
+func startLiveVideoEncoder(track *mediadevices.VideoTrack, videoCodec videoCodecOption, settings videoEncoderSettings, out *FanoutTrack) (*liveVideoEncoder, error) {
+	rtpCodec := videoCodec.rtpCodec
+	e := &liveVideoEncoder{
+		track:      track,
+		codec:      videoCodec,
+		out:        out,
+		packetizer: rtp.NewPacketizer(rtpOutboundMTU, uint8(rtpCodec.PayloadType), rand.Uint32(), rtpCodec.Payloader, rtp.NewRandomSequencer(), rtpCodec.ClockRate),
+	}
+	encoder, width, height, err := e.build(settings)
+	if err != nil {
+		return nil, err
+	}
+	e.encoder, e.width, e.height = encoder, width, height
+	out.OnKeyFrameRequest(e.forceKeyFrame)
+	go e.run()
+	return e, nil
+}
+
+// build crea un encoder con los settings indicados y devuelve el tamaño que
+// codificará.
+func (e *liveVideoEncoder) build(settings videoEncoderSettings) (codec.ReadCloser, int, int, error) {
+	videoCodec := e.codec
+	videoCodec.keyFrameInterval = settings.KeyFrameInterval
+	var width, height int
+	encoder, err := buildScaledVideoEncoder(e.track, videoCodec, settings.Bitrate, func(capturedWidth, capturedHeight int) (int, int) {
+		width, height = settings.size(capturedWidth, capturedHeight)
+		return width, height
+	}, float32(settings.FrameRate))
+	return encoder, width, height, err
+}
+
+func (e *liveVideoEncoder) run() {
+	last := time.Now()
+	clockRate := e.codec.rtpCodec.ClockRate
+	for {
+		e.mutex.Lock()
+		encoder := e.encoder
+		e.mutex.Unlock()
+
+		data, release, err := encoder.Read()
+		if err != nil {
+			e.mutex.Lock()
+			closed, replaced := e.closed, e.encoder != encoder
+			e.mutex.Unlock()
+			if closed {
+				return
+			}
+			if !replaced {
+				log.Printf("MediaManager: Encoder de %s detenido: %v", e.out.ID(), err)
+				return
+			}
+			continue
+		}
+		now := time.Now()
+		samples := uint32(now.Sub(last).Seconds() * float64(clockRate))
+		last = now
+		for _, pkt := range e.packetizer.Packetize(data, samples) {
+			e.out.WriteRTP(pkt)
+		}
+		release()
+	}
+}
+
+// Reconfigure sustituye el encoder por uno con los nuevos settings. Si no se
+// puede crear, se sigue con el actual.
+func (e *liveVideoEncoder) Reconfigure(settings videoEncoderSettings) error {
+	encoder, width, height, err := e.build(settings)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		encoder.Close()
+		return errors.New("encoder cerrado")
+	}
+	e.encoder.Close()
+	e.encoder, e.width, e.height = encoder, width, height
+	return nil
+}
+
+// encodedSize es el tamaño que codifica un encoder.
+type encodedSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Size devuelve el tamaño que se está codificando.
+func (e *liveVideoEncoder) Size() encodedSize {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return encodedSize{Width: e.width, Height: e.height}
+}
+
+func (e *liveVideoEncoder) forceKeyFrame() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if keyFrameController, ok := e.encoder.Controller().(codec.KeyFrameController); ok {
+		if err := keyFrameController.ForceKeyFrame(); err != nil {
+			log.Printf("MediaManager: Error forzando keyframe en %s: %v", e.out.ID(), err)
+		}
+	}
+}
+
+func (e *liveVideoEncoder) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	if err := e.encoder.Close(); err != nil {
+		return fmt.Errorf("encoder %s: %w", e.codec.rtpCodec.MimeType, err)
+	}
+	return nil
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	// "flag" // No se usa directamente aquí, loadConfig lo maneja
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/pion/mediadevices"
 	// Drivers necesarios para que EnumerateDevices funcione correctamente al inicio
@@ -99,18 +105,31 @@ func main() {
 	}
 	log.Printf("Solicitado: Video='%s', Audio='%s'\n", cfg.VideoIdentifier, cfg.AudioIdentifier)
 
+	// Las fuentes sintéticas se registran como drivers antes de enumerar,
+	// así findDevice las resuelve igual que a un dispositivo real.
+	if isTestSourceIdentifier(cfg.VideoIdentifier) {
+		if err := registerTestVideoSource(cfg.VideoIdentifier); err != nil {
+			log.Fatalf("Error: Fuente de video de prueba '%s' inválida: %v", cfg.VideoIdentifier, err)
+		}
+	}
+	if isTestAudioSourceIdentifier(cfg.AudioIdentifier) {
+		if err := registerTestAudioSource(cfg.AudioIdentifier); err != nil {
+			log.Fatalf("Error: Fuente de audio de prueba '%s' inválida: %v", cfg.AudioIdentifier, err)
+		}
+	}
+
 	// Enumerar (de nuevo, necesario para la lógica normal si no se hizo antes para listar)
 	allAvailableDevices := mediadevices.EnumerateDevices()
 
-	// Buscar y validar dispositivos
-	if cfg.VideoIdentifier != "" {
+	// Buscar y validar dispositivos (ficheros e ingesta RTP no pasan por mediadevices)
+	if cfg.VideoIdentifier != "" && !isExternalSourceIdentifier(cfg.VideoIdentifier) {
 		var found bool
 		cfg.VideoDeviceID, found = findDevice(cfg.VideoIdentifier, mediadevices.VideoInput, allAvailableDevices)
 		if !found {
 			log.Fatalf("Error: Dispositivo de video '%s' no encontrado.", cfg.VideoIdentifier)
 		}
 	}
-	if cfg.AudioIdentifier != "" {
+	if cfg.AudioIdentifier != "" && !isExternalSourceIdentifier(cfg.AudioIdentifier) {
 		var found bool
 		cfg.AudioDeviceID, found = findDevice(cfg.AudioIdentifier, mediadevices.AudioInput, allAvailableDevices)
 		if !found {
@@ -127,21 +146,63 @@ func main() {
 	defer mediaManager.Close() // Asegurar que los medios se cierren al final
 
 	// Iniciar WebRTCManager
-	codecSelectorForWebRTC := mediaManager.GetCodecSelector()
-	if codecSelectorForWebRTC == nil {
-		log.Fatal("MediaManager no proporcionó un CodecSelector válido.")
+	codecsForWebRTC := mediaManager.GetCodecs()
+	if len(codecsForWebRTC) == 0 {
+		log.Fatal("MediaManager no proporcionó ningún codec.")
 	}
-	webRTCManager, err := NewWebRTCManager(codecSelectorForWebRTC) // Definido en webrtc_manager.go
+	webRTCManager, err := NewWebRTCManager(codecsForWebRTC, cfg) // Definido en webrtc_manager.go
 	if err != nil {
 		log.Fatalf("Error crítico al iniciar WebRTCManager: %v", err)
 	}
+	defer webRTCManager.Close()
+
+	// Servidor TURN embebido opcional
+	var turnServer *TURNServer
+	if cfg.TURNListen != "" {
+		turnServer, err = NewTURNServer(cfg.TURNListen, cfg.TURNRealm, cfg.TURNPublicIP, cfg.TURNCredentialTTL, cfg.TURNAllowPrivatePeers) // Definido en turn_server.go
+		if err != nil {
+			log.Fatalf("Error crítico al iniciar el servidor TURN: %v", err)
+		}
+		defer turnServer.Close()
+	}
+
+	// Grabaciones del directo en WebM: la continua de -record y las que se
+	// piden bajo demanda a la API de administración.
+	recordings := newRecordingManager(mediaManager, cfg.RecordingsPath, cfg.RecordMaxDuration, int64(cfg.RecordMaxSize)*1024*1024) // Definido en recordings.go
+	defer recordings.Close() // Cierra los ficheros en curso antes que los encoders
+	if cfg.RecordPath != "" {
+		if err := recordings.StartContinuous(cfg.RecordPath); err != nil {
+			log.Fatalf("Error crítico al iniciar la grabación: %v", err)
+		}
+	}
 
 	// Crear e iniciar el servidor
-	srv := NewServer(mediaManager, webRTCManager) // Definido en server.go
+	srv := NewServer(mediaManager, webRTCManager, turnServer) // Definido en server.go
+	srv.SetRecordings(recordings)
+	srv.SetClips(newClipManager(mediaManager, cfg.ClipsPath)) // Definido en clips.go
 	srv.RegisterHandlers()
+	if cfg.AdminToken != "" {
+		srv.RegisterAdminHandlers(cfg.AdminToken)
+	}
+
+	// Con Ctrl+C o SIGTERM se detiene el servidor HTTP para que se ejecuten
+	// los defer (ficheros grabados, encoders, TURN). Una segunda señal termina
+	// el proceso de inmediato.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Printf("Señal %v recibida, deteniendo el servidor...", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Error deteniendo el servidor HTTP: %v", err)
+		}
+	}()
 
 	log.Printf("Servidor HTTP/WebSocket iniciado en http://localhost:%s", port)
-	if err := srv.Start(":" + port); err != nil {
+	if err := srv.Start(":" + port); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("Fallo al iniciar servidor HTTP: %v", err)
 	}
 
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Reproducción de ficheros ya codificados ("-v file:clip.ivf", "-a file:clip.ogg").
+// Los fotogramas se empaquetan en RTP tal cual, sin decodificar ni volver a
+// codificar, y se envían al ritmo que marcan los timestamps del contenedor.
+const fileSourcePrefix = "file:"
+
+func isFileSourceIdentifier(identifier string) bool {
+	return strings.HasPrefix(identifier, fileSourcePrefix)
+}
+
+// mediaFrame es una unidad de acceso del fichero (un fotograma de video o un
+// paquete Opus) con su instante de presentación.
+type mediaFrame struct {
+	data     []byte
+	pts      time.Duration
+	keyFrame bool
+}
+
+// mediaFileReader abstrae los contenedores soportados.
+type mediaFileReader interface {
+	ReadFrame() (mediaFrame, error)
+	Close() error
+}
+
+// openMediaFile abre el fichero según su extensión y devuelve el lector y
+// el codec RTP con el que se empaquetará.
+func openMediaFile(path string) (mediaFileReader, *codec.RTPCodec, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ivf":
+		reader, rtpCodec, err := newIVFFileReader(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return reader, rtpCodec, nil
+	case ".ogg", ".opus":
+		reader, err := newOggOpusFileReader(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return reader, codec.NewRTPOpusCodec(48000), nil
+	default:
+		file.Close()
+		return nil, nil, fmt.Errorf("formato de fichero no soportado '%s' (usa .ivf o .ogg)", filepath.Ext(path))
+	}
+}
+
+// filePlayer lee un fichero y publica sus fotogramas en una FanoutTrack.
+type filePlayer struct {
+	path        string
+	codec       *codec.RTPCodec
+	out         *FanoutTrack
+	loop        bool
+	startOffset time.Duration
+
+	ssrc     uint32
+	sequence uint16
+	tsBase   uint32
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// startFilePlayer valida el fichero, crea la FanoutTrack correspondiente y
+// empieza a reproducir en segundo plano.
+func startFilePlayer(path string, trackID string, loop bool, startOffset time.Duration) (*filePlayer, error) {
+	reader, rtpCodec, err := openMediaFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo abrir '%s': %w", path, err)
+	}
+	reader.Close()
+
+	p := &filePlayer{
+		path:        path,
+		codec:       rtpCodec,
+		out:         NewFanoutTrack(rtpCodec.RTPCodecCapability, trackID, streamID),
+		loop:        loop,
+		startOffset: startOffset,
+		ssrc:        rand.Uint32(),
+		sequence:    uint16(rand.Uint32()),
+		tsBase:      rand.Uint32(),
+		stop:        make(chan struct{}),
+	}
+	p.out.OnKeyFrameRequest(func() {
+		// No hay encoder al que pedir un keyframe: el espectador espera al siguiente del fichero.
+	})
+	go p.run()
+	return p, nil
+}
+
+func (p *filePlayer) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	return nil
+}
+
+func (p *filePlayer) run() {
+	start := time.Now()
+	var mediaBase time.Duration // Tiempo de medio acumulado por las vueltas anteriores
+	isVideo := p.out.Kind() == webrtc.RTPCodecTypeVideo
+
+	for iteration := 1; ; iteration++ {
+		reader, _, err := openMediaFile(p.path)
+		if err != nil {
+			log.Printf("MediaManager: Error reabriendo '%s': %v", p.path, err)
+			return
+		}
+
+		started := false
+		var loopStart, lastPTS, lastDuration time.Duration
+		for {
+			frame, err := reader.ReadFrame()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					log.Printf("MediaManager: Error leyendo '%s': %v", p.path, err)
+				}
+				break
+			}
+			if frame.pts < p.startOffset || (!started && isVideo && !frame.keyFrame) {
+				continue
+			}
+			if !started {
+				loopStart = frame.pts
+				started = true
+			} else if frame.pts > lastPTS {
+				lastDuration = frame.pts - lastPTS
+			}
+			lastPTS = frame.pts
+
+			mediaTime := mediaBase + frame.pts - loopStart
+			select {
+			case <-p.stop:
+				reader.Close()
+				return
+			case <-time.After(time.Until(start.Add(mediaTime))):
+			}
+			p.writeFrame(frame.data, mediaTime, isVideo)
+		}
+		reader.Close()
+
+		if !started {
+			log.Printf("MediaManager: '%s' no tiene fotogramas reproducibles a partir de %v.", p.path, p.startOffset)
+			return
+		}
+		if !p.loop {
+			log.Printf("MediaManager: Reproducción de '%s' terminada.", p.path)
+			return
+		}
+		if lastDuration == 0 {
+			lastDuration = 20 * time.Millisecond
+		}
+		mediaBase += lastPTS - loopStart + lastDuration
+		log.Printf("MediaManager: '%s' reiniciado (vuelta %d).", p.path, iteration+1)
+	}
+}
+
+func (p *filePlayer) writeFrame(data []byte, mediaTime time.Duration, isVideo bool) {
+	timestamp := p.tsBase + uint32(uint64(mediaTime)*uint64(p.codec.ClockRate)/uint64(time.Second))
+	payloads := p.codec.Payloader.Payload(rtpOutboundMTU-12, data)
+	for i, payload := range payloads {
+		pkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         isVideo && i == len(payloads)-1,
+				PayloadType:    uint8(p.codec.PayloadType),
+				SequenceNumber: p.sequence,
+				Timestamp:      timestamp,
+				SSRC:           p.ssrc,
+			},
+			Payload: payload,
+		}
+		p.sequence++
+		p.out.WriteRTP(pkt)
+	}
+}
+
+// maxIVFFrameSize limita el tamaño de un fotograma IVF: la cabecera trae un
+// tamaño de 32 bits y un fichero corrupto no debe forzar una reserva de 4 GB.
+const maxIVFFrameSize = 8 * 1024 * 1024
+
+// ivfFileReader lee ficheros IVF (VP8, VP9 o AV1).
+type ivfFileReader struct {
+	file      *os.File
+	reader    *bufio.Reader
+	mimeType  string
+	timebase  [2]uint64 // Numerador y denominador
+	frameHead [12]byte
+	remaining int64 // Bytes del fichero aún sin leer (-1 = desconocido)
+}
+
+func newIVFFileReader(file *os.File) (*ivfFileReader, *codec.RTPCodec, error) {
+	var header [32]byte
+	r := bufio.NewReader(file)
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, nil, fmt.Errorf("cabecera IVF incompleta: %w", err)
+	}
+	if string(header[0:4]) != "DKIF" {
+		return nil, nil, errors.New("no es un fichero IVF (firma DKIF ausente)")
+	}
+	headerSize := binary.LittleEndian.Uint16(header[6:8])
+	if headerSize > 32 {
+		if _, err := r.Discard(int(headerSize) - 32); err != nil {
+			return nil, nil, err
+		}
+	}
+	remaining := int64(-1)
+	if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+		remaining = info.Size() - int64(max(headerSize, 32))
+	}
+
+	// Bytes 16-19: denominador (p.ej. 30 o 1000); bytes 20-23: numerador.
+	denominator := uint64(binary.LittleEndian.Uint32(header[16:20]))
+	numerator := uint64(binary.LittleEndian.Uint32(header[20:24]))
+	if denominator == 0 || numerator == 0 {
+		return nil, nil, errors.New("base de tiempos IVF inválida")
+	}
+
+	var rtpCodec *codec.RTPCodec
+	switch fourCC := string(header[8:12]); fourCC {
+	case "VP80":
+		rtpCodec = codec.NewRTPVP8Codec(90000)
+	case "VP90":
+		rtpCodec = codec.NewRTPVP9Codec(90000)
+	case "AV01":
+		rtpCodec = newRTPAV1Codec()
+	default:
+		return nil, nil, fmt.Errorf("codec IVF no soportado '%s'", fourCC)
+	}
+
+	return &ivfFileReader{
+		file:      file,
+		reader:    r,
+		mimeType:  rtpCodec.MimeType,
+		timebase:  [2]uint64{numerator, denominator},
+		remaining: remaining,
+	}, rtpCodec, nil
+}
+
+func (r *ivfFileReader) ReadFrame() (mediaFrame, error) {
+	if _, err := io.ReadFull(r.reader, r.frameHead[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return mediaFrame{}, io.EOF // Fichero truncado: se trata como final
+		}
+		return mediaFrame{}, err
+	}
+	size := int64(binary.LittleEndian.Uint32(r.frameHead[0:4]))
+	pts := binary.LittleEndian.Uint64(r.frameHead[4:12])
+	if r.remaining >= 0 {
+		r.remaining -= int64(len(r.frameHead))
+		if size > r.remaining {
+			return mediaFrame{}, io.EOF // Fichero truncado: se trata como final
+		}
+		r.remaining -= size
+	}
+	if size > maxIVFFrameSize {
+		return mediaFrame{}, fmt.Errorf("fotograma IVF de %d bytes (máximo %d): fichero corrupto", size, maxIVFFrameSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		return mediaFrame{}, io.EOF
+	}
+	return mediaFrame{
+		data:     data,
+		pts:      ivfTimestamp(pts, r.timebase[0], r.timebase[1]),
+		keyFrame: isKeyFrameData(r.mimeType, data),
+	}, nil
+}
+
+// ivfTimestamp convierte un pts IVF a tiempo. pts*numerador*1e9 no cabe en 64
+// bits en ficheros largos con bases de tiempo finas, así que se opera con
+// enteros grandes; lo que no cabe en un time.Duration se satura.
+func ivfTimestamp(pts, numerator, denominator uint64) time.Duration {
+	v := new(big.Int).SetUint64(pts)
+	v.Mul(v, new(big.Int).SetUint64(numerator))
+	v.Mul(v, big.NewInt(int64(time.Second)))
+	v.Quo(v, new(big.Int).SetUint64(denominator))
+	if !v.IsInt64() {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(v.Int64())
+}
+
+func (r *ivfFileReader) Close() error {
+	return r.file.Close()
+}
+
+// oggOpusFileReader extrae los paquetes Opus de un fichero Ogg, respetando
+// el "lacing" de segmentos (una página puede contener muchos paquetes y un
+// paquete puede continuar en la página siguiente).
+type oggOpusFileReader struct {
+	file    *os.File
+	reader  *bufio.Reader
+	serial  uint32
+	started bool     // Ya se conoce el flujo lógico (serial) a reproducir
+	pending [][]byte // Paquetes completos aún no entregados
+	partial []byte   // Paquete que continúa en la página siguiente
+	pts     time.Duration
+}
+
+func newOggOpusFileReader(file *os.File) (*oggOpusFileReader, error) {
+	r := &oggOpusFileReader{file: file, reader: bufio.NewReader(file)}
+	head, err := r.nextPacket()
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo leer la cabecera Ogg: %w", err)
+	}
+	if !bytes.HasPrefix(head, []byte("OpusHead")) {
+		return nil, errors.New("el fichero Ogg no contiene Opus (OpusHead ausente)")
+	}
+	if _, err := r.nextPacket(); err != nil { // OpusTags
+		return nil, fmt.Errorf("no se pudo leer OpusTags: %w", err)
+	}
+	return r, nil
+}
+
+func (r *oggOpusFileReader) ReadFrame() (mediaFrame, error) {
+	packet, err := r.nextPacket()
+	if err != nil {
+		return mediaFrame{}, err
+	}
+	frame := mediaFrame{data: packet, pts: r.pts, keyFrame: true}
+	r.pts += opusPacketDuration(packet)
+	return frame, nil
+}
+
+func (r *oggOpusFileReader) nextPacket() ([]byte, error) {
+	for len(r.pending) == 0 {
+		if err := r.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := r.pending[0]
+	r.pending = r.pending[1:]
+	return packet, nil
+}
+
+func (r *oggOpusFileReader) readPage() error {
+	var header [27]byte
+	if _, err := io.ReadFull(r.reader, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return io.EOF
+		}
+		return err
+	}
+	if string(header[0:4]) != "OggS" {
+		return errors.New("página Ogg inválida (firma OggS ausente)")
+	}
+	serial := binary.LittleEndian.Uint32(header[14:18])
+	lacing := make([]byte, header[26])
+	if _, err := io.ReadFull(r.reader, lacing); err != nil {
+		return io.EOF
+	}
+	total := 0
+	for _, l := range lacing {
+		total += int(l)
+	}
+	body := make([]byte, total)
+	if _, err := io.ReadFull(r.reader, body); err != nil {
+		return io.EOF
+	}
+
+	// Solo se reproduce el primer flujo lógico del fichero.
+	if !r.started {
+		r.serial = serial
+		r.started = true
+	} else if serial != r.serial {
+		return nil
+	}
+
+	offset := 0
+	for _, l := range lacing {
+		r.partial = append(r.partial, body[offset:offset+int(l)]...)
+		offset += int(l)
+		if l < 255 {
+			r.pending = append(r.pending, r.partial)
+			r.partial = nil
+		}
+	}
+	return nil
+}
+
+func (r *oggOpusFileReader) Close() error {
+	return r.file.Close()
+}
+
+// opusPacketDuration calcula la duración de un paquete Opus a partir de su
+// byte TOC (RFC 6716, sección 3.1).
+func opusPacketDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	config := toc >> 3
+	var frame time.Duration
+	switch {
+	case config < 12: // SILK: 10, 20, 40, 60 ms
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16: // Híbrido: 10, 20 ms
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default: // CELT: 2.5, 5, 10, 20 ms
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+	frames := 1
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) > 1 {
+			frames = int(packet[1] & 0x3F)
+		}
+	}
+	return frame * time.Duration(frames)
+}
+
+// isKeyFrameData indica si un fotograma completo (no un paquete RTP) es
+// independiente, para empezar la reproducción en un punto decodificable.
+func isKeyFrameData(mimeType string, frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		// Bit P del "frame tag": 0 indica keyframe (RFC 6386, sección 9.1).
+		return frame[0]&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		// Cabecera sin comprimir: frame_marker(2) profile(2[+1]) show_existing_frame(1) frame_type(1).
+		b := frame[0]
+		profile := (b>>5)&0x01 | (b>>3)&0x02
+		bit := 4
+		if profile == 3 {
+			bit++
+		}
+		if (b>>(7-bit))&0x01 == 1 { // show_existing_frame
+			return false
+		}
+		bit++
+		return (b>>(7-bit))&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeAV1):
+		// Se considera punto de acceso el fotograma que incluye un Sequence Header OBU.
+		for offset := 0; offset < len(frame); {
+			header := frame[offset]
+			if (header>>3)&0x0F == 1 {
+				return true
+			}
+			offset++
+			if header&0x04 != 0 { // obu_extension_flag
+				offset++
+			}
+			if header&0x02 == 0 { // Sin obu_size: el OBU ocupa el resto del fotograma
+				break
+			}
+			size, n := readLEB128(frame[min(offset, len(frame)):])
+			if n == 0 {
+				break
+			}
+			offset += n + int(size)
+		}
+		return false
+	}
+	return true
+}
+
+// readLEB128 decodifica un entero LEB128 (usado en los tamaños de OBU de AV1) y
+// devuelve el valor y los bytes consumidos (0 si es inválido).
+func readLEB128(b []byte) (uint64, int) {
+	var value uint64
+	for i := 0; i < len(b) && i < 8; i++ {
+		value |= uint64(b[i]&0x7F) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
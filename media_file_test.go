@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestFile escribe data en un fichero temporal y lo abre.
+func writeTestFile(t *testing.T, name string, data []byte) *os.File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file
+}
+
+// ivfTestFile construye un IVF con la base de tiempos indicada y un
+// fotograma por elemento de frames (pts consecutivos desde 0).
+func ivfTestFile(fourCC string, numerator, denominator uint32, frames ...[]byte) []byte {
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:8], 32)
+	copy(header[8:12], fourCC)
+	binary.LittleEndian.PutUint32(header[16:20], denominator)
+	binary.LittleEndian.PutUint32(header[20:24], numerator)
+	data := header
+	for i, frame := range frames {
+		frameHead := make([]byte, 12)
+		binary.LittleEndian.PutUint32(frameHead[0:4], uint32(len(frame)))
+		binary.LittleEndian.PutUint64(frameHead[4:12], uint64(i))
+		data = append(append(data, frameHead...), frame...)
+	}
+	return data
+}
+
+func TestIVFTimestamp(t *testing.T) {
+	tests := []struct {
+		pts, numerator, denominator uint64
+		want                        time.Duration
+	}{
+		{30, 1, 30, time.Second},
+		{1, 1001, 30000, 33366666},
+		{20_000_000_000, 1, 90000, 222222222222222}, // pts*1e9 no cabe en 64 bits
+		{1 << 62, 1, 1, time.Duration(math.MaxInt64)},
+	}
+	for _, tt := range tests {
+		if got := ivfTimestamp(tt.pts, tt.numerator, tt.denominator); got != tt.want {
+			t.Errorf("ivfTimestamp(%d, %d, %d) = %d, se esperaba %d", tt.pts, tt.numerator, tt.denominator, got, tt.want)
+		}
+	}
+}
+
+func TestIVFFileReader(t *testing.T) {
+	type frame struct {
+		size     int
+		pts      time.Duration
+		keyFrame bool
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		frames  []frame
+	}{
+		{
+			name:   "VP8",
+			data:   ivfTestFile("VP80", 1, 30, []byte{0x00, 1, 2}, []byte{0x01, 3}),
+			frames: []frame{{3, 0, true}, {2, time.Second / 30, false}},
+		},
+		{
+			name:   "último fotograma truncado",
+			data:   ivfTestFile("VP80", 1, 1000, []byte{0x00, 1, 2}, []byte{0x01, 3, 4, 5})[:32+12+3+12+2],
+			frames: []frame{{3, 0, true}},
+		},
+		{name: "sin firma DKIF", data: append([]byte("RIFF"), make([]byte, 28)...), wantErr: true},
+		{name: "codec no soportado", data: ivfTestFile("H264", 1, 30), wantErr: true},
+		{name: "base de tiempos nula", data: ivfTestFile("VP80", 0, 30), wantErr: true},
+		{name: "cabecera incompleta", data: []byte("DKIF"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, _, err := newIVFFileReader(writeTestFile(t, "test.ivf", tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("se esperaba un error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.frames {
+				got, err := reader.ReadFrame()
+				if err != nil {
+					t.Fatalf("fotograma %d: %v", i, err)
+				}
+				if len(got.data) != want.size || got.pts != want.pts || got.keyFrame != want.keyFrame {
+					t.Errorf("fotograma %d: %d bytes, pts %v, keyframe %v; se esperaba %+v", i, len(got.data), got.pts, got.keyFrame, want)
+				}
+			}
+			if _, err := reader.ReadFrame(); !errors.Is(err, io.EOF) {
+				t.Errorf("se esperaba io.EOF al final, se obtuvo %v", err)
+			}
+		})
+	}
+}
+
+// oggTestPage construye una página Ogg con los valores de lacing indicados
+// (el CRC no se comprueba al leer).
+func oggTestPage(serial uint32, lacing []byte, body []byte) []byte {
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	binary.LittleEndian.PutUint32(header[14:18], serial)
+	header[26] = byte(len(lacing))
+	return append(append(header, lacing...), body...)
+}
+
+func TestOggOpusFileReader(t *testing.T) {
+	head := []byte("OpusHead\x01\x02\x00\x00\x80\xbb\x00\x00\x00\x00\x00")
+	tags := []byte("OpusTags")
+	celt20ms := []byte{0xF8, 1, 2} // TOC: CELT 20 ms, un frame
+	long := make([]byte, 300)
+	long[0] = 0xF9 // CELT 20 ms, dos frames
+	headers := oggTestPage(1, []byte{byte(len(head)), byte(len(tags))}, append(append([]byte(nil), head...), tags...))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		sizes   []int
+		pts     []time.Duration
+	}{
+		{
+			name:  "varios paquetes en una página",
+			data:  append(append([]byte(nil), headers...), oggTestPage(1, []byte{3, 3}, append(append([]byte(nil), celt20ms...), celt20ms...))...),
+			sizes: []int{3, 3},
+			pts:   []time.Duration{0, 20 * time.Millisecond},
+		},
+		{
+			name: "paquete que continúa en la página siguiente",
+			data: append(append(append([]byte(nil), headers...),
+				oggTestPage(1, []byte{255}, long[:255])...),
+				oggTestPage(1, []byte{45, 3}, append(append([]byte(nil), long[255:]...), celt20ms...))...),
+			sizes: []int{300, 3},
+			pts:   []time.Duration{0, 40 * time.Millisecond},
+		},
+		{
+			name: "se ignora otro flujo lógico",
+			data: append(append(append([]byte(nil), headers...),
+				oggTestPage(2, []byte{3}, celt20ms)...),
+				oggTestPage(1, []byte{3}, celt20ms)...),
+			sizes: []int{3},
+			pts:   []time.Duration{0},
+		},
+		{name: "sin OpusHead", data: oggTestPage(1, []byte{4, 4}, []byte("abcdefgh")), wantErr: true},
+		{name: "sin firma OggS", data: append([]byte("RIFF"), make([]byte, 40)...), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader, err := newOggOpusFileReader(writeTestFile(t, "test.ogg", tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("se esperaba un error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range tt.sizes {
+				got, err := reader.ReadFrame()
+				if err != nil {
+					t.Fatalf("paquete %d: %v", i, err)
+				}
+				if len(got.data) != tt.sizes[i] || got.pts != tt.pts[i] {
+					t.Errorf("paquete %d: %d bytes en %v, se esperaban %d en %v", i, len(got.data), got.pts, tt.sizes[i], tt.pts[i])
+				}
+			}
+			if _, err := reader.ReadFrame(); !errors.Is(err, io.EOF) {
+				t.Errorf("se esperaba io.EOF al final, se obtuvo %v", err)
+			}
+		})
+	}
+}
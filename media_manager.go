@@ -3,14 +3,16 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/pion/mediadevices"
-	"github.com/pion/mediadevices/pkg/codec/opus"
-	"github.com/pion/mediadevices/pkg/codec/vpx"
+	"github.com/pion/mediadevices/pkg/codec"
 	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/webrtc/v4"
 	// Los drivers se importan en main.go para EnumerateDevices,
 	// pero es bueno tenerlos aquí también si este paquete se usara de forma más aislada.
 	// _ "github.com/pion/mediadevices/pkg/driver/camera"
@@ -25,62 +27,185 @@ type MediaManager struct {
 	isVideoEnabled   bool
 	isAudioEnabled   bool
 	codecSelector    *mediadevices.CodecSelector
+	videoCodec       webrtc.RTPCodecParameters
+	audioCodec       webrtc.RTPCodecParameters
+	videoFanout      *FanoutTrack     // Pista que reciben los clientes (un solo encoder para todos; con video capturado, la del codec preferido)
+	audioFanout      *FanoutTrack
+	opusParams       *opusParams       // Encoder Opus del audio capturado
+	audioEncoder     *sharedAudioEncoder
+	sources          []io.Closer      // Fuentes ya codificadas (fichero, RTP o WHIP), sin encoder
+	whip             *whipIngest      // Publicador WHIP, si -v/-a whip
+	videoCodecs      []videoCodecOption      // Codecs del video capturado, por preferencia (-video-codec)
+	videoFanouts     map[string]*FanoutTrack // Pista de cada codec ya arrancado, por MIME type
+	videoSettings    videoEncoderSettings    // Parámetros del encoder compartido, cambiables desde /admin/encoder
+	videoEncoders    map[string]*liveVideoEncoder // Encoder compartido de cada codec ya arrancado, por MIME type
+	videoViewers     map[string]int               // Referencias a la pista de cada codec (espectadores y grabaciones)
+	videoStarting    map[string]*videoCodecStart  // Codecs cuyo encoder se está arrancando
+	adaptiveBitrate  bool             // Un encoder por espectador (-adaptive-bitrate)
+	minBitrate       int
+	maxBitrate       int
+	renditions       []rendition          // Escalera de calidades (-renditions), de más a menos calidad
+	renditionEncoders map[string][]*renditionEncoder // Un encoder por rendición de cada codec, capas de su pista
+	svc              bool             // Filtrado de capas VP9 SVC por espectador (-svc)
+	keyFramePolicy   keyFramePolicy   // Peticiones de keyframe de las pistas de video
+	gopCacheBytes    int              // Tamaño de la caché de GOP por capa (0 = sin caché)
+	dvrWindow        time.Duration    // Tiempo del buffer DVR (0 = sin time-shift)
+	dvrMaxBytes      int              // Tamaño máximo del buffer DVR por capa
 }
 
 func NewMediaManager() *MediaManager {
 	return &MediaManager{}
 }
 
-func (m *MediaManager) Initialize(cfg *Config) error {
+func (m *MediaManager) Initialize(cfg *Config) (err error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	// Cualquier error a partir de aquí puede llegar con fuentes o encoders ya
+	// en marcha (p.ej. una fuente externa arrancada antes de validar
+	// -renditions): se cierra todo lo que se haya iniciado.
+	defer func() {
+		if err != nil {
+			m.closeLocked()
+		}
+	}()
 
 	log.Println("MediaManager: Inicializando...")
 
-	if cfg.VideoDeviceID == "" && cfg.AudioDeviceID == "" {
+	videoExternal := isExternalSourceIdentifier(cfg.VideoIdentifier)
+	audioExternal := isExternalSourceIdentifier(cfg.AudioIdentifier)
+	captureVideo := cfg.VideoDeviceID != "" && !videoExternal
+	captureAudio := cfg.AudioDeviceID != "" && !audioExternal
+	if !captureVideo && !captureAudio && !videoExternal && !audioExternal {
 		return errors.New("MediaManager: no se especificaron dispositivos válidos para capturar")
 	}
+	if cfg.KeyFrameMinInterval < 0 {
+		return errors.New("MediaManager: -keyframe-min-interval no puede ser negativo")
+	}
+	m.keyFramePolicy = keyFramePolicy{minInterval: cfg.KeyFrameMinInterval, onJoin: cfg.KeyFrameOnJoin}
+	if cfg.GOPCacheSize < 0 {
+		return errors.New("MediaManager: -gop-cache-size no puede ser negativo")
+	}
+	m.gopCacheBytes = cfg.GOPCacheSize * 1024
+	if cfg.DVRWindow < 0 || cfg.DVRMaxSize < 0 {
+		return errors.New("MediaManager: -dvr-window y -dvr-max-size no pueden ser negativos")
+	}
+	m.dvrWindow, m.dvrMaxBytes = cfg.DVRWindow, cfg.DVRMaxSize*1024*1024
+
+	// Ficheros pre-codificados e ingesta RTP: se publican directamente, sin GetUserMedia ni encoder.
+	if videoExternal {
+		if err := m.startExternalSource(cfg.VideoIdentifier, webrtc.RTPCodecTypeVideo, cfg); err != nil {
+			return err
+		}
+		if cfg.SVC && strings.EqualFold(m.videoCodec.MimeType, webrtc.MimeTypeVP9) {
+			m.videoFanout.EnableSVC()
+			m.svc = true
+			log.Println("MediaManager: Reenvío de capas VP9 SVC por espectador habilitado.")
+		} else if cfg.SVC {
+			log.Printf("MediaManager ADVERTENCIA: -svc requiere una fuente VP9 (la fuente es %s); se reenvía tal cual.", m.videoCodec.MimeType)
+		}
+	} else if cfg.SVC {
+		log.Println("MediaManager ADVERTENCIA: -svc solo afecta a fuentes VP9 ya codificadas; el encoder VP8 local no genera capas SVC.")
+	}
+	if audioExternal {
+		if err := m.startExternalSource(cfg.AudioIdentifier, webrtc.RTPCodecTypeAudio, cfg); err != nil {
+			return err
+		}
+	}
+	if !captureVideo && !captureAudio {
+		log.Println("MediaManager inicializado exitosamente.")
+		return nil
+	}
 
 	var codecSelectorOptions []mediadevices.CodecSelectorOption
-	if cfg.VideoDeviceID != "" {
-		vp8Params, errVP8 := vpx.NewVP8Params()
-		if errVP8 != nil { return fmt.Errorf("MediaManager: fallo al crear params VP8: %w", errVP8) }
-		vp8Params.BitRate = 1_500_000
-		//vp8Params.BitRate = 700_000
-		codecSelectorOptions = append(codecSelectorOptions, mediadevices.WithVideoEncoders(&vp8Params))
+	if cfg.Renditions != "" {
+		renditions, err := parseRenditions(cfg.Renditions)
+		if err != nil {
+			return fmt.Errorf("MediaManager: %w", err)
+		}
+		if cfg.AdaptiveBitrate {
+			return errors.New("MediaManager: -renditions y -adaptive-bitrate son incompatibles")
+		}
+		if captureVideo {
+			m.renditions = renditions
+		} else {
+			log.Println("MediaManager ADVERTENCIA: -renditions solo afecta al video capturado; la fuente de video se reenvía tal cual.")
+		}
+	}
+	if captureVideo {
+		settings := videoEncoderSettings{Bitrate: cfg.VideoBitrate, KeyFrameInterval: cfg.KeyFrameInterval}
+		if err := settings.validate(); err != nil || cfg.Width < 0 || cfg.Height < 0 || cfg.FrameRate < 0 {
+			return errors.New("MediaManager: -video-bitrate, -keyframe-interval, -width, -height o -fps fuera de rango")
+		}
+		videoCodecs, errCodecs := parseVideoCodecs(cfg.VideoCodecs, cfg.KeyFrameInterval)
+		if errCodecs != nil { return fmt.Errorf("MediaManager: %w", errCodecs) }
+		// Todos los encoders se registran; cada uno se arranca cuando un espectador lo necesita.
+		var builders []codec.VideoEncoderBuilder
+		var mimeTypes []string
+		for _, option := range videoCodecs {
+			builders = append(builders, option.params(cfg.VideoBitrate))
+			mimeTypes = append(mimeTypes, option.rtpCodec.MimeType)
+		}
+		codecSelectorOptions = append(codecSelectorOptions, mediadevices.WithVideoEncoders(builders...))
+		m.videoCodec = videoCodecs[0].rtpCodec.RTPCodecParameters
+		m.videoCodecs = videoCodecs
+		m.videoSettings = settings
 		m.isVideoEnabled = true
-		log.Println("MediaManager: Codec VP8 para video habilitado.")
+		log.Printf("MediaManager: Codecs de video habilitados (por preferencia): %s; %d kbps, keyframe cada %d frames.", strings.Join(mimeTypes, ", "), cfg.VideoBitrate/1000, cfg.KeyFrameInterval)
+		if cfg.AdaptiveBitrate {
+			if cfg.MinBitrate <= 0 || cfg.MinBitrate > cfg.MaxBitrate {
+				return fmt.Errorf("MediaManager: rango de bitrate adaptativo inválido: %d-%d", cfg.MinBitrate, cfg.MaxBitrate)
+			}
+			m.adaptiveBitrate, m.minBitrate, m.maxBitrate = true, cfg.MinBitrate, cfg.MaxBitrate
+			log.Printf("MediaManager: Bitrate adaptativo por espectador entre %d y %d kbps.", cfg.MinBitrate/1000, cfg.MaxBitrate/1000)
+		}
+	} else if cfg.AdaptiveBitrate {
+		log.Println("MediaManager ADVERTENCIA: -adaptive-bitrate solo afecta al video capturado; la fuente de video se reenvía tal cual.")
 	}
-	if cfg.AudioDeviceID != "" {
-		opusParams, errOpus := opus.NewParams()
-		if errOpus != nil { return fmt.Errorf("MediaManager: fallo al crear params Opus: %w", errOpus) }
-		codecSelectorOptions = append(codecSelectorOptions, mediadevices.WithAudioEncoders(&opusParams))
+	if !captureVideo && cfg.VideoCodecs != defaultVideoCodecs {
+		log.Println("MediaManager ADVERTENCIA: -video-codec solo afecta al video capturado; la fuente de video se reenvía tal cual.")
+	}
+	if captureAudio {
+		opusParams := &opusParams{
+			channels: cfg.AudioChannels, bitrate: cfg.AudioBitrate, fec: cfg.OpusFEC, packetLoss: cfg.OpusPacketLoss,
+			dtx: cfg.OpusDTX, complexity: cfg.OpusComplexity, frameDuration: cfg.OpusFrameDuration,
+		}
+		if err := opusParams.validate(); err != nil { return fmt.Errorf("MediaManager: %w", err) }
+		codecSelectorOptions = append(codecSelectorOptions, mediadevices.WithAudioEncoders(opusParams))
+		m.opusParams = opusParams
+		m.audioCodec = opusParams.RTPCodec().RTPCodecParameters
 		m.isAudioEnabled = true
-		log.Println("MediaManager: Codec Opus para audio habilitado.")
+		log.Printf("MediaManager: Codec Opus para audio habilitado (%s).", m.audioCodec.SDPFmtpLine)
 	}
 
 	if len(codecSelectorOptions) == 0 { return errors.New("MediaManager: no se configuraron codecs") }
 	m.codecSelector = mediadevices.NewCodecSelector(codecSelectorOptions...)
 
 	constraints := mediadevices.MediaStreamConstraints{ Codec: m.codecSelector } // Desreferenciar
+	var videoConstraints, audioConstraints mediadevices.MediaTrackConstraints // Las aplicadas, para informar del modo elegido
 	logStreamMsg := "MediaManager: Intentando obtener MediaStream ("
 	hasRequest := false
 
-	if m.isVideoEnabled {
+	if captureVideo {
+		pixelFormats, errFormats := parsePixelFormats(cfg.PixelFormats)
+		if errFormats != nil { return fmt.Errorf("MediaManager: %w", errFormats) }
 		constraints.Video = func(c *mediadevices.MediaTrackConstraints) {
 			c.DeviceID = prop.String(cfg.VideoDeviceID)
-			//c.Width = prop.Int(1024)
-			//c.Height = prop.Int(818)
-			//c.Width = prop.Int(800)
-			//c.Height = prop.Int(600)
-			log.Printf("MediaManager: Constraint Video: DeviceID='%s'", cfg.VideoDeviceID)
+			// Valores ideales: el dispositivo da el modo más cercano que tenga.
+			if cfg.Width > 0 { c.Width = prop.Int(cfg.Width) }
+			if cfg.Height > 0 { c.Height = prop.Int(cfg.Height) }
+			if cfg.FrameRate > 0 { c.FrameRate = prop.Float(cfg.FrameRate) }
+			if len(pixelFormats) > 0 { c.FrameFormat = pixelFormats }
+			log.Printf("MediaManager: Constraint Video: DeviceID='%s' %dx%d@%v %s", cfg.VideoDeviceID, cfg.Width, cfg.Height, cfg.FrameRate, cfg.PixelFormats)
+			videoConstraints = *c
 		}
 		logStreamMsg += fmt.Sprintf("Video desde '%s'", cfg.VideoDeviceID); hasRequest = true
 	}
-	if m.isAudioEnabled {
+	if captureAudio {
 		constraints.Audio = func(c *mediadevices.MediaTrackConstraints) {
 			c.DeviceID = prop.String(cfg.AudioDeviceID)
-			log.Printf("MediaManager: Constraint Audio: DeviceID='%s'", cfg.AudioDeviceID)
+			c.ChannelCount = prop.Int(cfg.AudioChannels)
+			log.Printf("MediaManager: Constraint Audio: DeviceID='%s' %d canal(es)", cfg.AudioDeviceID, cfg.AudioChannels)
+			audioConstraints = *c
 		}
 		if hasRequest { logStreamMsg += " y " }
 		logStreamMsg += fmt.Sprintf("Audio desde '%s'", cfg.AudioDeviceID); hasRequest = true
@@ -112,21 +237,23 @@ func (m *MediaManager) Initialize(cfg *Config) error {
 	}
 
 	// Extraer pistas
-	if m.isVideoEnabled {
+	if captureVideo {
 		videoTracks := m.mediaStream.GetVideoTracks()
 		if len(videoTracks) > 0 {
 			m.videoTrack = videoTracks[0]
 			log.Printf("MediaManager: Pista de video compartida inicializada: ID=%s", m.videoTrack.ID())
+			reportVideoFormat(m.videoTrack, videoConstraints)
 		} else {
 			log.Println("MediaManager ADVERTENCIA: Se solicitó video pero no se obtuvo pista de video.")
 			m.isVideoEnabled = false // Corregir el flag si no se obtuvo
 		}
 	}
-	if m.isAudioEnabled {
+	if captureAudio {
 		audioTracks := m.mediaStream.GetAudioTracks()
 		if len(audioTracks) > 0 {
 			m.audioTrack = audioTracks[0]
 			log.Printf("MediaManager: Pista de audio compartida inicializada: ID=%s", m.audioTrack.ID())
+			reportAudioFormat(audioConstraints)
 		} else {
 			log.Println("MediaManager ADVERTENCIA: Se solicitó audio pero no se obtuvo pista de audio.")
 			m.isAudioEnabled = false // Corregir el flag si no se obtuvo
@@ -134,34 +261,620 @@ func (m *MediaManager) Initialize(cfg *Config) error {
 	}
     
 	if !m.isVideoEnabled && !m.isAudioEnabled {
-		if m.mediaStream != nil { for _, track := range m.mediaStream.GetTracks() { track.Close() } }
 		return errors.New("MediaManager: no se pudo obtener ninguna pista de medios solicitada después de los reintentos")
 	}
+
+	// Un único encoder por pista (o por rendición); sus paquetes se reparten a todos los clientes.
+	// El video arranca con el codec preferido; los demás, con el primer espectador que los pida.
+	if captureVideo && m.videoTrack != nil {
+		if _, err := m.startVideoCodecLocked(m.videoCodecs[0]); err != nil {
+			return fmt.Errorf("MediaManager: %w", err)
+		}
+	}
+	if captureAudio && m.audioTrack != nil {
+		audioTrack, ok := m.audioTrack.(*mediadevices.AudioTrack)
+		if !ok {
+			return errors.New("MediaManager: la pista de audio no admite encoder compartido")
+		}
+		m.audioFanout = NewFanoutTrack(m.audioCodec.RTPCodecCapability, "audio", streamID)
+		m.audioFanout.EnableDVR(m.dvrWindow, m.dvrMaxBytes)
+		encoder, err := startSharedAudioEncoder(audioTrack, m.opusParams, m.audioFanout)
+		if err != nil {
+			return fmt.Errorf("MediaManager: %w", err)
+		}
+		m.audioEncoder = encoder
+		log.Printf("MediaManager: Encoder de audio compartido iniciado (%s).", m.audioCodec.MimeType)
+	}
 	log.Println("MediaManager inicializado exitosamente.")
 	return nil
 }
 
-func (m *MediaManager) GetVideoTrack() (mediadevices.Track, bool) {
+func (m *MediaManager) GetVideoTrack() (*FanoutTrack, bool) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	return m.videoTrack, m.isVideoEnabled && m.videoTrack != nil
+	return m.videoFanout, m.isVideoEnabled && m.videoFanout != nil
 }
 
-func (m *MediaManager) GetAudioTrack() (mediadevices.Track, bool) {
+func (m *MediaManager) GetAudioTrack() (*FanoutTrack, bool) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	return m.audioTrack, m.isAudioEnabled && m.audioTrack != nil
+	return m.audioFanout, m.isAudioEnabled && m.audioFanout != nil
 }
 
-func (m *MediaManager) GetCodecSelector() *mediadevices.CodecSelector {
-    m.mutex.RLock()
-    defer m.mutex.RUnlock()
-    return m.codecSelector
+// GetVideoTrackFor devuelve la pista de video para un espectador cuya oferta
+// incluye los codecs indicados (MIME types). Con video capturado es la del
+// primer codec de -video-codec que acepte, cuyo encoder se arranca si aún no
+// lo estaba, y el espectador debe devolverla con ReleaseVideoTrack al irse;
+// con una fuente ya codificada, la única que hay.
+func (m *MediaManager) GetVideoTrackFor(offered []string) (*FanoutTrack, bool) {
+	m.mutex.RLock()
+	out, enabled := m.videoFanout, m.isVideoEnabled && m.videoFanout != nil
+	option, ok := preferredVideoCodec(m.videoCodecs, offered)
+	captured := len(m.videoCodecs) > 0
+	m.mutex.RUnlock()
+	if !enabled {
+		return nil, false
+	}
+	if !captured {
+		return out, true
+	}
+	if !ok {
+		log.Printf("MediaManager: Ningún codec de video de -video-codec está en la oferta (%s).", strings.Join(offered, ", "))
+		return nil, false
+	}
+	out, err := m.acquireVideoCodec(option)
+	if err != nil {
+		log.Printf("MediaManager: %v", err)
+		return nil, false
+	}
+	return out, true
+}
+
+// ReleaseVideoTrack devuelve una pista obtenida con GetVideoTrackFor o
+// GetRecordingTracks. Cuando se va la última referencia a un codec que no es
+// el preferido, se detiene su encoder. Las demás pistas se ignoran.
+func (m *MediaManager) ReleaseVideoTrack(out *FanoutTrack) {
+	if out == nil {
+		return
+	}
+	m.mutex.Lock()
+	mimeType := ""
+	for codecMimeType, track := range m.videoFanouts {
+		if track == out {
+			mimeType = codecMimeType
+		}
+	}
+	if mimeType == "" {
+		m.mutex.Unlock()
+		return
+	}
+	if m.videoViewers[mimeType] > 0 {
+		m.videoViewers[mimeType]--
+	}
+	if m.videoViewers[mimeType] > 0 || out == m.videoFanout {
+		m.mutex.Unlock()
+		return
+	}
+	live, renditions := m.videoEncoders[mimeType], m.renditionEncoders[mimeType]
+	delete(m.videoFanouts, mimeType)
+	delete(m.videoEncoders, mimeType)
+	delete(m.renditionEncoders, mimeType)
+	delete(m.videoViewers, mimeType)
+	m.mutex.Unlock()
+
+	closeVideoCodecEncoders(mimeType, live, renditions)
+	log.Printf("MediaManager: Encoder de video %s detenido (sin espectadores).", mimeType)
+}
+
+// videoCodecStart es el arranque en curso del encoder de un codec. Se hace
+// fuera de m.mutex porque el encoder lee un frame de la captura antes de
+// devolver; quien pide el mismo codec mientras tanto espera a done.
+type videoCodecStart struct {
+	done chan struct{}
+	err  error
+}
+
+// acquireVideoCodec devuelve la pista de un codec del video capturado,
+// arrancando su encoder si no lo estaba, y cuenta una referencia. Se llama
+// sin m.mutex.
+func (m *MediaManager) acquireVideoCodec(option videoCodecOption) (*FanoutTrack, error) {
+	mimeType := option.rtpCodec.MimeType
+	m.mutex.Lock()
+	for {
+		if out, ok := m.videoFanouts[mimeType]; ok {
+			m.videoViewers[mimeType]++
+			m.mutex.Unlock()
+			return out, nil
+		}
+		start, ok := m.videoStarting[mimeType]
+		if !ok {
+			break
+		}
+		m.mutex.Unlock()
+		<-start.done
+		if start.err != nil {
+			return nil, start.err
+		}
+		m.mutex.Lock()
+	}
+	videoTrack, settings := m.videoTrack, m.videoSettings
+	if videoTrack == nil {
+		m.mutex.Unlock()
+		return nil, errors.New("la captura de video está cerrada")
+	}
+	start := &videoCodecStart{done: make(chan struct{})}
+	if m.videoStarting == nil {
+		m.videoStarting = make(map[string]*videoCodecStart)
+	}
+	m.videoStarting[mimeType] = start
+	m.mutex.Unlock()
+
+	out, live, renditions, err := m.buildVideoCodec(option, videoTrack, settings)
+
+	m.mutex.Lock()
+	delete(m.videoStarting, mimeType)
+	if err == nil && m.videoTrack == nil { // Close mientras arrancaba
+		closeVideoCodecEncoders(mimeType, live, renditions)
+		err = errors.New("la captura de video está cerrada")
+	}
+	if err == nil {
+		// Un cambio desde /admin/encoder durante el arranque no llegó a este encoder.
+		if live != nil && m.videoSettings != settings {
+			if errReconfigure := live.Reconfigure(m.videoSettings); errReconfigure != nil {
+				log.Printf("MediaManager: No se pudieron aplicar los parámetros actuales a %s: %v", mimeType, errReconfigure)
+			}
+		}
+		m.registerVideoCodecLocked(mimeType, out, live, renditions)
+		m.videoViewers[mimeType]++
+	}
+	start.err = err
+	close(start.done)
+	m.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// startVideoCodecLocked arranca con m.mutex tomado el encoder del codec
+// preferido al inicializar; ese no se detiene aunque no haya espectadores.
+func (m *MediaManager) startVideoCodecLocked(option videoCodecOption) (*FanoutTrack, error) {
+	out, live, renditions, err := m.buildVideoCodec(option, m.videoTrack, m.videoSettings)
+	if err != nil {
+		return nil, err
+	}
+	m.registerVideoCodecLocked(option.rtpCodec.MimeType, out, live, renditions)
+	return out, nil
+}
+
+// buildVideoCodec crea la pista de un codec del video capturado y arranca el
+// encoder compartido (o los de las rendiciones) que la alimenta.
+func (m *MediaManager) buildVideoCodec(option videoCodecOption, track mediadevices.Track, settings videoEncoderSettings) (*FanoutTrack, *liveVideoEncoder, []*renditionEncoder, error) {
+	videoTrack, ok := track.(*mediadevices.VideoTrack)
+	if !ok {
+		return nil, nil, nil, errors.New("la pista de video no admite encoder compartido")
+	}
+	if len(m.renditions) > 0 {
+		out, renditions, err := m.startRenditions(option, videoTrack, settings)
+		return out, nil, renditions, err
+	}
+	out := NewFanoutTrack(option.rtpCodec.RTPCodecCapability, "video", streamID)
+	m.configureVideoFanout(out)
+	live, err := startLiveVideoEncoder(videoTrack, option, settings, out)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	log.Printf("MediaManager: Encoder de video compartido iniciado (%s).", option.rtpCodec.MimeType)
+	return out, live, nil, nil
+}
+
+// registerVideoCodecLocked guarda la pista y los encoders de un codec ya
+// arrancado.
+func (m *MediaManager) registerVideoCodecLocked(mimeType string, out *FanoutTrack, live *liveVideoEncoder, renditions []*renditionEncoder) {
+	if m.videoFanouts == nil {
+		m.videoFanouts = make(map[string]*FanoutTrack)
+		m.videoViewers = make(map[string]int)
+		m.videoEncoders = make(map[string]*liveVideoEncoder)
+		m.renditionEncoders = make(map[string][]*renditionEncoder)
+	}
+	m.videoFanouts[mimeType] = out
+	if live != nil {
+		m.videoEncoders[mimeType] = live
+	}
+	if len(renditions) > 0 {
+		m.renditionEncoders[mimeType] = renditions
+	}
+	if m.videoFanout == nil {
+		m.videoFanout = out
+	}
+}
+
+// closeVideoCodecEncoders detiene los encoders de un codec.
+func closeVideoCodecEncoders(mimeType string, live *liveVideoEncoder, renditions []*renditionEncoder) {
+	if live != nil {
+		if err := live.Close(); err != nil {
+			log.Printf("MediaManager: Error cerrando encoder de video %s: %v", mimeType, err)
+		}
+	}
+	for _, encoder := range renditions {
+		encoder.Close()
+	}
+}
+
+// startRenditions arranca un encoder por rendición sobre una FanoutTrack con
+// una capa por rendición. Los espectadores empiezan en la mejor rendición que
+// no supera el bitrate de -video-bitrate.
+func (m *MediaManager) startRenditions(option videoCodecOption, videoTrack *mediadevices.VideoTrack, settings videoEncoderSettings) (*FanoutTrack, []*renditionEncoder, error) {
+	out := NewLayeredFanoutTrack(option.rtpCodec.RTPCodecCapability, "video", streamID, len(m.renditions))
+	m.configureVideoFanout(out)
+	defaultLayer := len(m.renditions) - 1
+	var encoders []*renditionEncoder
+	for layer, r := range m.renditions {
+		encoder, err := startRenditionEncoder(videoTrack, option, r, layer, out)
+		if err != nil {
+			for _, started := range encoders {
+				started.Close()
+			}
+			return nil, nil, err
+		}
+		encoders = append(encoders, encoder)
+		if r.bitrate <= settings.Bitrate && layer < defaultLayer {
+			defaultLayer = layer
+		}
+		log.Printf("MediaManager: Rendición %s iniciada (%s, %d kbps).", r.name, option.rtpCodec.MimeType, r.bitrate/1000)
+	}
+	out.OnLayerKeyFrameRequest(func(layer int) { encoders[layer].ForceKeyFrame() })
+	out.SetDefaultLayer(defaultLayer)
+	return out, encoders, nil
+}
+
+// errVideoNotReconfigurable indica que el video no tiene un encoder
+// compartido que se pueda reconfigurar en marcha.
+var errVideoNotReconfigurable = errors.New("el video no tiene encoder compartido reconfigurable (fuente ya codificada, -renditions o -adaptive-bitrate)")
+
+// VideoEncoderSettings devuelve los parámetros actuales del encoder compartido
+// y el tamaño que codifica cada codec arrancado.
+func (m *MediaManager) VideoEncoderSettings() (videoEncoderSettings, map[string]encodedSize, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if len(m.videoEncoders) == 0 || len(m.renditions) > 0 || m.adaptiveBitrate {
+		return videoEncoderSettings{}, nil, errVideoNotReconfigurable
+	}
+	sizes := make(map[string]encodedSize)
+	for mimeType, encoder := range m.videoEncoders {
+		sizes[mimeType] = encoder.Size()
+	}
+	return m.videoSettings, sizes, nil
+}
+
+// ReconfigureVideo aplica nuevos parámetros a los encoders compartidos sin
+// cortar a los espectadores. Si alguno falla, los ya cambiados se devuelven a
+// los parámetros anteriores.
+func (m *MediaManager) ReconfigureVideo(settings videoEncoderSettings) error {
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.videoEncoders) == 0 || len(m.renditions) > 0 || m.adaptiveBitrate {
+		return errVideoNotReconfigurable
+	}
+	previous := m.videoSettings
+	var done []*liveVideoEncoder
+	for mimeType, encoder := range m.videoEncoders {
+		if err := encoder.Reconfigure(settings); err != nil {
+			for _, reverted := range done {
+				reverted.Reconfigure(previous)
+			}
+			return fmt.Errorf("MediaManager: no se pudo reconfigurar %s: %w", mimeType, err)
+		}
+		done = append(done, encoder)
+	}
+	m.videoSettings = settings
+	log.Printf("MediaManager: Encoder de video reconfigurado: %d kbps, %dx%d (0 = captura), %v fps (0 = captura), keyframe cada %d frames.",
+		settings.Bitrate/1000, settings.Width, settings.Height, settings.FrameRate, settings.KeyFrameInterval)
+	return nil
+}
+
+// GetRenditions devuelve la escalera de calidades del video (vacía si no hay).
+func (m *MediaManager) GetRenditions() []rendition {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.renditions
+}
+
+// SVCEnabled indica si se filtran capas VP9 SVC por espectador.
+func (m *MediaManager) SVCEnabled() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.svc
+}
+
+// AdaptiveBitrateEnabled indica si cada espectador recibe su propio encoder de video.
+func (m *MediaManager) AdaptiveBitrateEnabled() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.adaptiveBitrate && m.videoTrack != nil
+}
+
+// NewAdaptiveVideoEncoder crea el encoder de video propio de un espectador,
+// con el codec preferido de entre los de su oferta; su bitrate se ajusta con
+// SetGCCEstimate y los REMB del espectador.
+func (m *MediaManager) NewAdaptiveVideoEncoder(clientID string, offered []string) (*adaptiveVideoEncoder, error) {
+	m.mutex.RLock()
+	videoTrack, ok := m.videoTrack.(*mediadevices.VideoTrack)
+	adaptive, bitrate, minBitrate, maxBitrate, policy := m.adaptiveBitrate, m.videoSettings.Bitrate, m.minBitrate, m.maxBitrate, m.keyFramePolicy
+	option, offeredOK := preferredVideoCodec(m.videoCodecs, offered)
+	m.mutex.RUnlock()
+	if !adaptive || !ok {
+		return nil, errors.New("MediaManager: bitrate adaptativo no disponible")
+	}
+	if !offeredOK {
+		return nil, fmt.Errorf("MediaManager: ningún codec de video de -video-codec está en la oferta (%s)", strings.Join(offered, ", "))
+	}
+
+	// Se construye sin m.mutex: el encoder lee un frame de la captura antes
+	// de devolver.
+	encoder, err := newAdaptiveVideoEncoder(clientID, videoTrack, option, bitrate, minBitrate, maxBitrate)
+	if err != nil {
+		return nil, fmt.Errorf("MediaManager: %w", err)
+	}
+	m.mutex.RLock()
+	closed := m.videoTrack == nil // Close mientras arrancaba
+	m.mutex.RUnlock()
+	if closed {
+		encoder.Close()
+		return nil, errors.New("MediaManager: la captura de video está cerrada")
+	}
+	encoder.Track().SetKeyFramePolicy(policy)
+	return encoder, nil
+}
+
+// configureVideoFanout aplica a una pista de video compartida la política de
+// keyframes, la caché de GOP y el buffer DVR.
+func (m *MediaManager) configureVideoFanout(out *FanoutTrack) {
+	out.SetKeyFramePolicy(m.keyFramePolicy)
+	out.EnableGOPCache(m.gopCacheBytes)
+	out.EnableDVR(m.dvrWindow, m.dvrMaxBytes)
+}
+
+// DVRWindow devuelve el tiempo que los espectadores pueden retroceder
+// (0 si no hay time-shift). Con -adaptive-bitrate el video de cada espectador
+// sale de su propio encoder y no se guarda.
+func (m *MediaManager) DVRWindow() time.Duration {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.adaptiveBitrate && m.videoTrack != nil {
+		return 0
+	}
+	return m.dvrWindow
+}
+
+// KeyFrameStats devuelve las peticiones de keyframe de cada pista de video
+// compartida, por MIME type.
+func (m *MediaManager) KeyFrameStats() map[string]keyFrameStats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	stats := make(map[string]keyFrameStats)
+	for mimeType, out := range m.videoFanouts {
+		stats[mimeType] = out.KeyFrameStats()
+	}
+	if len(m.videoFanouts) == 0 && m.videoFanout != nil {
+		stats[m.videoCodec.MimeType] = m.videoFanout.KeyFrameStats()
+	}
+	return stats
+}
+
+// GetRecordingTracks devuelve las pistas que se pueden grabar en WebM: el
+// video si es VP8 o VP9 (con video capturado, el primero de -video-codec que
+// lo sea, cuyo encoder se arranca si aún no lo estaba; con -renditions se
+// graba la de más calidad) y el audio si es Opus, con su número de canales.
+// El video se devuelve con ReleaseVideoTrack al terminar.
+func (m *MediaManager) GetRecordingTracks() (video, audio *FanoutTrack, channels int) {
+	webmVideo := []string{webrtc.MimeTypeVP8, webrtc.MimeTypeVP9}
+	m.mutex.RLock()
+	videoEnabled := m.isVideoEnabled && m.videoFanout != nil
+	captured := len(m.videoCodecs) > 0
+	option, webmCodec := preferredVideoCodec(m.videoCodecs, webmVideo)
+	if videoEnabled && !captured {
+		for _, mimeType := range webmVideo {
+			if strings.EqualFold(m.videoFanout.Codec().MimeType, mimeType) {
+				video = m.videoFanout
+			}
+		}
+	}
+	audio, channels = m.recordingAudioLocked()
+	m.mutex.RUnlock()
+
+	if videoEnabled && captured && webmCodec {
+		out, err := m.acquireVideoCodec(option)
+		if err != nil {
+			log.Printf("MediaManager: No se puede grabar el video: %v", err)
+		} else {
+			video = out
+		}
+	}
+	if videoEnabled && video == nil {
+		log.Println("MediaManager: El video no es VP8 ni VP9; no se graba.")
+	}
+	return video, audio, channels
+}
+
+// GetClipTracks devuelve las pistas de las que se exportan clips del buffer
+// DVR: la de video VP8 o VP9 que ya esté en marcha (nunca arranca un encoder,
+// cuyo buffer estaría vacío) y el audio si es Opus. No cuenta referencias: el
+// clip copia los paquetes del buffer antes de escribirlos. Sin video devuelve
+// solo el audio.
+func (m *MediaManager) GetClipTracks() (video, audio *FanoutTrack, channels int, err error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	audio, channels = m.recordingAudioLocked()
+	if !m.isVideoEnabled || m.videoFanout == nil {
+		return nil, audio, channels, nil
+	}
+	candidates := []*FanoutTrack{m.videoFanout}
+	for _, option := range m.videoCodecs {
+		if out, ok := m.videoFanouts[option.rtpCodec.MimeType]; ok {
+			candidates = append(candidates, out)
+		}
+	}
+	for _, out := range candidates {
+		mimeType := out.Codec().MimeType
+		if (strings.EqualFold(mimeType, webrtc.MimeTypeVP8) || strings.EqualFold(mimeType, webrtc.MimeTypeVP9)) && out.DVREnabled() {
+			return out, audio, channels, nil
+		}
+	}
+	return nil, nil, 0, errClipsNeedWebMVideo
+}
+
+// recordingAudioLocked devuelve el audio si es Opus, con su número de canales.
+func (m *MediaManager) recordingAudioLocked() (*FanoutTrack, int) {
+	channels := 2
+	if m.opusParams != nil {
+		channels = m.opusParams.channels
+	}
+	if !m.isAudioEnabled || m.audioFanout == nil {
+		return nil, channels
+	}
+	if !strings.EqualFold(m.audioFanout.Codec().MimeType, webrtc.MimeTypeOpus) {
+		log.Println("MediaManager: El audio no es Opus; no se graba.")
+		return nil, channels
+	}
+	return m.audioFanout, channels
+}
+
+// OpusFmtpLine devuelve los parámetros fmtp del encoder Opus para las
+// respuestas SDP de los espectadores (vacío si el audio no se codifica aquí).
+func (m *MediaManager) OpusFmtpLine() string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.opusParams == nil {
+		return ""
+	}
+	return m.opusParams.fmtpLine()
+}
+
+// GetWHIPIngest devuelve el receptor WHIP si alguna fuente es "whip".
+func (m *MediaManager) GetWHIPIngest() (*whipIngest, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.whip, m.whip != nil
+}
+
+// GetCodecs devuelve los codecs de las pistas activas para registrarlos en el
+// MediaEngine de WebRTC.
+func (m *MediaManager) GetCodecs() []webrtc.RTPCodecParameters {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var codecs []webrtc.RTPCodecParameters
+	if m.isVideoEnabled && len(m.videoCodecs) > 0 {
+		for _, option := range m.videoCodecs {
+			codecs = append(codecs, option.rtpCodec.RTPCodecParameters)
+		}
+	} else if m.isVideoEnabled && m.videoFanout != nil {
+		codecs = append(codecs, m.videoCodec)
+	}
+	if m.isAudioEnabled && m.audioFanout != nil {
+		audioCodec := m.audioCodec
+		if m.opusParams != nil {
+			// Los parámetros del encoder no se registran: si algún codec de la
+			// oferta (p.ej. RED) coincide con fmtp idéntico, pion negocia solo
+			// esos y Opus quedaría fuera. La respuesta los anuncia con
+			// preferOpusFmtp.
+			audioCodec.SDPFmtpLine = ""
+		}
+		codecs = append(codecs, audioCodec)
+	}
+	return codecs
+}
+
+// isExternalSourceIdentifier indica si la fuente llega ya codificada (fichero,
+// RTP o WHIP) y por tanto no pasa por GetUserMedia.
+func isExternalSourceIdentifier(identifier string) bool {
+	return isFileSourceIdentifier(identifier) || isRTPSourceIdentifier(identifier) || isWHIPSourceIdentifier(identifier)
+}
+
+// startExternalSource publica una fuente ya codificada como pista del tipo indicado.
+func (m *MediaManager) startExternalSource(identifier string, kind webrtc.RTPCodecType, cfg *Config) error {
+	var (
+		source   io.Closer
+		rtpCodec *codec.RTPCodec
+		out      *FanoutTrack
+	)
+	if isWHIPSourceIdentifier(identifier) {
+		whipCodec, err := parseWHIPCodec(identifier, kind)
+		if err != nil {
+			return fmt.Errorf("MediaManager: %w", err)
+		}
+		if m.whip == nil {
+			m.whip = newWHIPIngest(cfg.WHIPToken)
+			m.sources = append(m.sources, m.whip)
+		}
+		rtpCodec, out = whipCodec, m.whip.addTrack(whipCodec, kind)
+		log.Printf("MediaManager: %s esperando publicador WHIP en %s (%s).", kind, whipEndpointPath, rtpCodec.MimeType)
+	} else if isRTPSourceIdentifier(identifier) {
+		ingest, err := startRTPIngest(identifier, kind)
+		if err != nil {
+			return fmt.Errorf("MediaManager: %w", err)
+		}
+		source, rtpCodec, out = ingest, ingest.codec, ingest.out
+		log.Printf("MediaManager: Publicando '%s' como %s (%s).", identifier, kind, rtpCodec.MimeType)
+	} else {
+		path := strings.TrimPrefix(identifier, fileSourcePrefix)
+		player, err := startFilePlayer(path, kind.String(), cfg.Loop, cfg.StartOffset)
+		if err != nil {
+			return fmt.Errorf("MediaManager: %w", err)
+		}
+		if player.out.Kind() != kind {
+			player.Close()
+			return fmt.Errorf("MediaManager: '%s' no contiene %s", path, kind)
+		}
+		source, rtpCodec, out = player, player.codec, player.out
+		log.Printf("MediaManager: Reproduciendo '%s' como %s (%s, bucle=%v, inicio=%v).", path, kind, rtpCodec.MimeType, cfg.Loop, cfg.StartOffset)
+	}
+	if source != nil {
+		m.sources = append(m.sources, source)
+	}
+	if kind == webrtc.RTPCodecTypeVideo {
+		m.configureVideoFanout(out)
+		m.videoCodec, m.videoFanout, m.isVideoEnabled = rtpCodec.RTPCodecParameters, out, true
+	} else {
+		out.EnableDVR(m.dvrWindow, m.dvrMaxBytes)
+		m.audioCodec, m.audioFanout, m.isAudioEnabled = rtpCodec.RTPCodecParameters, out, true
+	}
+	return nil
 }
 
 func (m *MediaManager) Close() {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	m.closeLocked()
+}
+
+func (m *MediaManager) closeLocked() {
+	if m.audioEncoder != nil {
+		if err := m.audioEncoder.Close(); err != nil {
+			log.Printf("MediaManager: Error cerrando encoder de audio: %v", err)
+		}
+		m.audioEncoder = nil
+	}
+	for mimeType, encoder := range m.videoEncoders {
+		closeVideoCodecEncoders(mimeType, encoder, nil)
+	}
+	m.videoEncoders = nil
+	for mimeType, encoders := range m.renditionEncoders {
+		closeVideoCodecEncoders(mimeType, nil, encoders)
+	}
+	m.renditionEncoders = nil
+	// Sin esto, acquireVideoCodec devolvería las pistas de los encoders recién
+	// cerrados en lugar de fallar.
+	m.videoFanouts = nil
+	m.videoViewers = nil
+	for _, source := range m.sources {
+		source.Close()
+	}
+	m.sources = nil
+	m.whip = nil
 	if m.mediaStream != nil {
 		log.Println("MediaManager: Cerrando MediaStream compartido...")
 		for _, track := range m.mediaStream.GetTracks() {
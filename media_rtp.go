@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// Ingesta de RTP por UDP para que ffmpeg o GStreamer alimenten el servidor:
+//
+//	-v rtp:<puerto>:<codec>   p.ej. rtp:5004:vp8, rtp:5004:h264, rtp:5004:av1
+//	-a rtp:<puerto>:opus
+//	-v sdp:<fichero.sdp>      puerto, dirección y codec tomados del m=video del SDP
+//	-a sdp:<fichero.sdp>      ídem con el m=audio
+//
+// Los paquetes se reenvían a los espectadores sin decodificar; FanoutTrack
+// reescribe SSRC, payload type y secuencia para cada uno.
+const (
+	rtpSourcePrefix = "rtp:"
+	sdpSourcePrefix = "sdp:"
+	rtpIngestMTU    = 1500
+)
+
+func isRTPSourceIdentifier(identifier string) bool {
+	return strings.HasPrefix(identifier, rtpSourcePrefix) || strings.HasPrefix(identifier, sdpSourcePrefix)
+}
+
+// rtpIngestSpec describe qué escuchar y qué codec llega.
+type rtpIngestSpec struct {
+	address     string // host:puerto en el que escuchar
+	codec       *codec.RTPCodec
+	payloadType uint8 // Payload type de entrada (0 = cualquiera)
+}
+
+func parseRTPIngestSpec(identifier string, kind webrtc.RTPCodecType) (rtpIngestSpec, error) {
+	if strings.HasPrefix(identifier, sdpSourcePrefix) {
+		return parseRTPIngestSDP(strings.TrimPrefix(identifier, sdpSourcePrefix), kind)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(identifier, rtpSourcePrefix), ":")
+	if len(parts) != 2 {
+		return rtpIngestSpec{}, fmt.Errorf("formato inválido '%s': rtp:<puerto>:<codec>", identifier)
+	}
+	port, err := strconv.Atoi(parts[0])
+	if err != nil || port <= 0 || port > 65535 {
+		return rtpIngestSpec{}, fmt.Errorf("puerto inválido en '%s'", identifier)
+	}
+	rtpCodec, err := rtpIngestCodec(parts[1], "")
+	if err != nil {
+		return rtpIngestSpec{}, err
+	}
+	return rtpIngestSpec{address: net.JoinHostPort("0.0.0.0", parts[0]), codec: rtpCodec}, nil
+}
+
+// parseRTPIngestSDP toma del SDP la primera descripción de medios del tipo
+// pedido: puerto, dirección de conexión (unicast o multicast) y codec.
+func parseRTPIngestSDP(path string, kind webrtc.RTPCodecType) (rtpIngestSpec, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return rtpIngestSpec{}, err
+	}
+	var description sdp.SessionDescription
+	if err := description.Unmarshal(raw); err != nil {
+		return rtpIngestSpec{}, fmt.Errorf("SDP inválido '%s': %w", path, err)
+	}
+
+	for _, media := range description.MediaDescriptions {
+		if media.MediaName.Media != kind.String() || len(media.MediaName.Formats) == 0 {
+			continue
+		}
+		payloadType, err := strconv.Atoi(media.MediaName.Formats[0])
+		if err != nil {
+			return rtpIngestSpec{}, fmt.Errorf("payload type inválido en '%s'", path)
+		}
+
+		var encoding, fmtp string
+		for _, attr := range media.Attributes {
+			fields := strings.SplitN(attr.Value, " ", 2)
+			if len(fields) != 2 || fields[0] != media.MediaName.Formats[0] {
+				continue
+			}
+			switch attr.Key {
+			case "rtpmap":
+				encoding = strings.SplitN(fields[1], "/", 2)[0]
+			case "fmtp":
+				fmtp = fields[1]
+			}
+		}
+		if encoding == "" {
+			return rtpIngestSpec{}, fmt.Errorf("'%s' no tiene a=rtpmap para el payload type %d", path, payloadType)
+		}
+		rtpCodec, err := rtpIngestCodec(encoding, fmtp)
+		if err != nil {
+			return rtpIngestSpec{}, err
+		}
+
+		host := "0.0.0.0"
+		connection := media.ConnectionInformation
+		if connection == nil {
+			connection = description.ConnectionInformation
+		}
+		if connection != nil && connection.Address != nil {
+			if ip := net.ParseIP(connection.Address.Address); ip != nil && ip.IsMulticast() {
+				host = ip.String()
+			}
+		}
+		return rtpIngestSpec{
+			address:     net.JoinHostPort(host, strconv.Itoa(media.MediaName.Port.Value)),
+			codec:       rtpCodec,
+			payloadType: uint8(payloadType),
+		}, nil
+	}
+	return rtpIngestSpec{}, fmt.Errorf("'%s' no contiene ninguna sección m=%s", path, kind)
+}
+
+// rtpIngestCodec traduce el nombre de codec (de la línea de comandos o del
+// rtpmap) a los parámetros que se anunciarán a los espectadores.
+func rtpIngestCodec(name, fmtp string) (*codec.RTPCodec, error) {
+	var rtpCodec *codec.RTPCodec
+	switch strings.ToLower(name) {
+	case "vp8":
+		rtpCodec = codec.NewRTPVP8Codec(90000)
+	case "vp9":
+		rtpCodec = codec.NewRTPVP9Codec(90000)
+	case "h264":
+		rtpCodec = codec.NewRTPH264Codec(90000)
+	case "av1":
+		rtpCodec = newRTPAV1Codec()
+	case "opus":
+		rtpCodec = codec.NewRTPOpusCodec(48000)
+	default:
+		return nil, fmt.Errorf("codec RTP no soportado '%s' (vp8, vp9, h264, av1, opus)", name)
+	}
+	if fmtp != "" && rtpCodec.MimeType == webrtc.MimeTypeH264 {
+		rtpCodec.SDPFmtpLine = fmtp
+	}
+	return rtpCodec, nil
+}
+
+// newRTPAV1Codec completa los helpers de mediadevices, que no incluyen AV1
+// porque no tiene encoder: solo se usa para reenviar fuentes ya codificadas.
+func newRTPAV1Codec() *codec.RTPCodec {
+	return &codec.RTPCodec{
+		RTPCodecParameters: webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000},
+			PayloadType:        45,
+		},
+		Payloader: &codecs.AV1Payloader{},
+	}
+}
+
+// rtpIngest escucha en un socket UDP y publica los paquetes recibidos.
+type rtpIngest struct {
+	spec     rtpIngestSpec
+	codec    *codec.RTPCodec
+	conn     *net.UDPConn
+	out      *FanoutTrack
+	stopOnce sync.Once
+}
+
+func startRTPIngest(identifier string, kind webrtc.RTPCodecType) (*rtpIngest, error) {
+	spec, err := parseRTPIngestSpec(identifier, kind)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(strings.ToLower(spec.codec.MimeType), strings.ToLower(kind.String())+"/") {
+		return nil, fmt.Errorf("el codec %s no es de %s", spec.codec.MimeType, kind)
+	}
+	addr, err := net.ResolveUDPAddr("udp", spec.address)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *net.UDPConn
+	if addr.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo escuchar RTP en %s: %w", spec.address, err)
+	}
+
+	in := &rtpIngest{
+		spec:  spec,
+		codec: spec.codec,
+		conn:  conn,
+		out:   NewFanoutTrack(spec.codec.RTPCodecCapability, kind.String(), streamID),
+	}
+	in.out.OnKeyFrameRequest(func() {
+		// El emisor UDP no recibe RTCP: el espectador espera al siguiente keyframe del flujo.
+	})
+	go in.run()
+	log.Printf("MediaManager: Escuchando RTP %s en %s.", spec.codec.MimeType, spec.address)
+	return in, nil
+}
+
+func (in *rtpIngest) run() {
+	buf := make([]byte, rtpIngestMTU)
+	var sourceSSRC uint32
+	for {
+		n, from, err := in.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("MediaManager: Error leyendo RTP en %s: %v", in.spec.address, err)
+			}
+			return
+		}
+		// Con rtcp-mux pueden llegar paquetes RTCP al mismo puerto (PT 192-223).
+		if n < 12 || (buf[1] >= 192 && buf[1] <= 223) {
+			continue
+		}
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(buf[:n]); err != nil {
+			continue
+		}
+		if in.spec.payloadType != 0 && pkt.PayloadType != in.spec.payloadType {
+			continue
+		}
+		if pkt.SSRC != sourceSSRC {
+			log.Printf("MediaManager: Nuevo flujo RTP en %s desde %s (SSRC=%d).", in.spec.address, from, pkt.SSRC)
+			sourceSSRC = pkt.SSRC
+		}
+		in.out.WriteRTP(pkt)
+	}
+}
+
+func (in *rtpIngest) Close() error {
+	var err error
+	in.stopOnce.Do(func() { err = in.conn.Close() })
+	return err
+}
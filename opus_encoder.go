@@ -0,0 +1,317 @@
+package main
+
+/*
+#include <stdint.h>
+
+// Prototipos de libopus. La biblioteca la enlaza pkg/codec/opus de
+// mediadevices (estática por defecto, o por pkg-config con -tags dynamic).
+typedef struct OpusEncoder OpusEncoder;
+OpusEncoder *opus_encoder_create(int32_t Fs, int channels, int application, int *error);
+int32_t opus_encode(OpusEncoder *st, const int16_t *pcm, int frame_size, unsigned char *data, int32_t max_data_bytes);
+int32_t opus_encode_float(OpusEncoder *st, const float *pcm, int frame_size, unsigned char *data, int32_t max_data_bytes);
+int opus_encoder_ctl(OpusEncoder *st, int request, ...);
+void opus_encoder_destroy(OpusEncoder *st);
+
+static int streamer_opus_set(OpusEncoder *st, int request, int value) {
+	return opus_encoder_ctl(st, request, value);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+	_ "github.com/pion/mediadevices/pkg/codec/opus" // Enlaza libopus
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/mediadevices/pkg/wave"
+	"github.com/pion/mediadevices/pkg/wave/mixer"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Encoder Opus del audio capturado. El de mediadevices solo permite elegir el
+// bitrate y la duración de trama, así que se usa libopus directamente para
+// configurar también los canales, la FEC en banda, el DTX y la complejidad.
+// Con DTX, las tramas de silencio no se envían: el timestamp RTP avanza igual
+// y el receptor genera ruido de confort.
+
+// Constantes de opus_defines.h.
+const (
+	opusOK                   = 0
+	opusApplicationVoIP      = 2048
+	opusSetBitrateRequest    = 4002
+	opusSetComplexityRequest = 4010
+	opusSetInbandFECRequest  = 4012
+	opusSetPacketLossRequest = 4014
+	opusSetDTXRequest        = 4016
+	opusMaxPacketSize        = 4000 // Búfer de salida recomendado por libopus: con tramas de 40/60 ms un paquete lleva varias de hasta 1275 bytes
+	opusRTPClockRate         = 48000
+	opusMaxDTXPacketSize     = 2 // Paquetes de este tamaño o menos no se transmiten
+)
+
+var opusFrameDurations = []time.Duration{2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond}
+
+// opusParams son los parámetros del encoder Opus (-audio-channels,
+// -audio-bitrate y -opus-*). Implementa codec.AudioEncoderBuilder.
+type opusParams struct {
+	channels      int
+	bitrate       int
+	fec           bool
+	packetLoss    int // Pérdidas esperadas (%), con las que se dimensiona la FEC
+	dtx           bool
+	complexity    int // 0-10
+	frameDuration time.Duration
+}
+
+func (p opusParams) validate() error {
+	if p.channels != 1 && p.channels != 2 {
+		return fmt.Errorf("-audio-channels debe ser 1 o 2 (es %d)", p.channels)
+	}
+	if p.bitrate < 6000 || p.bitrate > 510000 {
+		return fmt.Errorf("-audio-bitrate fuera del rango de Opus (6000-510000): %d", p.bitrate)
+	}
+	if p.packetLoss < 0 || p.packetLoss > 100 {
+		return fmt.Errorf("-opus-packet-loss debe estar entre 0 y 100 (es %d)", p.packetLoss)
+	}
+	if p.complexity < 0 || p.complexity > 10 {
+		return fmt.Errorf("-opus-complexity debe estar entre 0 y 10 (es %d)", p.complexity)
+	}
+	for _, duration := range opusFrameDurations {
+		if p.frameDuration == duration {
+			return nil
+		}
+	}
+	return fmt.Errorf("-opus-frame-duration inválido %v (2.5ms, 5ms, 10ms, 20ms, 40ms o 60ms)", p.frameDuration)
+}
+
+// fmtpLine describe en el SDP lo que envía el encoder (RFC 7587).
+func (p opusParams) fmtpLine() string {
+	params := []string{"minptime=10", fmt.Sprintf("useinbandfec=%d", boolToInt(p.fec))}
+	if p.dtx {
+		params = append(params, "usedtx=1")
+	}
+	if p.channels == 2 {
+		params = append(params, "stereo=1", "sprop-stereo=1")
+	}
+	params = append(params, fmt.Sprintf("maxaveragebitrate=%d", p.bitrate))
+	return strings.Join(params, ";")
+}
+
+// expectedLoss es el porcentaje de pérdidas que se indica al encoder; sin FEC
+// no se declara ninguno para no restar calidad.
+func (p opusParams) expectedLoss() int {
+	if !p.fec {
+		return 0
+	}
+	return p.packetLoss
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (p *opusParams) RTPCodec() *codec.RTPCodec {
+	c := codec.NewRTPOpusCodec(opusRTPClockRate)
+	c.SDPFmtpLine = p.fmtpLine()
+	c.Latency = p.frameDuration
+	return c
+}
+
+// BuildAudioEncoder crea el encoder para audio con las propiedades indicadas;
+// los canales se mezclan a p.channels.
+func (p *opusParams) BuildAudioEncoder(r audio.Reader, property prop.Media) (codec.ReadCloser, error) {
+	switch property.SampleRate {
+	case 8000, 12000, 16000, 24000, 48000:
+	default:
+		return nil, fmt.Errorf("opus: frecuencia de muestreo no soportada: %d Hz", property.SampleRate)
+	}
+	var cerror C.int
+	engine := C.opus_encoder_create(C.int32_t(property.SampleRate), C.int(p.channels), opusApplicationVoIP, &cerror)
+	if cerror != opusOK {
+		return nil, fmt.Errorf("opus: no se pudo crear el encoder (error %d)", int(cerror))
+	}
+	e := &opusEncoder{engine: engine}
+	for _, ctl := range []struct {
+		name           string
+		request, value int
+	}{
+		{"bitrate", opusSetBitrateRequest, p.bitrate},
+		{"complejidad", opusSetComplexityRequest, p.complexity},
+		{"FEC", opusSetInbandFECRequest, boolToInt(p.fec)},
+		{"pérdidas esperadas", opusSetPacketLossRequest, p.expectedLoss()},
+		{"DTX", opusSetDTXRequest, boolToInt(p.dtx)},
+	} {
+		if result := C.streamer_opus_set(engine, C.int(ctl.request), C.int(ctl.value)); result != opusOK {
+			e.Close()
+			return nil, fmt.Errorf("opus: no se pudo fijar %s=%d (error %d)", ctl.name, ctl.value, int(result))
+		}
+	}
+	frameSamples := int(p.frameDuration * time.Duration(property.SampleRate) / time.Second)
+	e.reader = audio.NewChannelMixer(p.channels, &mixer.MonoMixer{})(audio.NewBuffer(frameSamples)(r))
+	return e, nil
+}
+
+// opusEncoder codifica tramas de audio con libopus.
+type opusEncoder struct {
+	reader audio.Reader
+
+	mutex  sync.Mutex
+	engine *C.OpusEncoder
+}
+
+func (e *opusEncoder) Read() ([]byte, func(), error) {
+	chunk, _, err := e.reader.Read()
+	if err != nil {
+		return nil, func() {}, err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.engine == nil {
+		return nil, func() {}, io.EOF
+	}
+	encoded := make([]byte, opusMaxPacketSize)
+	var n C.int32_t
+	switch b := chunk.(type) {
+	case *wave.Int16Interleaved:
+		n = C.opus_encode(e.engine, (*C.int16_t)(&b.Data[0]), C.int(b.ChunkInfo().Len), (*C.uchar)(&encoded[0]), C.int32_t(len(encoded)))
+	case *wave.Float32Interleaved:
+		n = C.opus_encode_float(e.engine, (*C.float)(&b.Data[0]), C.int(b.ChunkInfo().Len), (*C.uchar)(&encoded[0]), C.int32_t(len(encoded)))
+	default:
+		return nil, func() {}, fmt.Errorf("opus: formato de audio no soportado %T", chunk)
+	}
+	if n < 0 {
+		return nil, func() {}, fmt.Errorf("opus: error codificando (%d)", int(n))
+	}
+	return encoded[:n], func() {}, nil
+}
+
+// SetBitRate permite cambiar el bitrate en marcha (codec.BitRateController).
+func (e *opusEncoder) SetBitRate(bitrate int) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.engine == nil {
+		return io.EOF
+	}
+	if result := C.streamer_opus_set(e.engine, opusSetBitrateRequest, C.int(bitrate)); result != opusOK {
+		return fmt.Errorf("opus: no se pudo fijar el bitrate %d (error %d)", bitrate, int(result))
+	}
+	return nil
+}
+
+func (e *opusEncoder) Controller() codec.EncoderController {
+	return e
+}
+
+func (e *opusEncoder) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.engine != nil {
+		C.opus_encoder_destroy(e.engine)
+		e.engine = nil
+	}
+	return nil
+}
+
+// preferOpusFmtp hace que la respuesta SDP anuncie en Opus los parámetros del
+// encoder: pion copia los de la oferta, que describen lo que el espectador
+// quiere recibir pero no lo que se le envía (estéreo, DTX, FEC). Se fijan como
+// preferencia de codecs de las pistas de audio, así que la respuesta que se
+// envía es la misma que LocalDescription() y se mantiene al renegociar. Se
+// llama tras SetRemoteDescription y antes de CreateAnswer.
+func preferOpusFmtp(pc *webrtc.PeerConnection, fmtp string) error {
+	if fmtp == "" {
+		return nil
+	}
+	for _, transceiver := range pc.GetTransceivers() {
+		sender := transceiver.Sender()
+		if transceiver.Kind() != webrtc.RTPCodecTypeAudio || sender == nil {
+			continue
+		}
+		// Los codecs negociados con la oferta, con sus payload types; RED y
+		// los demás se conservan tal cual.
+		codecs := append([]webrtc.RTPCodecParameters(nil), sender.GetParameters().Codecs...)
+		changed := false
+		for i := range codecs {
+			if strings.EqualFold(codecs[i].MimeType, webrtc.MimeTypeOpus) {
+				codecs[i].SDPFmtpLine, changed = fmtp, true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := transceiver.SetCodecPreferences(codecs); err != nil {
+			return fmt.Errorf("no se pudieron fijar los parámetros Opus: %w", err)
+		}
+	}
+	return nil
+}
+
+// sharedAudioEncoder codifica el audio capturado una vez y lo reparte a
+// todos los espectadores a través de su FanoutTrack.
+type sharedAudioEncoder struct {
+	encoder    codec.ReadCloser
+	out        *FanoutTrack
+	packetizer rtp.Packetizer
+	samples    uint32 // Muestras RTP por trama
+}
+
+func startSharedAudioEncoder(track *mediadevices.AudioTrack, params *opusParams, out *FanoutTrack) (*sharedAudioEncoder, error) {
+	reader := track.NewReader(false)
+	// Se descarta un bloque para conocer la frecuencia y los canales capturados.
+	chunk, _, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo leer el audio capturado: %w", err)
+	}
+	info := chunk.ChunkInfo()
+	encoder, err := params.BuildAudioEncoder(reader, prop.Media{Audio: prop.Audio{SampleRate: info.SamplingRate, ChannelCount: info.Channels}})
+	if err != nil {
+		return nil, err
+	}
+	rtpCodec := params.RTPCodec()
+	e := &sharedAudioEncoder{
+		encoder:    encoder,
+		out:        out,
+		packetizer: rtp.NewPacketizer(rtpOutboundMTU, uint8(rtpCodec.PayloadType), rand.Uint32(), rtpCodec.Payloader, rtp.NewRandomSequencer(), rtpCodec.ClockRate),
+		samples:    uint32(params.frameDuration * opusRTPClockRate / time.Second),
+	}
+	log.Printf("MediaManager: Audio capturado a %d Hz con %d canal(es), codificado con %d.", info.SamplingRate, info.Channels, params.channels)
+	go e.run()
+	return e, nil
+}
+
+func (e *sharedAudioEncoder) run() {
+	for {
+		data, release, err := e.encoder.Read()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("MediaManager: Encoder de %s detenido: %v", e.out.ID(), err)
+			}
+			return
+		}
+		if len(data) <= opusMaxDTXPacketSize {
+			e.packetizer.SkipSamples(e.samples) // Silencio con DTX: no se envía
+		} else {
+			for _, pkt := range e.packetizer.Packetize(data, e.samples) {
+				e.out.WriteRTP(pkt)
+			}
+		}
+		release()
+	}
+}
+
+func (e *sharedAudioEncoder) Close() error {
+	return e.encoder.Close()
+}
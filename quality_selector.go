@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+)
+
+const (
+	qualityCheckInterval   = time.Second
+	qualityUpgradeDelay    = 5 * time.Second  // Espera mínima antes de subir de nivel
+	qualityMaxUpgradeDelay = 60 * time.Second // Tope de la espera tras subidas fallidas
+	qualityHighLoss        = 0.10             // Pérdidas que fuerzan a bajar un nivel
+	qualityLowLoss         = 0.02             // Pérdidas máximas para intentar subir
+	qualityUpgradeHeadroom = 1.3              // Estimación necesaria sobre el bitrate actual para subir
+)
+
+// qualityLevel es una de las calidades que puede recibir un espectador.
+type qualityLevel struct {
+	name    string
+	bitrate int
+}
+
+// qualityLadder es lo que controla un qualitySelector para un espectador: las
+// rendiciones (-renditions) o las capas SVC (-svc) de la pista de video.
+type qualityLadder interface {
+	// Levels devuelve los niveles disponibles, del mejor al peor.
+	Levels() []qualityLevel
+	// Current devuelve el nivel actual y las estadísticas del espectador; ok
+	// es false si aún no está vinculado o hay un cambio en curso.
+	Current() (level int, stats FanoutBindingStats, ok bool)
+	SwitchTo(level int)
+}
+
+// qualitySelector elige el nivel de calidad de un espectador. Baja en cuanto la
+// estimación no alcanza el bitrate del actual o las pérdidas son altas. Como
+// GCC no estima por encima de ~1,5 veces lo que se envía, subir es un sondeo:
+// se intenta tras un periodo estable, y si hay que volver a bajar enseguida la
+// espera hasta el siguiente intento se duplica.
+type qualitySelector struct {
+	clientID  string
+	ladder    qualityLadder
+	estimator cc.BandwidthEstimator // nil sin TWCC: solo REMB y pérdidas
+
+	mutex        sync.Mutex
+	manual       string // Nivel fijado por el espectador, "" = automático
+	lastSwitch   time.Time
+	lastUpgrade  time.Time
+	upgradeDelay time.Duration
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newQualitySelector(clientID string, ladder qualityLadder, estimator cc.BandwidthEstimator) *qualitySelector {
+	s := &qualitySelector{
+		clientID:     clientID,
+		ladder:       ladder,
+		estimator:    estimator,
+		lastSwitch:   time.Now(),
+		upgradeDelay: qualityUpgradeDelay,
+		done:         make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// SetLevel fija el nivel por nombre, o vuelve a la selección automática con
+// "auto".
+func (s *qualitySelector) SetLevel(name string) error {
+	if name == "auto" {
+		name = ""
+	} else if levelIndex(s.ladder.Levels(), name) < 0 {
+		return fmt.Errorf("calidad desconocida '%s'", name)
+	}
+	s.mutex.Lock()
+	s.manual = name
+	s.mutex.Unlock()
+	if name == "" {
+		log.Printf("[%s] Calidad automática.", s.clientID)
+	} else {
+		log.Printf("[%s] Calidad fijada por el cliente: %s", s.clientID, name)
+	}
+	s.check()
+	return nil
+}
+
+func levelIndex(levels []qualityLevel, name string) int {
+	for i, level := range levels {
+		if level.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *qualitySelector) run() {
+	ticker := time.NewTicker(qualityCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+func (s *qualitySelector) check() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	levels := s.ladder.Levels()
+	current, stats, ok := s.ladder.Current()
+	if !ok || current >= len(levels) {
+		return // Aún sin negociar, o esperando el keyframe de un cambio
+	}
+
+	target := current
+	estimate := stats.REMB
+	if s.estimator != nil {
+		if gccEstimate := s.estimator.GetTargetBitrate(); estimate == 0 || gccEstimate < estimate {
+			estimate = gccEstimate
+		}
+	}
+	last := len(levels) - 1
+
+	switch {
+	case s.manual != "":
+		if index := levelIndex(levels, s.manual); index >= 0 {
+			target = index
+		}
+	case stats.FractionLost > qualityHighLoss && current < last:
+		target = current + 1
+	case estimate > 0 && estimate < levels[current].bitrate && current < last:
+		target = current + 1
+		for target < last && levels[target].bitrate > estimate {
+			target++
+		}
+	case current > 0 && stats.FractionLost < qualityLowLoss && time.Since(s.lastSwitch) >= s.upgradeDelay &&
+		(estimate == 0 || float64(estimate) >= qualityUpgradeHeadroom*float64(levels[current].bitrate)):
+		target = current - 1
+	}
+	if target == current {
+		return
+	}
+
+	if s.manual == "" {
+		if target > current && time.Since(s.lastUpgrade) < 2*qualityUpgradeDelay {
+			s.upgradeDelay = min(2*s.upgradeDelay, qualityMaxUpgradeDelay)
+		} else if target > current {
+			s.upgradeDelay = qualityUpgradeDelay
+		}
+		if target < current {
+			s.lastUpgrade = time.Now()
+		}
+	}
+	s.lastSwitch = time.Now()
+	s.ladder.SwitchTo(target)
+	log.Printf("[%s] Calidad %s -> %s (estimación %d kbps, pérdidas %.1f%%).", s.clientID, levels[current].name, levels[target].name, estimate/1000, stats.FractionLost*100)
+}
+
+func (s *qualitySelector) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// Grabación del directo en ficheros WebM (-record). El grabador recibe los
+// mismos paquetes ya codificados que se reparten a los espectadores (video VP8
+// o VP9 de la mejor calidad y audio Opus), sin volver a codificar, y los
+// escribe desde su propia goroutine para que un disco lento no retrase el
+// reparto.
+//
+// De un VP9 con capas espaciales (SVC) solo se graba la base: las capas
+// superiores comparten timestamp con ella y dependen de ella, y WebM espera
+// un bloque decodificable por frame.
+//
+// Cada fichero empieza en un keyframe de video. Al alcanzar
+// -record-max-duration o -record-max-size se pide un keyframe y el fichero se
+// cambia en cuanto llega; también se cambia si cambia la resolución. El
+// nombre sale de la plantilla de -record (ver recordingPath).
+
+const (
+	recorderQueueSize = 4096 // Paquetes en cola hacia la goroutine de escritura
+	recorderMaxLate   = 256  // Paquetes que se espera a uno que falta antes de darlo por perdido
+
+	recorderTrackVideo = 1
+	recorderTrackAudio = 2
+)
+
+// recorderConfig son los parámetros de grabación.
+type recorderConfig struct {
+	id           string // Identificador de la grabación (%i en la plantilla)
+	pathTemplate string
+	literalPath  bool          // pathTemplate es la ruta del fichero, sin expandir (clips)
+	maxDuration  time.Duration // 0 = sin límite
+	maxSize      int64         // Bytes, 0 = sin límite
+	single       bool          // Un solo fichero aunque cambie la resolución (clips)
+}
+
+// recorderPacket es un paquete de la fuente con su instante de llegada.
+type recorderPacket struct {
+	video bool
+	pkt   *rtp.Packet
+	at    time.Time
+}
+
+// Recorder graba las pistas compartidas en ficheros WebM.
+type Recorder struct {
+	cfg      recorderConfig
+	video    *FanoutTrack // nil si no se graba video
+	audio    *FanoutTrack // nil si no se graba audio
+	channels int
+	codecID  string // V_VP8 o V_VP9
+
+	live    bool // Recibe el directo: puede pedir keyframes
+	packets chan recorderPacket
+	remove  []func()
+	done    chan struct{}
+	dropped atomic.Int64
+
+	// Estado de la goroutine de escritura.
+	videoBuilder *samplebuilder.SampleBuilder
+	videoSSRC    uint32
+	videoSVC     *vp9LayerFilter      // nil salvo con VP9
+	videoSkipped uint16               // Paquetes descartados por videoSVC (se renumeran los demás)
+	videoArrival map[uint32]time.Time // Llegada del primer paquete de cada frame, por timestamp
+	videoClock   recorderClock
+	audioClock   recorderClock
+	waitKeyFrame bool // Faltan paquetes de video: se espera al siguiente keyframe
+	file         *webmWriter
+	path         string
+	fileStart    time.Time
+	fileIndex    int
+	width        int
+	height       int
+	rotate       bool // El fichero actual llegó al límite
+
+	filesMutex sync.Mutex
+	files      []recordingFile // Ficheros escritos; si hay uno abierto, es el último
+}
+
+// NewRecorder empieza a grabar las pistas indicadas (video VP8/VP9 y audio
+// Opus; cualquiera de las dos puede ser nil).
+func NewRecorder(cfg recorderConfig, video, audio *FanoutTrack, channels int) (*Recorder, error) {
+	r, kinds, err := newRecorder(cfg, video, audio, channels)
+	if err != nil {
+		return nil, err
+	}
+	r.live = true
+	go r.run()
+	if video != nil {
+		r.remove = append(r.remove, video.AddSink(0, r.enqueue(true)))
+		video.RequestKeyFrame(0, keyFrameReasonRecord)
+	}
+	if audio != nil {
+		r.remove = append(r.remove, audio.AddSink(0, r.enqueue(false)))
+	}
+	var limits []string
+	if cfg.maxDuration > 0 {
+		limits = append(limits, cfg.maxDuration.String())
+	}
+	if cfg.maxSize > 0 {
+		limits = append(limits, fmt.Sprintf("%d MB", cfg.maxSize/(1024*1024)))
+	}
+	rotation := "sin rotación"
+	if len(limits) > 0 {
+		rotation = "rotación cada " + strings.Join(limits, " o ")
+	}
+	log.Printf("Recorder(%s): Grabando %s en '%s' (%s).", r.cfg.id, strings.Join(kinds, " + "), cfg.pathTemplate, rotation)
+	return r, nil
+}
+
+// writeRecording escribe de una vez paquetes ya guardados (p.ej. del buffer
+// DVR), ordenados por llegada, y devuelve los ficheros escritos.
+func writeRecording(cfg recorderConfig, video, audio *FanoutTrack, channels int, packets []recorderPacket) ([]recordingFile, error) {
+	r, _, err := newRecorder(cfg, video, audio, channels)
+	if err != nil {
+		return nil, err
+	}
+	go r.run()
+	for _, p := range packets {
+		r.packets <- p
+	}
+	close(r.packets)
+	<-r.done
+	return r.Files(), nil
+}
+
+// newRecorder valida los parámetros y prepara el grabador, sin arrancarlo.
+func newRecorder(cfg recorderConfig, video, audio *FanoutTrack, channels int) (*Recorder, []string, error) {
+	if cfg.pathTemplate == "" {
+		return nil, nil, errors.New("falta la plantilla de nombre de fichero")
+	}
+	if cfg.maxDuration < 0 || cfg.maxSize < 0 {
+		return nil, nil, errors.New("-record-max-duration y -record-max-size no pueden ser negativos")
+	}
+	if video == nil && audio == nil {
+		return nil, nil, errors.New("no hay pistas que grabar (el video debe ser VP8 o VP9 y el audio Opus)")
+	}
+	r := &Recorder{
+		cfg:      cfg,
+		video:    video,
+		audio:    audio,
+		channels: channels,
+		packets:  make(chan recorderPacket, recorderQueueSize),
+		done:     make(chan struct{}),
+	}
+	var kinds []string
+	if video != nil {
+		mimeType := video.Codec().MimeType
+		switch strings.ToLower(mimeType) {
+		case "video/vp8":
+			r.codecID = "V_VP8"
+		case "video/vp9":
+			r.codecID = "V_VP9"
+			r.videoSVC = newVP9LayerFilter()
+			r.videoSVC.targetSpatial.Store(0)
+		default:
+			return nil, nil, fmt.Errorf("WebM no admite video %s", mimeType)
+		}
+		r.videoBuilder = r.newVideoBuilder()
+		r.videoClock.clockRate = video.Codec().ClockRate
+		kinds = append(kinds, mimeType)
+	}
+	if audio != nil {
+		if !strings.EqualFold(audio.Codec().MimeType, webrtc.MimeTypeOpus) {
+			return nil, nil, fmt.Errorf("WebM no admite audio %s", audio.Codec().MimeType)
+		}
+		r.audioClock.clockRate = audio.Codec().ClockRate
+		kinds = append(kinds, audio.Codec().MimeType)
+	}
+	return r, kinds, nil
+}
+
+// Close deja de recibir paquetes, escribe los pendientes y cierra el fichero
+// en curso.
+func (r *Recorder) Close() {
+	for _, remove := range r.remove {
+		remove()
+	}
+	close(r.packets)
+	<-r.done
+	if dropped := r.dropped.Load(); dropped > 0 {
+		log.Printf("Recorder(%s): %d paquetes descartados porque la escritura no daba abasto.", r.cfg.id, dropped)
+	}
+	log.Printf("Recorder(%s): Grabación detenida.", r.cfg.id)
+}
+
+// enqueue devuelve la función que recibe los paquetes de una pista. Si la cola
+// está llena el paquete se descarta: el reparto a los espectadores no espera.
+func (r *Recorder) enqueue(video bool) func(pkt *rtp.Packet) {
+	return func(pkt *rtp.Packet) {
+		select {
+		case r.packets <- recorderPacket{video: video, pkt: pkt.Clone(), at: time.Now()}:
+		default:
+			if r.dropped.Add(1) == 1 {
+				log.Printf("Recorder(%s): La escritura no da abasto; se descartan paquetes.", r.cfg.id)
+			}
+		}
+	}
+}
+
+func (r *Recorder) newVideoBuilder() *samplebuilder.SampleBuilder {
+	var depacketizer rtp.Depacketizer = &codecs.VP8Packet{}
+	if r.codecID == "V_VP9" {
+		depacketizer = &codecs.VP9Packet{}
+	}
+	return samplebuilder.New(recorderMaxLate, depacketizer, r.video.Codec().ClockRate)
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+	var last time.Time
+	for p := range r.packets {
+		last = p.at
+		if p.video {
+			r.handleVideo(p)
+		} else {
+			r.handleAudio(p)
+		}
+	}
+	if r.videoBuilder != nil {
+		r.flushVideo(last)
+	}
+	r.closeFile()
+}
+
+func (r *Recorder) handleVideo(p recorderPacket) {
+	// Otro SSRC es otra secuencia (p.ej. encoder reconstruido): se vacía el
+	// ensamblador para que no confunda los números de secuencia.
+	if p.pkt.SSRC != r.videoSSRC {
+		r.flushVideo(p.at)
+		r.videoBuilder = r.newVideoBuilder()
+		r.videoSSRC = p.pkt.SSRC
+		r.videoSkipped = 0
+	}
+	if r.videoSVC != nil {
+		forward, marker := r.videoSVC.filter(parseVP9Descriptor(p.pkt.Payload), p.pkt.Marker)
+		if !forward {
+			r.videoSkipped++
+			return
+		}
+		pkt := *p.pkt // Puede ser del buffer DVR: no se modifica
+		pkt.Marker, pkt.SequenceNumber = marker, pkt.SequenceNumber-r.videoSkipped
+		p.pkt = &pkt
+	}
+	// El ensamblador entrega cada frame al llegar el siguiente: se guarda
+	// cuándo llegó el suyo para no desfasar el video respecto al audio.
+	if _, ok := r.videoArrival[p.pkt.Timestamp]; !ok {
+		if len(r.videoArrival) >= recorderMaxLate {
+			r.videoArrival = nil
+		}
+		if r.videoArrival == nil {
+			r.videoArrival = make(map[uint32]time.Time)
+		}
+		r.videoArrival[p.pkt.Timestamp] = p.at
+	}
+	r.videoBuilder.Push(p.pkt)
+	for sample := r.videoBuilder.Pop(); sample != nil; sample = r.videoBuilder.Pop() {
+		r.writeVideo(sample, p.at)
+	}
+}
+
+func (r *Recorder) flushVideo(at time.Time) {
+	r.videoBuilder.Flush()
+	for sample := r.videoBuilder.Pop(); sample != nil; sample = r.videoBuilder.Pop() {
+		r.writeVideo(sample, at)
+	}
+}
+
+func (r *Recorder) writeVideo(sample *media.Sample, arrival time.Time) {
+	if first, ok := r.videoArrival[sample.PacketTimestamp]; ok {
+		arrival = first
+		delete(r.videoArrival, sample.PacketTimestamp)
+	}
+	keyFrame, width, height := webmVideoFrameInfo(r.codecID, sample.Data)
+	at := r.videoClock.at(r.videoSSRC, sample.PacketTimestamp, arrival)
+	if !keyFrame && (sample.PrevDroppedPackets > 0 || r.waitKeyFrame) {
+		if !r.waitKeyFrame {
+			r.waitKeyFrame = true
+			r.requestKeyFrame()
+		}
+		return
+	}
+	if keyFrame {
+		r.waitKeyFrame = false
+		resized := !r.cfg.single && (width != r.width || height != r.height)
+		if r.file == nil || r.rotate || resized {
+			r.openFile(at, width, height)
+		}
+	}
+	if r.file != nil {
+		r.writeFrame(recorderTrackVideo, at, keyFrame, sample.Data)
+	}
+}
+
+func (r *Recorder) handleAudio(p recorderPacket) {
+	if len(p.pkt.Payload) == 0 {
+		return
+	}
+	at := r.audioClock.at(p.pkt.SSRC, p.pkt.Timestamp, p.at)
+	// Sin video no hay keyframes que esperar: el fichero se abre o se cambia
+	// con cualquier paquete de audio.
+	if r.video == nil && (r.file == nil || r.rotate) {
+		r.openFile(at, 0, 0)
+	}
+	if r.file != nil {
+		r.writeFrame(recorderTrackAudio, at, true, p.pkt.Payload)
+	}
+}
+
+// writeFrame escribe un frame en el fichero en curso y comprueba los límites
+// de rotación.
+func (r *Recorder) writeFrame(track uint64, at time.Time, keyFrame bool, data []byte) {
+	timecode := at.Sub(r.fileStart).Milliseconds()
+	if timecode < 0 {
+		return // Audio anterior al keyframe con el que empieza el fichero
+	}
+	if err := r.file.WriteFrame(track, timecode, keyFrame, data); err != nil {
+		log.Printf("Recorder(%s): Error escribiendo en '%s': %v", r.cfg.id, r.path, err)
+		r.closeFile()
+		return
+	}
+	r.updateFile()
+	if r.rotate {
+		return
+	}
+	if (r.cfg.maxDuration > 0 && r.file.Duration() >= r.cfg.maxDuration) || (r.cfg.maxSize > 0 && r.file.Size() >= r.cfg.maxSize) {
+		r.rotate = true
+		r.requestKeyFrame()
+	}
+}
+
+// requestKeyFrame pide un keyframe del video en directo para empezar un
+// fichero o recuperarse de una pérdida.
+func (r *Recorder) requestKeyFrame() {
+	if r.live && r.video != nil {
+		r.video.RequestKeyFrame(0, keyFrameReasonRecord)
+	}
+}
+
+// openFile cierra el fichero en curso y empieza otro en el instante indicado.
+func (r *Recorder) openFile(start time.Time, width, height int) {
+	r.closeFile()
+	r.rotate = false
+	r.fileIndex++
+
+	var tracks []webmTrack
+	if r.video != nil {
+		tracks = append(tracks, webmTrack{number: recorderTrackVideo, trackType: webmTrackVideo, codecID: r.codecID, width: width, height: height})
+	}
+	if r.audio != nil {
+		tracks = append(tracks, webmTrack{number: recorderTrackAudio, trackType: webmTrackAudio, codecID: "A_OPUS",
+			codecPrivate: webmOpusHead(r.channels), sampleRate: 48000, channels: r.channels})
+	}
+
+	path := r.cfg.pathTemplate
+	if !r.cfg.literalPath {
+		path = recordingPath(r.cfg.pathTemplate, start, r.fileIndex, r.cfg.id)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("Recorder(%s): Error creando el directorio de '%s': %v", r.cfg.id, path, err)
+		return
+	}
+	// No se sobrescriben grabaciones: si el nombre existe se añade un sufijo.
+	ext := filepath.Ext(path)
+	candidate := path
+	for i := 2; ; i++ {
+		file, err := newWebMWriter(candidate, tracks, start)
+		if errors.Is(err, os.ErrExist) && i < 100 {
+			candidate = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), i, ext)
+			continue
+		}
+		if err != nil {
+			log.Printf("Recorder(%s): Error creando '%s': %v", r.cfg.id, candidate, err)
+			return
+		}
+		r.file, r.path = file, candidate
+		break
+	}
+	r.filesMutex.Lock()
+	r.files = append(r.files, recordingFile{Path: r.path})
+	r.filesMutex.Unlock()
+	r.fileStart, r.width, r.height = start, width, height
+	if r.video != nil {
+		log.Printf("Recorder(%s): Nuevo fichero '%s' (%dx%d).", r.cfg.id, r.path, width, height)
+	} else {
+		log.Printf("Recorder(%s): Nuevo fichero '%s'.", r.cfg.id, r.path)
+	}
+}
+
+func (r *Recorder) closeFile() {
+	if r.file == nil {
+		return
+	}
+	err := r.file.Close()
+	duration, size := r.updateFile()
+	if err != nil {
+		log.Printf("Recorder(%s): Error cerrando '%s': %v", r.cfg.id, r.path, err)
+	} else {
+		log.Printf("Recorder(%s): Fichero '%s' cerrado (%v, %.1f MB).", r.cfg.id, r.path, duration.Round(time.Second), float64(size)/(1024*1024))
+	}
+	r.file = nil
+}
+
+// updateFile actualiza la duración y el tamaño del fichero en curso en la
+// lista de ficheros, y los devuelve.
+func (r *Recorder) updateFile() (time.Duration, int64) {
+	duration, size := r.file.Duration(), r.file.Size()
+	r.filesMutex.Lock()
+	defer r.filesMutex.Unlock()
+	if last := len(r.files) - 1; last >= 0 {
+		r.files[last].Duration, r.files[last].Bytes = duration.Seconds(), size
+	}
+	return duration, size
+}
+
+// Files devuelve los ficheros escritos hasta ahora, con su duración y tamaño.
+func (r *Recorder) Files() []recordingFile {
+	r.filesMutex.Lock()
+	defer r.filesMutex.Unlock()
+	return append([]recordingFile(nil), r.files...)
+}
+
+// recorderClock convierte los timestamps RTP de una pista en instantes de
+// reloj: el primer paquete (o el primero de otro SSRC) se ancla a su llegada y
+// los siguientes avanzan según su timestamp. Si la fuente se desvía más de un
+// segundo de la llegada (pausa, bucle de un fichero) se vuelve a anclar.
+type recorderClock struct {
+	clockRate uint32
+	started   bool
+	ssrc      uint32
+	lastTS    uint32
+	ticks     int64 // Timestamp extendido desde el ancla
+	base      time.Time
+}
+
+func (c *recorderClock) at(ssrc, timestamp uint32, arrival time.Time) time.Time {
+	if !c.started || ssrc != c.ssrc {
+		c.started, c.ssrc, c.lastTS, c.ticks, c.base = true, ssrc, timestamp, 0, arrival
+		return arrival
+	}
+	c.ticks += int64(int32(timestamp - c.lastTS))
+	c.lastTS = timestamp
+	at := c.base.Add(time.Duration(float64(c.ticks) / float64(c.clockRate) * float64(time.Second)))
+	if drift := arrival.Sub(at); drift > time.Second || drift < -time.Second {
+		c.ticks, c.base = 0, arrival
+		return arrival
+	}
+	return at
+}
+
+// recordingPath expande la plantilla de -record con el instante de inicio
+// del fichero (hora local): %Y, %m, %d, %H, %M, %S, %n (número de fichero
+// de la grabación, 0001...), %i (identificador de la grabación) y %%. Sin
+// extensión se añade ".webm".
+func recordingPath(template string, start time.Time, index int, id string) string {
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' || i+1 == len(template) {
+			b.WriteByte(template[i])
+			continue
+		}
+		i++
+		switch template[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", start.Year())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(start.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", start.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", start.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", start.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", start.Second())
+		case 'n':
+			fmt.Fprintf(&b, "%04d", index)
+		case 'i':
+			b.WriteString(id)
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(template[i])
+		}
+	}
+	path := b.String()
+	if filepath.Ext(path) == "" {
+		path += ".webm"
+	}
+	return path
+}
+
+// webmVideoFrameInfo indica si un frame VP8/VP9 es un keyframe y, en ese
+// caso, su tamaño.
+func webmVideoFrameInfo(codecID string, frame []byte) (keyFrame bool, width, height int) {
+	if codecID == "V_VP9" {
+		return vp9FrameInfo(frame)
+	}
+	// VP8 (RFC 6386, 9.1): bit P a 0, código de inicio y tamaño de 14 bits.
+	if len(frame) < 10 || frame[0]&0x01 != 0 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+		return false, 0, 0
+	}
+	width = int(frame[6]) | int(frame[7]&0x3f)<<8
+	height = int(frame[8]) | int(frame[9]&0x3f)<<8
+	return true, width, height
+}
+
+// vp9FrameInfo lee la cabecera no comprimida de un frame VP9 (en una
+// supertrama, la del primero).
+func vp9FrameInfo(frame []byte) (keyFrame bool, width, height int) {
+	pos := 0
+	bit := func() int {
+		if pos >= len(frame)*8 {
+			return 0
+		}
+		v := int(frame[pos/8]>>(7-pos%8)) & 1
+		pos++
+		return v
+	}
+	bits := func(n int) int {
+		v := 0
+		for ; n > 0; n-- {
+			v = v<<1 | bit()
+		}
+		return v
+	}
+	if bits(2) != 2 { // frame_marker
+		return false, 0, 0
+	}
+	profile := bit()
+	profile |= bit() << 1
+	if profile == 3 {
+		bit()
+	}
+	if bit() == 1 || bit() == 1 { // show_existing_frame, frame_type (1 = no keyframe)
+		return false, 0, 0
+	}
+	bits(2) // show_frame, error_resilient_mode
+	if bits(24) != 0x498342 {
+		return false, 0, 0
+	}
+	if profile >= 2 {
+		bit() // ten_or_twelve_bit
+	}
+	if bits(3) != 7 { // color_space != CS_RGB
+		bit() // color_range
+		if profile == 1 || profile == 3 {
+			bits(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		bit() // reserved_zero
+	}
+	width, height = bits(16)+1, bits(16)+1
+	if pos > len(frame)*8 {
+		return false, 0, 0
+	}
+	return true, width, height
+}
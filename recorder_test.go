@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+func TestRecordingPath(t *testing.T) {
+	start := time.Date(2024, 3, 5, 7, 8, 9, 0, time.Local)
+	tests := []struct {
+		template string
+		index    int
+		id       string
+		want     string
+	}{
+		{"rec/%Y%m%d-%H%M%S", 1, "", "rec/20240305-070809.webm"},
+		{"%i-%n.mkv", 12, "abc", "abc-0012.mkv"},
+		{"100%%", 1, "", "100%.webm"},
+		{"a%q%", 1, "", "a%q%.webm"},
+		{"clip.webm", 3, "x", "clip.webm"},
+	}
+	for _, tt := range tests {
+		if got := recordingPath(tt.template, start, tt.index, tt.id); got != tt.want {
+			t.Errorf("recordingPath(%q, %d, %q) = %q, se esperaba %q", tt.template, tt.index, tt.id, got, tt.want)
+		}
+	}
+}
+
+// De un VP9 con dos capas espaciales solo se graba la base: un bloque por
+// frame con los datos de S0.
+func TestWriteRecordingVP9SVC(t *testing.T) {
+	keyFrame := []byte{0x82, 0x49, 0x83, 0x42, 0x00, 0x13, 0xf0, 0x0b, 0x30} // Perfil 0, 320x180
+	var (
+		packets []recorderPacket
+		want    [][]byte
+		seq     uint16
+	)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		for sid := byte(0); sid < 2; sid++ {
+			b0 := byte(0x80 | 0x20 | 0x08 | 0x04) // I L B E
+			data := []byte{0x86, byte(0x10*(sid+1) + byte(i))}
+			if i > 0 || sid > 0 {
+				b0 |= 0x40 // P
+			} else {
+				data = append(append([]byte(nil), keyFrame...), 0x10)
+			}
+			if sid == 0 {
+				want = append(want, data)
+			}
+			payload := append([]byte{b0, byte(i), sid << 1, 0}, data...)
+			packets = append(packets, recorderPacket{
+				video: true,
+				pkt:   &rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(i * 3000), SSRC: 1, Marker: sid == 1}, Payload: payload},
+				at:    start.Add(time.Duration(i) * 33 * time.Millisecond),
+			})
+			seq++
+		}
+	}
+
+	video := NewFanoutTrack(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000}, "video", "test")
+	cfg := recorderConfig{id: "test", pathTemplate: filepath.Join(t.TempDir(), "svc.webm"), single: true}
+	files, err := writeRecording(cfg, video, nil, 0, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("%d ficheros, se esperaba 1", len(files))
+	}
+	data, err := os.ReadFile(files[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := readEBMLTest(t, readEBMLTest(t, data)[1].data)
+	var got [][]byte
+	for _, cluster := range findEBMLTest(segment, mkvIDCluster) {
+		for _, block := range findEBMLTest(readEBMLTest(t, cluster.data), mkvIDSimpleBlock) {
+			got = append(got, block.data[4:])
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d bloques, se esperaban %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("bloque %d: % X, se esperaba % X", i, got[i], want[i])
+		}
+	}
+	// Los paquetes pueden venir del buffer DVR: no se modifican.
+	if packets[0].pkt.Marker || packets[2].pkt.SequenceNumber != 2 {
+		t.Errorf("el grabador modificó los paquetes de entrada")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Grabaciones bajo demanda (/admin/recordings). Además de la grabación
+// continua de -record, un operador puede empezar y parar grabaciones del
+// directo cuando las necesita, p.ej. para capturar una incidencia. Cada una
+// tiene su propio Recorder con la plantilla de -recordings-path y los mismos
+// límites de rotación, y los clientes WebSocket reciben un mensaje
+// {"type":"recording","event":"started"|"stopped",...} al empezar y al parar.
+
+const (
+	recordingContinuousID = "continuous" // ID de la grabación de -record
+	maxActiveRecordings   = 8            // Grabaciones bajo demanda simultáneas
+	maxRecordingNameLen   = 200
+
+	recordingEventStarted = "started"
+	recordingEventStopped = "stopped"
+)
+
+var (
+	errRecordingNotFound   = errors.New("grabación no encontrada")
+	errRecordingStopped    = errors.New("la grabación ya está detenida")
+	errRecordingContinuous = errors.New("la grabación continua (-record) no se detiene desde la API")
+	errTooManyRecordings   = fmt.Errorf("ya hay %d grabaciones en curso", maxActiveRecordings)
+)
+
+// recordingFile es un fichero de una grabación.
+type recordingFile struct {
+	Path     string  `json:"path"`
+	Duration float64 `json:"duration"` // Segundos
+	Bytes    int64   `json:"bytes"`
+}
+
+// recordingInfo describe una grabación en las respuestas de la API y en los
+// eventos WebSocket.
+type recordingInfo struct {
+	ID         string          `json:"id"`
+	Name       string          `json:"name,omitempty"`
+	Continuous bool            `json:"continuous,omitempty"` // La de -record
+	Active     bool            `json:"active"`
+	StartedAt  time.Time       `json:"started-at"`
+	StoppedAt  *time.Time      `json:"stopped-at,omitempty"`
+	Path       string          `json:"path"`     // Fichero en curso o, si ya terminó, el último
+	Duration   float64         `json:"duration"` // Segundos, suma de los ficheros
+	Bytes      int64           `json:"bytes"`    // Suma de los ficheros
+	Files      []recordingFile `json:"files"`
+}
+
+// recording es una grabación (activa o terminada) desde el arranque.
+type recording struct {
+	id         string
+	name       string
+	continuous bool
+	recorder   *Recorder
+	video      *FanoutTrack // Se devuelve al MediaManager al terminar
+	startedAt  time.Time
+	stoppedAt  time.Time // Cero mientras está activa
+	stopping   bool
+}
+
+func (r *recording) info() recordingInfo {
+	info := recordingInfo{
+		ID:         r.id,
+		Name:       r.name,
+		Continuous: r.continuous,
+		Active:     !r.stopping,
+		StartedAt:  r.startedAt,
+		Files:      r.recorder.Files(),
+	}
+	if !r.stoppedAt.IsZero() {
+		stoppedAt := r.stoppedAt
+		info.StoppedAt = &stoppedAt
+	}
+	for _, file := range info.Files {
+		info.Duration += file.Duration
+		info.Bytes += file.Bytes
+		info.Path = file.Path
+	}
+	if info.Files == nil {
+		info.Files = []recordingFile{}
+	}
+	return info
+}
+
+// recordingManager lleva las grabaciones del directo.
+type recordingManager struct {
+	media       *MediaManager
+	template    string // -recordings-path
+	maxDuration time.Duration
+	maxSize     int64
+
+	mutex      sync.Mutex
+	recordings map[string]*recording
+	starting   int // Grabaciones bajo demanda con plaza reservada que aún no están en recordings
+	onEvent    func(event string, info recordingInfo, active int)
+}
+
+func newRecordingManager(media *MediaManager, template string, maxDuration time.Duration, maxSize int64) *recordingManager {
+	return &recordingManager{
+		media:       media,
+		template:    template,
+		maxDuration: maxDuration,
+		maxSize:     maxSize,
+		recordings:  make(map[string]*recording),
+	}
+}
+
+// OnEvent registra la función que se llama al empezar o parar una grabación,
+// con el número de grabaciones activas.
+func (m *recordingManager) OnEvent(f func(event string, info recordingInfo, active int)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.onEvent = f
+}
+
+// StartContinuous empieza la grabación continua de -record.
+func (m *recordingManager) StartContinuous(template string) error {
+	_, err := m.start(recordingContinuousID, "", template, true)
+	return err
+}
+
+// Start empieza una grabación bajo demanda con el nombre (opcional) indicado.
+func (m *recordingManager) Start(name string) (recordingInfo, error) {
+	name = strings.TrimSpace(name)
+	if len(name) > maxRecordingNameLen {
+		return recordingInfo{}, fmt.Errorf("el nombre no puede tener más de %d caracteres", maxRecordingNameLen)
+	}
+	// La plaza se reserva con el mismo lock con el que se cuentan las activas,
+	// para que dos peticiones simultáneas no pasen a la vez de maxActiveRecordings.
+	m.mutex.Lock()
+	active := m.starting
+	for _, r := range m.recordings {
+		if !r.continuous && !r.stopping {
+			active++
+		}
+	}
+	if active >= maxActiveRecordings {
+		m.mutex.Unlock()
+		return recordingInfo{}, errTooManyRecordings
+	}
+	m.starting++
+	m.mutex.Unlock()
+	return m.start(uuid.NewString(), name, m.template, false)
+}
+
+func (m *recordingManager) start(id, name, template string, continuous bool) (recordingInfo, error) {
+	video, audio, channels := m.media.GetRecordingTracks()
+	recorder, err := NewRecorder(recorderConfig{
+		id:           id,
+		pathTemplate: template,
+		maxDuration:  m.maxDuration,
+		maxSize:      m.maxSize,
+	}, video, audio, channels)
+	if err != nil {
+		m.media.ReleaseVideoTrack(video)
+		if !continuous {
+			m.mutex.Lock()
+			m.starting--
+			m.mutex.Unlock()
+		}
+		return recordingInfo{}, err
+	}
+	r := &recording{id: id, name: name, continuous: continuous, recorder: recorder, video: video, startedAt: time.Now()}
+
+	m.mutex.Lock()
+	if !continuous {
+		m.starting--
+	}
+	m.recordings[id] = r
+	info, onEvent, active := r.info(), m.onEvent, m.activeLocked()
+	m.mutex.Unlock()
+
+	if name != "" {
+		log.Printf("Recorder(%s): Grabación '%s' iniciada.", id, name)
+	}
+	if onEvent != nil {
+		onEvent(recordingEventStarted, info, active)
+	}
+	return info, nil
+}
+
+// Stop detiene una grabación bajo demanda y devuelve su estado final.
+func (m *recordingManager) Stop(id string) (recordingInfo, error) {
+	m.mutex.Lock()
+	r, ok := m.recordings[id]
+	switch {
+	case !ok:
+		m.mutex.Unlock()
+		return recordingInfo{}, errRecordingNotFound
+	case r.continuous:
+		m.mutex.Unlock()
+		return recordingInfo{}, errRecordingContinuous
+	case r.stopping:
+		m.mutex.Unlock()
+		return recordingInfo{}, errRecordingStopped
+	}
+	r.stopping = true
+	m.mutex.Unlock()
+
+	return m.finish(r), nil
+}
+
+// finish cierra el Recorder de una grabación ya marcada como detenida.
+func (m *recordingManager) finish(r *recording) recordingInfo {
+	r.recorder.Close()
+	m.media.ReleaseVideoTrack(r.video)
+
+	m.mutex.Lock()
+	r.stoppedAt = time.Now()
+	info, onEvent, active := r.info(), m.onEvent, m.activeLocked()
+	m.mutex.Unlock()
+
+	if onEvent != nil {
+		onEvent(recordingEventStopped, info, active)
+	}
+	return info
+}
+
+// Get devuelve el estado de una grabación.
+func (m *recordingManager) Get(id string) (recordingInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	r, ok := m.recordings[id]
+	if !ok {
+		return recordingInfo{}, errRecordingNotFound
+	}
+	return r.info(), nil
+}
+
+// List devuelve todas las grabaciones desde el arranque, por orden de inicio.
+func (m *recordingManager) List() []recordingInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := make([]recordingInfo, 0, len(m.recordings))
+	for _, r := range m.recordings {
+		list = append(list, r.info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	return list
+}
+
+// ActiveCount devuelve el número de grabaciones en curso (incluida la continua).
+func (m *recordingManager) ActiveCount() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.activeLocked()
+}
+
+func (m *recordingManager) activeLocked() int {
+	active := 0
+	for _, r := range m.recordings {
+		if !r.stopping {
+			active++
+		}
+	}
+	return active
+}
+
+// Close detiene todas las grabaciones en curso, cerrando sus ficheros.
+func (m *recordingManager) Close() {
+	m.mutex.Lock()
+	var active []*recording
+	for _, r := range m.recordings {
+		if !r.stopping {
+			r.stopping = true
+			active = append(active, r)
+		}
+	}
+	m.mutex.Unlock()
+	for _, r := range active {
+		m.finish(r)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Redundancia para espectadores en enlaces con pérdidas, donde esperar a una
+// retransmisión NACK llega tarde:
+//   - Audio (-audio-red): RED (RFC 2198). Cada paquete Opus lleva además las
+//     últimas tramas enviadas, así que una pérdida aislada se recupera del
+//     paquete siguiente.
+//   - Video (-video-fec): FlexFEC (draft-ietf-payload-flexible-fec-scheme-03,
+//     el que implementa libwebrtc). Cada N paquetes de video se envía un paquete
+//     de reparación con el XOR de todos ellos, por un SSRC propio; el espectador
+//     reconstruye cualquier paquete perdido del grupo.
+//
+// Ambos se anuncian en el MediaEngine y solo se usan con los espectadores que
+// los negocian. Chrome ofrece audio/red por defecto, pero flexfec-03 solo con
+// los field trials WebRTC-FlexFEC-03-Advertised y WebRTC-FlexFEC-03.
+
+const (
+	mimeTypeRED          = "audio/red"
+	redPayloadType       = 63 // El mismo que usa Chrome
+	redMaxDistance       = 3
+	redMaxTimestampDelta = 1<<14 - 1 // Límites de la cabecera de bloque RED
+	redMaxBlockLength    = 1<<10 - 1
+
+	flexFECPayloadType  = 49
+	flexFECMaxGroup     = 15 // Cabe en la primera máscara de la cabecera FlexFEC
+	flexFECHeaderSize   = 20
+	flexFECRepairWindow = "repair-window=10000000" // µs, como libwebrtc
+)
+
+// registerRedundancyCodecs registra audio/red (apuntando a Opus) y
+// flexfec-03 según la configuración. used son los payload types ya ocupados.
+func registerRedundancyCodecs(mediaEngine *webrtc.MediaEngine, codecs []webrtc.RTPCodecParameters, used map[webrtc.PayloadType]bool, cfg *Config) error {
+	if cfg.AudioRED > 0 {
+		registered := false
+		for _, codec := range codecs {
+			if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
+				continue
+			}
+			red := webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRED, ClockRate: 48000, Channels: 2, SDPFmtpLine: fmt.Sprintf("%d/%d", codec.PayloadType, codec.PayloadType)},
+				PayloadType:        freePayloadType(used, redPayloadType),
+			}
+			if err := mediaEngine.RegisterCodec(red, webrtc.RTPCodecTypeAudio); err != nil {
+				return fmt.Errorf("WebRTCManager: fallo al registrar RED: %w", err)
+			}
+			registered = true
+			break
+		}
+		if !registered {
+			log.Println("WebRTCManager: -audio-red sin audio Opus, no se anuncia RED.")
+		}
+	}
+	if cfg.VideoFEC > 0 {
+		flexFEC := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeFlexFEC03, ClockRate: 90000, SDPFmtpLine: flexFECRepairWindow},
+			PayloadType:        freePayloadType(used, flexFECPayloadType),
+		}
+		if err := mediaEngine.RegisterCodec(flexFEC, webrtc.RTPCodecTypeVideo); err != nil {
+			return fmt.Errorf("WebRTCManager: fallo al registrar FlexFEC: %w", err)
+		}
+	}
+	return nil
+}
+
+// freePayloadType reserva el payload type preferido o, si está ocupado, el
+// primero libre por debajo (rango dinámico 35-63).
+func freePayloadType(used map[webrtc.PayloadType]bool, preferred webrtc.PayloadType) webrtc.PayloadType {
+	payloadType := preferred
+	for used[payloadType] {
+		payloadType--
+	}
+	used[payloadType] = true
+	return payloadType
+}
+
+// redCodecFor devuelve el codec RED negociado que encapsula primary (Opus),
+// si lo hay. Su fmtp lista los payload types de los bloques, p.ej. "111/111".
+func redCodecFor(negotiated []webrtc.RTPCodecParameters, primary webrtc.RTPCodecParameters) (webrtc.RTPCodecParameters, bool) {
+	if !strings.EqualFold(primary.MimeType, webrtc.MimeTypeOpus) {
+		return webrtc.RTPCodecParameters{}, false
+	}
+	for _, codec := range negotiated {
+		if strings.EqualFold(codec.MimeType, mimeTypeRED) && redPrimaryPayloadType(codec.SDPFmtpLine) == int(primary.PayloadType) {
+			return codec, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+func redPrimaryPayloadType(fmtp string) int {
+	first, _, _ := strings.Cut(fmtp, "/")
+	payloadType, err := strconv.Atoi(strings.TrimSpace(first))
+	if err != nil {
+		return -1
+	}
+	return payloadType
+}
+
+// redInterceptor encapsula en RED los paquetes Opus de las pistas vinculadas
+// como audio/red. La FanoutTrack los escribe con el payload type de Opus; los
+// que ya llegan como RED (una fuente que envía RED) pasan sin cambios.
+type redInterceptor struct {
+	interceptor.NoOp
+	distance int // Tramas anteriores que se repiten en cada paquete
+}
+
+// NewInterceptor implementa interceptor.Factory. No guarda estado por
+// PeerConnection, así que se comparte.
+func (i *redInterceptor) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return i, nil
+}
+
+func (i *redInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if !strings.EqualFold(info.MimeType, mimeTypeRED) {
+		return writer
+	}
+	primary := redPrimaryPayloadType(info.SDPFmtpLine)
+	if primary < 0 {
+		log.Printf("WebRTCManager: fmtp RED '%s' no válido, se envía sin redundancia.", info.SDPFmtpLine)
+		return writer
+	}
+	encoder := &redEncoder{distance: i.distance, primaryPayloadType: uint8(primary)}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if header.PayloadType != encoder.primaryPayloadType {
+			return writer.Write(header, payload, attributes)
+		}
+		redHeader := *header
+		redHeader.PayloadType = info.PayloadType
+		return writer.Write(&redHeader, encoder.encode(header.Timestamp, payload), attributes)
+	})
+}
+
+// redEncoder construye los paquetes RED de un flujo.
+type redEncoder struct {
+	distance           int
+	primaryPayloadType uint8
+
+	mutex   sync.Mutex
+	history []redBlock // Últimas tramas enviadas, de la más antigua a la más reciente
+}
+
+type redBlock struct {
+	timestamp uint32
+	payload   []byte
+}
+
+// encode devuelve el payload RED con las tramas anteriores que aún se pueden
+// referenciar (distancia y tamaño limitados por la cabecera) y la actual.
+func (e *redEncoder) encode(timestamp uint32, payload []byte) []byte {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var blocks []redBlock
+	size := 1 + len(payload)
+	for _, block := range e.history {
+		delta := timestamp - block.timestamp
+		if delta == 0 || delta > redMaxTimestampDelta || len(block.payload) > redMaxBlockLength {
+			continue
+		}
+		blocks = append(blocks, block)
+		size += 4 + len(block.payload)
+	}
+
+	//  0                   1                   2                   3
+	//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |1| block PT    |  timestamp offset         |   block length    |
+	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+	// |0| block PT    |  (el bloque principal solo lleva este byte)
+	out := make([]byte, 0, size)
+	for _, block := range blocks {
+		offsetAndLength := (timestamp-block.timestamp)<<10 | uint32(len(block.payload))
+		out = append(out, 0x80|e.primaryPayloadType, byte(offsetAndLength>>16), byte(offsetAndLength>>8), byte(offsetAndLength))
+	}
+	out = append(out, e.primaryPayloadType)
+	for _, block := range blocks {
+		out = append(out, block.payload...)
+	}
+	out = append(out, payload...)
+
+	// El payload pertenece a la fuente compartida: se guarda una copia.
+	e.history = append(e.history, redBlock{timestamp: timestamp, payload: append([]byte(nil), payload...)})
+	if len(e.history) > e.distance {
+		e.history = e.history[len(e.history)-e.distance:]
+	}
+	return out
+}
+
+// flexFECInterceptor añade paquetes FlexFEC a los flujos de video cuyo
+// espectador negoció flexfec-03 (pion les asigna un SSRC de FEC).
+type flexFECInterceptor struct {
+	interceptor.NoOp
+	group int // Paquetes de video por paquete FEC
+}
+
+// NewInterceptor implementa interceptor.Factory. No guarda estado por
+// PeerConnection, así que se comparte.
+func (i *flexFECInterceptor) NewInterceptor(string) (interceptor.Interceptor, error) {
+	return i, nil
+}
+
+func (i *flexFECInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if info.SSRCForwardErrorCorrection == 0 || info.PayloadTypeForwardErrorCorrection == 0 {
+		return writer
+	}
+	encoder := &flexFECEncoder{
+		group:       i.group,
+		ssrc:        info.SSRC,
+		fecSSRC:     info.SSRCForwardErrorCorrection,
+		payloadType: info.PayloadTypeForwardErrorCorrection,
+		sequencer:   rtp.NewRandomSequencer(),
+	}
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, attributes)
+		if err != nil || header.SSRC != encoder.ssrc {
+			return n, err
+		}
+		if fec := encoder.add(header, payload); fec != nil {
+			if _, err := writer.Write(&fec.Header, fec.Payload, interceptor.Attributes{}); err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	})
+}
+
+// flexFECEncoder agrupa los paquetes consecutivos de un flujo y genera un
+// paquete FlexFEC por grupo.
+type flexFECEncoder struct {
+	group       int
+	ssrc        uint32
+	fecSSRC     uint32
+	payloadType uint8
+	sequencer   rtp.Sequencer
+
+	mutex   sync.Mutex
+	packets [][]byte // Paquetes del grupo en curso, serializados
+	baseSeq uint16
+	nextSeq uint16
+	lastTS  uint32
+}
+
+// add incorpora un paquete enviado y devuelve el paquete FEC cuando se
+// completa el grupo. Las retransmisiones (números de secuencia ya vistos) se
+// ignoran y un hueco empieza un grupo nuevo, porque la máscara describe
+// paquetes consecutivos a partir de baseSeq.
+func (e *flexFECEncoder) add(header *rtp.Header, payload []byte) *rtp.Packet {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if len(e.packets) > 0 && header.SequenceNumber != e.nextSeq {
+		if int16(header.SequenceNumber-e.nextSeq) < 0 {
+			return nil
+		}
+		e.packets = e.packets[:0]
+	}
+	raw, err := (&rtp.Packet{Header: *header, Payload: payload}).Marshal()
+	if err != nil {
+		return nil
+	}
+	if len(e.packets) == 0 {
+		e.baseSeq = header.SequenceNumber
+	}
+	e.packets = append(e.packets, raw)
+	e.nextSeq = header.SequenceNumber + 1
+	e.lastTS = header.Timestamp
+	if len(e.packets) < e.group {
+		return nil
+	}
+	fec := e.encode()
+	e.packets = e.packets[:0]
+	return fec
+}
+
+// encode genera el paquete de reparación del grupo en curso:
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|R|F|P|X|  CC   |M| PT recovery |        length recovery        |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                          TS recovery                          |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|   SSRCCount   |                    reserved                   |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                             SSRC                              |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|           SN base             |1|        Mask [0-14]          |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// seguida del XOR de todo lo que va detrás de la cabecera fija RTP (CSRC,
+// extensiones, payload y relleno) de cada paquete.
+func (e *flexFECEncoder) encode() *rtp.Packet {
+	header := make([]byte, flexFECHeaderSize)
+	var repair []byte
+	for _, raw := range e.packets {
+		header[0] ^= raw[0]
+		header[1] ^= raw[1]
+		length := uint16(len(raw) - 12)
+		header[2] ^= byte(length >> 8)
+		header[3] ^= byte(length)
+		for i := 4; i < 8; i++ {
+			header[i] ^= raw[i]
+		}
+		if extra := len(raw) - 12 - len(repair); extra > 0 {
+			repair = append(repair, make([]byte, extra)...)
+		}
+		for i, b := range raw[12:] {
+			repair[i] ^= b
+		}
+	}
+	header[0] &= 0x3f // R=0, F=0: máscara flexible
+	header[8] = 1     // Protege un solo SSRC
+	binary.BigEndian.PutUint32(header[12:16], e.ssrc)
+	binary.BigEndian.PutUint16(header[16:18], e.baseSeq)
+	mask := uint16(0x8000) // k=1: no hay más máscaras
+	for i := range e.packets {
+		mask |= 1 << (14 - i)
+	}
+	binary.BigEndian.PutUint16(header[18:20], mask)
+
+	return &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    e.payloadType,
+			SequenceNumber: e.sequencer.NextSequenceNumber(),
+			Timestamp:      e.lastTS,
+			SSRC:           e.fecSSRC,
+		},
+		Payload: append(header, repair...),
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestREDEncoderEncode(t *testing.T) {
+	type step struct {
+		timestamp uint32
+		payload   []byte
+		want      []byte
+	}
+	big := make([]byte, redMaxBlockLength+1)
+	tests := []struct {
+		name     string
+		distance int
+		steps    []step
+	}{
+		{
+			name:     "bloques anteriores hasta la distancia",
+			distance: 2,
+			steps: []step{
+				{1000, []byte{1, 2}, []byte{0x6F, 1, 2}},
+				{1960, []byte{3}, []byte{0xEF, 0x0F, 0x00, 0x02, 0x6F, 1, 2, 3}},
+				{2920, []byte{4}, []byte{0xEF, 0x1E, 0x00, 0x02, 0xEF, 0x0F, 0x00, 0x01, 0x6F, 1, 2, 3, 4}},
+				{3880, []byte{5}, []byte{0xEF, 0x1E, 0x00, 0x01, 0xEF, 0x0F, 0x00, 0x01, 0x6F, 3, 4, 5}},
+			},
+		},
+		{
+			name:     "desplazamiento de timestamp demasiado grande",
+			distance: 1,
+			steps: []step{
+				{0, []byte{1}, []byte{0x6F, 1}},
+				{redMaxTimestampDelta + 1, []byte{2}, []byte{0x6F, 2}},
+			},
+		},
+		{
+			name:     "mismo timestamp",
+			distance: 1,
+			steps: []step{
+				{5, []byte{1}, []byte{0x6F, 1}},
+				{5, []byte{2}, []byte{0x6F, 2}},
+			},
+		},
+		{
+			name:     "bloque demasiado largo",
+			distance: 1,
+			steps: []step{
+				{0, big, append([]byte{0x6F}, big...)},
+				{960, []byte{2}, []byte{0x6F, 2}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		encoder := &redEncoder{distance: tt.distance, primaryPayloadType: 111}
+		for i, s := range tt.steps {
+			payload := append([]byte(nil), s.payload...)
+			got := encoder.encode(s.timestamp, payload)
+			if !bytes.Equal(got, s.want) {
+				t.Errorf("%s, paso %d: % X, se esperaba % X", tt.name, i, got, s.want)
+			}
+			payload[0] ^= 0xFF // El encoder guarda su propia copia
+		}
+	}
+}
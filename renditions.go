@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/rtp"
+)
+
+// Escalera de calidades (-renditions): el video capturado se codifica una vez
+// por rendición (p.ej. 1080p, 720p y 360p, cada una con su bitrate) y cada
+// espectador recibe una de ellas como capa de la FanoutTrack de video. Su
+// qualitySelector la elige según la estimación de ancho de banda y las
+// pérdidas que informa el espectador, o la fija el propio espectador con el
+// mensaje {"type":"rendition","name":"360p"} ("auto" vuelve a la selección
+// automática). El coste de codificar depende del número de rendiciones, no del
+// de espectadores.
+
+type rendition struct {
+	name    string
+	height  int
+	bitrate int
+}
+
+// parseRenditions interpreta una lista como "1080p:4M,720p:2000k,360p:600000"
+// y la devuelve ordenada de más a menos calidad.
+func parseRenditions(spec string) ([]rendition, error) {
+	var renditions []rendition
+	seen := make(map[int]bool)
+	for _, item := range splitList(spec) {
+		name, rate, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("rendición inválida '%s' (se espera <alto>p:<bitrate>)", item)
+		}
+		height, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(name), "p"))
+		if err != nil || height <= 0 {
+			return nil, fmt.Errorf("altura inválida en la rendición '%s'", item)
+		}
+		bitrate, err := parseBitrate(rate)
+		if err != nil {
+			return nil, fmt.Errorf("rendición '%s': %w", item, err)
+		}
+		if seen[height] {
+			return nil, fmt.Errorf("rendición %dp repetida", height)
+		}
+		seen[height] = true
+		renditions = append(renditions, rendition{name: fmt.Sprintf("%dp", height), height: height, bitrate: bitrate})
+	}
+	sort.Slice(renditions, func(i, j int) bool { return renditions[i].height > renditions[j].height })
+	return renditions, nil
+}
+
+// renditionBitrateRange devuelve el suelo y el techo de la estimación de
+// ancho de banda para una escalera: el bitrate de la rendición más baja y el de
+// la más alta con el margen que exige qualitySelector para subir a ella. Con
+// -max-bitrate por debajo, la estimación nunca permitiría elegir la más alta.
+func renditionBitrateRange(renditions []rendition) (int, int) {
+	lowest, highest := renditions[0].bitrate, renditions[0].bitrate
+	for _, r := range renditions[1:] {
+		lowest, highest = min(lowest, r.bitrate), max(highest, r.bitrate)
+	}
+	return lowest, int(math.Ceil(qualityUpgradeHeadroom * float64(highest)))
+}
+
+// parseBitrate acepta bps o los sufijos k y M (p.ej. 800k, 2.5M).
+func parseBitrate(value string) (int, error) {
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(value, "k"), strings.HasSuffix(value, "K"):
+		multiplier, value = 1e3, value[:len(value)-1]
+	case strings.HasSuffix(value, "M"):
+		multiplier, value = 1e6, value[:len(value)-1]
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("bitrate inválido '%s'", value)
+	}
+	return int(number * multiplier), nil
+}
+
+// renditionEncoder codifica una rendición y la escribe como capa de la
+// FanoutTrack compartida.
+type renditionEncoder struct {
+	rendition  rendition
+	layer      int
+	out        *FanoutTrack
+	clockRate  uint32
+	packetizer rtp.Packetizer
+	encoder    codec.ReadCloser
+}
+
+func startRenditionEncoder(track *mediadevices.VideoTrack, videoCodec videoCodecOption, r rendition, layer int, out *FanoutTrack) (*renditionEncoder, error) {
+	// Nunca se escala hacia arriba: si la captura es menor, se codifica tal cual.
+	encoder, err := buildScaledVideoEncoder(track, videoCodec, r.bitrate, func(width, height int) (int, int) {
+		if height <= r.height {
+			return width, height
+		}
+		return (width * r.height / height) &^ 1, r.height
+	}, 0)
+	if err != nil {
+		return nil, fmt.Errorf("rendición %s: %w", r.name, err)
+	}
+	rtpCodec := videoCodec.rtpCodec
+	e := &renditionEncoder{
+		rendition:  r,
+		layer:      layer,
+		out:        out,
+		clockRate:  rtpCodec.ClockRate,
+		packetizer: rtp.NewPacketizer(rtpOutboundMTU, uint8(rtpCodec.PayloadType), rand.Uint32(), rtpCodec.Payloader, rtp.NewRandomSequencer(), rtpCodec.ClockRate),
+		encoder:    encoder,
+	}
+	go e.run()
+	return e, nil
+}
+
+func (e *renditionEncoder) run() {
+	last := time.Now()
+	for {
+		data, release, err := e.encoder.Read()
+		if err != nil {
+			log.Printf("MediaManager: Encoder de la rendición %s detenido: %v", e.rendition.name, err)
+			return
+		}
+		now := time.Now()
+		samples := uint32(now.Sub(last).Seconds() * float64(e.clockRate))
+		last = now
+		for _, pkt := range e.packetizer.Packetize(data, samples) {
+			e.out.WriteLayerRTP(e.layer, pkt)
+		}
+		release()
+	}
+}
+
+func (e *renditionEncoder) ForceKeyFrame() {
+	if keyFrameController, ok := e.encoder.Controller().(codec.KeyFrameController); ok {
+		if err := keyFrameController.ForceKeyFrame(); err != nil {
+			log.Printf("MediaManager: Error forzando keyframe en la rendición %s: %v", e.rendition.name, err)
+		}
+	}
+}
+
+func (e *renditionEncoder) Close() error {
+	return e.encoder.Close()
+}
+
+// renditionLadder presenta las rendiciones al qualitySelector; cada una es
+// una capa de la FanoutTrack de video.
+type renditionLadder struct {
+	track      *FanoutTrack
+	ssrc       uint32
+	renditions []rendition
+}
+
+func (l *renditionLadder) Levels() []qualityLevel {
+	levels := make([]qualityLevel, len(l.renditions))
+	for i, r := range l.renditions {
+		levels[i] = qualityLevel{name: r.name, bitrate: r.bitrate}
+	}
+	return levels
+}
+
+func (l *renditionLadder) Current() (int, FanoutBindingStats, bool) {
+	stats, ok := l.track.BindingStats(l.ssrc)
+	return stats.Layer, stats, ok && stats.PendingLayer < 0
+}
+
+func (l *renditionLadder) SwitchTo(level int) {
+	l.track.SwitchLayer(l.ssrc, level)
+}
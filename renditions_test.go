@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "600000", want: 600000},
+		{value: "800k", want: 800000},
+		{value: "1500K", want: 1500000},
+		{value: "2.5M", want: 2500000},
+		{value: "", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "-1k", wantErr: true},
+		{value: "5m", wantErr: true},
+		{value: "abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBitrate(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseBitrate(%q) = %d, %v; se esperaba %d (error: %v)", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseRenditions(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []rendition
+		wantErr bool
+	}{
+		{spec: "", want: nil},
+		{
+			spec: "1080p:4M,720p:2000k,360p:600000",
+			want: []rendition{{"1080p", 1080, 4000000}, {"720p", 720, 2000000}, {"360p", 360, 600000}},
+		},
+		{
+			spec: " 360p:600k , 1080P:4M ",
+			want: []rendition{{"1080p", 1080, 4000000}, {"360p", 360, 600000}},
+		},
+		{spec: "720p", wantErr: true},
+		{spec: "p:1M", wantErr: true},
+		{spec: "0p:1M", wantErr: true},
+		{spec: "720p:x", wantErr: true},
+		{spec: "720p:1M,720p:2M", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRenditions(tt.spec)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRenditions(%q) = %+v, %v; se esperaba %+v (error: %v)", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestRenditionBitrateRange(t *testing.T) {
+	renditions, err := parseRenditions("720p:2M,1080p:4M,360p:600k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lowest, highest := renditionBitrateRange(renditions)
+	if lowest != 600000 || highest != 5200000 {
+		t.Errorf("renditionBitrateRange = %d-%d, se esperaba 600000-5200000", lowest, highest)
+	}
+}
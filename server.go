@@ -1,8 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	//"fmt"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/webrtc/v4"
 )
 
@@ -23,8 +25,26 @@ var upgrader = websocket.Upgrader{
 
 type Client struct {
 	id             string
-	conn           *websocket.Conn
+	conn           *websocket.Conn // nil en las sesiones WHEP
 	peerConnection *webrtc.PeerConnection
+	adaptiveVideo  *adaptiveVideoEncoder // Encoder propio con -adaptive-bitrate
+	sharedVideo    *FanoutTrack          // Pista de video compartida; se devuelve al MediaManager al irse
+	quality        *qualitySelector      // Elige su rendición (-renditions) o sus capas SVC (-svc)
+	timeshift      *dvrViewer            // Time-shift de sus pistas (-dvr-window), nil si no hay
+	writeMutex     sync.Mutex            // gorilla/websocket admite un solo escritor a la vez
+}
+
+// send escribe un mensaje en el WebSocket del cliente. Lo usan a la vez el
+// bucle de señalización, los callbacks de ICE y los avisos a todos los
+// clientes (broadcast), así que las escrituras se serializan aquí.
+func (c *Client) send(payload []byte) error {
+	if c.conn == nil {
+		return nil // Sesión WHEP: sin WebSocket
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, payload)
 }
 
 type Server struct {
@@ -32,9 +52,14 @@ type Server struct {
 	clientsMutex  sync.Mutex
 	mediaManager  *MediaManager
 	webRTCManager *WebRTCManager
+	turnServer    *TURNServer // Opcional: servidor TURN embebido
+	adminToken    string      // Bearer token de la API de administración
+	recordings    *recordingManager // Grabaciones (-record y bajo demanda)
+	clips         *clipManager      // Clips exportados del buffer DVR
+	httpServer    *http.Server
 }
 
-func NewServer(mm *MediaManager, wm *WebRTCManager) *Server {
+func NewServer(mm *MediaManager, wm *WebRTCManager, ts *TURNServer) *Server {
 	if mm == nil {
 		log.Fatal("Server: MediaManager no puede ser nil")
 	}
@@ -45,17 +70,42 @@ func NewServer(mm *MediaManager, wm *WebRTCManager) *Server {
 		clients:       make(map[string]*Client),
 		mediaManager:  mm,
 		webRTCManager: wm,
+		turnServer:    ts,
+		httpServer:    &http.Server{},
 	}
 }
 
 func (s *Server) RegisterHandlers() {
 	http.HandleFunc("/", s.serveClientHTML)
 	http.HandleFunc("/ws", s.handleWebSocket)
+	http.HandleFunc("POST "+whipEndpointPath, s.handleWHIP)
+	http.HandleFunc("DELETE "+whipEndpointPath+"/{id}", s.handleWHIPResource)
+	http.HandleFunc("POST "+whepEndpointPath, s.handleWHEP)
+	http.HandleFunc("PATCH "+whepEndpointPath+"/{id}", s.handleWHEPPatch)
+	http.HandleFunc("DELETE "+whepEndpointPath+"/{id}", s.handleWHEPDelete)
+	http.HandleFunc("GET "+clipsURLPath+"{file}", s.handleClipDownload) // Definido en clips.go
 }
 
 func (s *Server) Start(addr string) error {
 	log.Printf("Servidor HTTP/WebSocket iniciando en %s", addr)
-	return http.ListenAndServe(addr, nil)
+	s.httpServer.Addr = addr
+	return s.httpServer.ListenAndServe()
+}
+
+// Shutdown deja de aceptar conexiones y espera a que terminen las peticiones
+// HTTP en curso (los WebSocket ya establecidos no se esperan). Start devuelve
+// entonces http.ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// SetRecordings asocia el gestor de grabaciones: la API de administración lo
+// expone y sus eventos se avisan a todos los clientes WebSocket.
+func (s *Server) SetRecordings(recordings *recordingManager) {
+	s.recordings = recordings
+	recordings.OnEvent(func(event string, info recordingInfo, active int) {
+		s.broadcast(map[string]interface{}{"type": "recording", "event": event, "recording": info, "active": active})
+	})
 }
 
 func (s *Server) serveClientHTML(w http.ResponseWriter, r *http.Request) {
@@ -74,12 +124,52 @@ func (s *Server) addClient(client *Client) {
 	s.clientsMutex.Unlock()
 }
 
+// broadcast envía un mensaje a todos los clientes WebSocket conectados.
+func (s *Server) broadcast(msg interface{}) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Server: Error serializando mensaje para los clientes: %v", err)
+		return
+	}
+	s.clientsMutex.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, client := range s.clients {
+		clients = append(clients, client)
+	}
+	s.clientsMutex.Unlock() // Las escrituras pueden tardar hasta wsWriteTimeout
+
+	for _, client := range clients {
+		if err := client.send(payload); err != nil {
+			log.Printf("[%s] Error enviando aviso: %v", client.id, err)
+		}
+	}
+}
+
+func (s *Server) getClient(clientID string) (*Client, bool) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	client, ok := s.clients[clientID]
+	return client, ok
+}
+
 func (s *Server) removeClient(clientID string) {
 	s.clientsMutex.Lock()
 	client, exists := s.clients[clientID]
 	delete(s.clients, clientID) // Siempre eliminar del mapa
 	s.clientsMutex.Unlock()     // Desbloquear antes de operaciones potencialmente largas
 
+	if exists {
+		s.revokeICECredentials(clientID)
+	}
+	if exists && client.adaptiveVideo != nil {
+		client.adaptiveVideo.Close()
+	}
+	if exists && client.quality != nil {
+		client.quality.Close()
+	}
+	if exists && client.sharedVideo != nil {
+		s.mediaManager.ReleaseVideoTrack(client.sharedVideo)
+	}
 	if exists {
 		log.Printf("[%s] Cliente eliminado. Total restantes: %d", clientID, len(s.clients)-1) // -1 es un error, len(s.clients) ya estará actualizado
 		if client.peerConnection != nil && client.peerConnection.ConnectionState() != webrtc.PeerConnectionStateClosed {
@@ -95,6 +185,126 @@ func (s *Server) removeClient(clientID string) {
 	}
 }
 
+// addSharedTracks añade las pistas compartidas del MediaManager al PeerConnection
+// de un espectador (WebSocket o WHEP). Con bitrate adaptativo el video sale de
+// un encoder propio guiado por el estimador del PeerConnection; con varias
+// rendiciones o capas SVC, un qualitySelector elige cuáles recibe. El codec de
+// video es el preferido de entre los que incluye la oferta del espectador.
+// Debe llamarse antes de aplicar la oferta, y antes de addClient o desde la
+// goroutine que después llama a removeClient.
+func (s *Server) addSharedTracks(client *Client, estimator cc.BandwidthEstimator, offer string) {
+	clientID, peerConnection := client.id, client.peerConnection
+	offeredVideo := offeredVideoCodecs(offer)
+	var tracksAdded []string
+	var dvrTracks []dvrViewerTrack
+	dvrComplete := true // Todas sus pistas tienen buffer DVR
+	if s.mediaManager.AdaptiveBitrateEnabled() {
+		if adaptiveVideo, err := s.mediaManager.NewAdaptiveVideoEncoder(clientID, offeredVideo); err != nil {
+			log.Printf("[%s] Fallo al crear el encoder adaptativo: %v", clientID, err)
+		} else if _, err := peerConnection.AddTrack(adaptiveVideo.Track()); err != nil {
+			adaptiveVideo.Close()
+			log.Printf("[%s] Fallo al añadir pista de video: %v", clientID, err)
+		} else {
+			if estimator != nil {
+				estimator.OnTargetBitrateChange(adaptiveVideo.SetGCCEstimate)
+			}
+			client.adaptiveVideo = adaptiveVideo
+			tracksAdded = append(tracksAdded, fmt.Sprintf("Video(%s, adaptativo)", adaptiveVideo.Track().Codec().MimeType))
+			dvrComplete = false
+		}
+	} else if videoTrack, ok := s.mediaManager.GetVideoTrackFor(offeredVideo); ok {
+		if sender, err := peerConnection.AddTrack(videoTrack); err == nil {
+			client.sharedVideo = videoTrack
+			tracksAdded = append(tracksAdded, fmt.Sprintf("Video(%s)", videoTrack.Codec().MimeType))
+			ssrc := uint32(sender.GetParameters().Encodings[0].SSRC)
+			dvrTracks = append(dvrTracks, dvrViewerTrack{track: videoTrack, ssrc: ssrc})
+			if renditions := s.mediaManager.GetRenditions(); len(renditions) > 0 {
+				client.quality = newQualitySelector(clientID, &renditionLadder{track: videoTrack, ssrc: ssrc, renditions: renditions}, estimator)
+			} else if s.mediaManager.SVCEnabled() {
+				client.quality = newQualitySelector(clientID, newSVCLadder(videoTrack, ssrc), estimator)
+			}
+		} else {
+			s.mediaManager.ReleaseVideoTrack(videoTrack)
+			log.Printf("[%s] Fallo al añadir pista de video: %v", clientID, err)
+		}
+	}
+	if audioTrack, ok := s.mediaManager.GetAudioTrack(); ok {
+		if sender, err := peerConnection.AddTrack(audioTrack); err == nil {
+			tracksAdded = append(tracksAdded, "Audio")
+			dvrTracks = append(dvrTracks, dvrViewerTrack{track: audioTrack, ssrc: uint32(sender.GetParameters().Encodings[0].SSRC)})
+		} else { log.Printf("[%s] Fallo al añadir pista de audio: %v", clientID, err) }
+	}
+	for _, t := range dvrTracks {
+		dvrComplete = dvrComplete && t.track.DVREnabled()
+	}
+	if dvrComplete && len(dvrTracks) > 0 {
+		client.timeshift = newDVRViewer(clientID, dvrTracks) // Definido en dvr.go
+	}
+
+	if len(tracksAdded) > 0 {
+		log.Printf("[%s] Pistas compartidas añadidas al PeerConnection: %v", clientID, tracksAdded)
+	} else {
+		log.Printf("[%s] ADVERTENCIA: No se añadieron pistas al PeerConnection. Verifique captura.", clientID)
+		// No retornamos aquí, ya que el cliente podría querer conectarse incluso sin media (aunque no es el caso de uso actual)
+	}
+}
+
+// iceServersFor devuelve los servidores ICE que debe usar el cliente de una
+// sesión: los configurados más, si hay TURN embebido, unas credenciales propias.
+func (s *Server) iceServersFor(sessionID string) []webrtc.ICEServer {
+	servers := s.webRTCManager.ICEServers()
+	if s.turnServer != nil {
+		servers = append(servers, s.turnServer.MintCredentials(sessionID))
+	}
+	return servers
+}
+
+// revokeICECredentials invalida las credenciales TURN de una sesión.
+func (s *Server) revokeICECredentials(sessionID string) {
+	if s.turnServer != nil {
+		s.turnServer.RevokeCredentials(sessionID)
+	}
+}
+
+// setICEServerLinks anuncia los servidores ICE en cabeceras Link, como
+// definen WHIP y WHEP.
+func setICEServerLinks(w http.ResponseWriter, servers []webrtc.ICEServer) {
+	for _, server := range servers {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf("<%s>; rel=\"ice-server\"", url)
+			if server.Username != "" {
+				link += fmt.Sprintf("; username=%q; credential=%q; credential-type=\"password\"", server.Username, server.Credential)
+			}
+			w.Header().Add("Link", link)
+		}
+	}
+}
+
+// answerOffer aplica una oferta SDP, genera la respuesta y espera a que
+// termine la recolección ICE (sin trickle) para devolverla completa. Si
+// opusFmtp no está vacío, la respuesta anuncia esos parámetros Opus.
+func answerOffer(pc *webrtc.PeerConnection, offer, opusFmtp string) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", fmt.Errorf("oferta SDP inválida: %w", err)
+	}
+	if err := preferOpusFmtp(pc, opusFmtp); err != nil {
+		return "", err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("fallo CreateAnswer: %w", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("fallo SetLocalDesc(answer): %w", err)
+	}
+	select {
+	case <-gatherComplete:
+	case <-time.After(5 * time.Second):
+	}
+	return pc.LocalDescription().SDP, nil
+}
+
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil { log.Printf("Fallo al actualizar a WebSocket: %v", err); return }
@@ -102,7 +312,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	clientID := uuid.NewString()
 	log.Printf("[%s] Cliente WebSocket conectado.", clientID)
 
-	peerConnection, err := s.webRTCManager.NewPeerConnection()
+	peerConnection, estimator, err := s.webRTCManager.NewViewerPeerConnection()
 	if err != nil {
 		log.Printf("[%s] Fallo al crear PeerConnection: %v", clientID, err)
 		conn.Close(); return
@@ -110,6 +320,30 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 	client := &Client{id: clientID, conn: conn, peerConnection: peerConnection}
 	s.addClient(client)
+	tracksAdded := false // Las pistas se añaden con la primera oferta, según sus codecs
+
+	// Lo primero que recibe el cliente son los servidores ICE que debe usar.
+	configMsg := map[string]interface{}{"type": "config", "iceServers": s.iceServersFor(clientID)}
+	if renditions := s.mediaManager.GetRenditions(); len(renditions) > 0 {
+		names := make([]string, len(renditions))
+		for i, r := range renditions {
+			names[i] = r.name
+		}
+		configMsg["renditions"] = names
+	}
+	if s.recordings != nil && s.recordings.ActiveCount() > 0 {
+		configMsg["recording"] = true
+	}
+	if window := s.mediaManager.DVRWindow(); window > 0 {
+		configMsg["dvr"] = window.Seconds() // Segundos que se puede retroceder como máximo
+	}
+	configPayload, err := json.Marshal(configMsg)
+	if err == nil {
+		err = client.send(configPayload)
+	}
+	if err != nil {
+		log.Printf("[%s] Fallo al enviar configuración ICE: %v", clientID, err)
+	}
 
 	defer func() {
 		log.Printf("[%s] Iniciando limpieza (defer).", clientID)
@@ -126,25 +360,6 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[%s] Limpieza completada.", clientID)
 	}()
 
-	var tracksAdded []string
-	if videoTrack, ok := s.mediaManager.GetVideoTrack(); ok {
-		if _, err = peerConnection.AddTrack(videoTrack); err == nil {
-			tracksAdded = append(tracksAdded, "Video")
-		} else { log.Printf("[%s] Fallo al añadir pista de video: %v", clientID, err) }
-	}
-	if audioTrack, ok := s.mediaManager.GetAudioTrack(); ok {
-		if _, err = peerConnection.AddTrack(audioTrack); err == nil {
-			tracksAdded = append(tracksAdded, "Audio")
-		} else { log.Printf("[%s] Fallo al añadir pista de audio: %v", clientID, err) }
-	}
-
-	if len(tracksAdded) > 0 {
-		log.Printf("[%s] Pistas compartidas añadidas al PeerConnection: %v", clientID, tracksAdded)
-	} else {
-		log.Printf("[%s] ADVERTENCIA: No se añadieron pistas al PeerConnection. Verifique captura.", clientID)
-		// No retornamos aquí, ya que el cliente podría querer conectarse incluso sin media (aunque no es el caso de uso actual)
-	}
-
 	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate == nil { log.Printf("[%s] ICE finalizado.", clientID); return }
 		log.Printf("[%s] Nuevo ICE local.", clientID)
@@ -152,13 +367,16 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		if errMarshal != nil { log.Printf("[%s] Error serializando candidato ICE: %v", clientID, errMarshal); return }
 		
 		// Escribir en la conexión actual. Si falla, el bucle de lectura lo detectará.
-		if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+		if err := client.send(payload); err != nil {
 			log.Printf("[%s] Error enviando candidato ICE: %v", clientID, err)
 		}
 	})
 
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		log.Printf("[%s] PeerConnection state: %s", clientID, state.String())
+		if state == webrtc.PeerConnectionStateConnected {
+			requestJoinKeyFrames(peerConnection)
+		}
 		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateDisconnected {
 			log.Printf("[%s] PeerConnection cerrado/fallido/desconectado. Cerrando WebSocket.", clientID)
 			conn.Close() // Esto terminará el bucle ReadMessage
@@ -193,11 +411,18 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			sdpString, okSdpStr := sdpData["sdp"].(string)
 			if !okSdpStr { log.Printf("[%s] Error: 'sdp.sdp' no es string.", clientID); continue }
 
+			if !tracksAdded {
+				s.addSharedTracks(client, estimator, sdpString)
+				tracksAdded = true
+			}
 			offer := webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdpString}
 			if err = peerConnection.SetRemoteDescription(offer); err != nil {
 				log.Printf("[%s] Fallo SetRemoteDesc(offer): %v", clientID, err); continue
 			}
 			log.Printf("[%s] RemoteDesc(offer) establecido.", clientID)
+			if err = preferOpusFmtp(peerConnection, s.mediaManager.OpusFmtpLine()); err != nil {
+				log.Printf("[%s] %v", clientID, err); continue
+			}
 
 			answer, errAns := peerConnection.CreateAnswer(nil)
 			if errAns != nil { log.Printf("[%s] Fallo CreateAnswer: %v", clientID, errAns); continue }
@@ -208,7 +433,7 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			}
 			log.Printf("[%s] LocalDesc(answer) establecido.", clientID)
 
-			go func(pcToUse *webrtc.PeerConnection, connToUse *websocket.Conn, currentClientID string) {
+			go func(pcToUse *webrtc.PeerConnection, currentClientID string) {
 				select {
 				case <-time.After(5 * time.Second): log.Printf("[%s] Timeout ICE para respuesta.", currentClientID)
 				case <-gatherComplete: log.Printf("[%s] Recolección ICE completa para respuesta.", currentClientID)
@@ -218,13 +443,12 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				payload, errMrsh := json.Marshal(map[string]interface{}{"type": "answer", "sdp": localDesc})
 				if errMrsh != nil { log.Printf("[%s] Fallo Marshal Answer: %v", currentClientID, errMrsh); return }
 
-				// Escribir en la conexión específica. La conexión 'connToUse' es la que se pasó a la goroutine.
-				if errWr := connToUse.WriteMessage(websocket.TextMessage, payload); errWr != nil {
+				if errWr := client.send(payload); errWr != nil {
 					log.Printf("[%s] Fallo envío Answer SDP: %v", currentClientID, errWr)
 				} else {
 					log.Printf("[%s] Respuesta SDP enviada.", currentClientID)
 				}
-			}(peerConnection, conn, clientID)
+			}(peerConnection, clientID)
 
 		case "candidate":
 			candidateData, okCandData := msg["candidate"].(map[string]interface{})
@@ -239,6 +463,24 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			} else {
 				log.Printf("[%s] Candidato ICE remoto añadido.", clientID)
 			}
+		case "rendition":
+			name, okName := msg["name"].(string)
+			if !okName || client.quality == nil { log.Printf("[%s] 'rendition' ignorado (sin nombre o sin rendiciones).", clientID); continue }
+			if err := client.quality.SetLevel(name); err != nil {
+				log.Printf("[%s] %v", clientID, err)
+			}
+		case "timeshift":
+			offset, okOffset := msg["offset"].(float64)
+			if !okOffset || client.timeshift == nil { log.Printf("[%s] 'timeshift' ignorado (sin offset o sin -dvr-window).", clientID); continue }
+			delay, errSeek := client.timeshift.Seek(time.Duration(offset * float64(time.Second)))
+			reply := map[string]interface{}{"type": "timeshift", "offset": delay.Seconds(), "live": delay == 0, "available": client.timeshift.Available().Seconds()}
+			if errSeek != nil {
+				log.Printf("[%s] %v", clientID, errSeek)
+				reply["error"] = errSeek.Error()
+			}
+			if payload, errMrsh := json.Marshal(reply); errMrsh == nil {
+				if errWr := client.send(payload); errWr != nil { log.Printf("[%s] Fallo envío de 'timeshift': %v", clientID, errWr) }
+			}
 		default:
 			log.Printf("[%s] Tipo de mensaje desconocido: %s", clientID, msg["type"])
 		}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reenvío de capas VP9 SVC (-svc): cuando la fuente de video es VP9 con capas
+// espaciales y/o temporales (p.ej. un navegador que publica por WHIP con
+// scalabilityMode L3T3), cada espectador recibe solo las capas que admite su
+// ancho de banda; el resto de paquetes se descartan al reenviar. Las capas se
+// leen del descriptor de payload VP9 (RFC 9628), así que no hace falta
+// decodificar. El encoder local (libvpx vía mediadevices) no permite
+// configurar capas, por lo que esto solo aplica a fuentes ya codificadas.
+
+const svcMaxLayers = 8 // SID y TID ocupan 3 bits
+
+// vp9Descriptor son los campos del descriptor de payload VP9 que importan
+// para reenviar capas.
+type vp9Descriptor struct {
+	valid        bool
+	interPicture bool // P: depende de frames anteriores
+	hasLayers    bool // L: lleva TID/SID
+	start        bool // B: primer paquete del frame de la capa
+	end          bool // E: último paquete del frame de la capa
+	switchingUp  bool // U: punto de subida de capa temporal
+	temporal     int  // TID
+	spatial      int  // SID
+}
+
+func parseVP9Descriptor(payload []byte) vp9Descriptor {
+	if len(payload) < 1 {
+		return vp9Descriptor{}
+	}
+	d := vp9Descriptor{
+		valid:        true,
+		interPicture: payload[0]&0x40 != 0,
+		hasLayers:    payload[0]&0x20 != 0,
+		start:        payload[0]&0x08 != 0,
+		end:          payload[0]&0x04 != 0,
+	}
+	offset := 1
+	if payload[0]&0x80 != 0 { // I: PictureID de 7 o 15 bits
+		if len(payload) <= offset {
+			return vp9Descriptor{}
+		}
+		if payload[offset]&0x80 != 0 {
+			offset += 2
+		} else {
+			offset++
+		}
+	}
+	if d.hasLayers {
+		if len(payload) <= offset {
+			return vp9Descriptor{}
+		}
+		layers := payload[offset]
+		d.temporal = int(layers >> 5)
+		d.switchingUp = layers&0x10 != 0
+		d.spatial = int(layers>>1) & 0x07
+	}
+	return d
+}
+
+// svcLayerCounters acumula los bytes recibidos de la fuente por capa
+// (espacial, temporal) para estimar lo que cuesta cada combinación.
+type svcLayerCounters struct {
+	bytes [svcMaxLayers][svcMaxLayers]atomic.Int64
+}
+
+func (c *svcLayerCounters) add(d vp9Descriptor, size int) {
+	c.bytes[d.spatial][d.temporal].Add(int64(size))
+}
+
+func (c *svcLayerCounters) snapshot() (s [svcMaxLayers][svcMaxLayers]int64) {
+	for spatial := range c.bytes {
+		for temporal := range c.bytes[spatial] {
+			s[spatial][temporal] = c.bytes[spatial][temporal].Load()
+		}
+	}
+	return s
+}
+
+// vp9LayerFilter decide, paquete a paquete, qué reenviar a un espectador.
+// Los objetivos los fija el selector; los cambios se aplican donde el
+// decodificador puede seguir: bajar al comienzo de un frame, subir de capa
+// temporal en un frame de la capa base o con el bit U, y subir de capa
+// espacial solo en un keyframe.
+type vp9LayerFilter struct {
+	targetSpatial  atomic.Int32
+	targetTemporal atomic.Int32
+
+	// Solo los usa el escritor de la pista (con el mutex de la vinculación).
+	spatial  int
+	temporal int
+}
+
+func newVP9LayerFilter() *vp9LayerFilter {
+	f := &vp9LayerFilter{spatial: svcMaxLayers - 1, temporal: svcMaxLayers - 1}
+	f.targetSpatial.Store(svcMaxLayers - 1)
+	f.targetTemporal.Store(svcMaxLayers - 1)
+	return f
+}
+
+// filter devuelve si el paquete se reenvía y el bit de marcador que debe
+// llevar (se marca el final de la capa espacial más alta reenviada).
+func (f *vp9LayerFilter) filter(d vp9Descriptor, marker bool) (bool, bool) {
+	if !d.valid || !d.hasLayers {
+		return true, marker
+	}
+	if d.start {
+		targetSpatial, targetTemporal := int(f.targetSpatial.Load()), int(f.targetTemporal.Load())
+		if d.spatial == 0 && (targetSpatial < f.spatial || !d.interPicture) {
+			f.spatial = targetSpatial
+		}
+		if targetTemporal < f.temporal || d.temporal == 0 || (d.switchingUp && d.temporal <= targetTemporal) {
+			f.temporal = targetTemporal
+		}
+	}
+	if d.spatial > f.spatial || d.temporal > f.temporal {
+		return false, false
+	}
+	return true, marker || (d.end && d.spatial == f.spatial)
+}
+
+// svcLadder expone las capas de una vinculación como niveles de calidad para
+// el qualitySelector, con el bitrate medido de cada uno. El selector sube y
+// baja por índice, así que los niveles son una cadena fija de combinaciones
+// anidadas (cada una contiene las capas de la siguiente): desde la capa
+// espacial y temporal más altas se baja primero de capa espacial,
+// conservando los frames por segundo, y después de capa temporal sobre la
+// capa espacial base. Con L3T3: S3T3, S2T3, S1T3, S1T2, S1T1.
+type svcLadder struct {
+	track *FanoutTrack
+	ssrc  uint32
+
+	mutex       sync.Mutex
+	lastBytes   [svcMaxLayers][svcMaxLayers]int64
+	lastAt      time.Time
+	levels      []qualityLevel
+	layersOf    []svcLayers // Capas de cada nivel de levels
+	maxSpatial  int         // Capas más altas recibidas de la fuente (-1 = ninguna)
+	maxTemporal int
+	current     svcLayers
+	hasCurrent  bool
+}
+
+type svcLayers struct{ spatial, temporal int }
+
+func newSVCLadder(track *FanoutTrack, ssrc uint32) *svcLadder {
+	return &svcLadder{track: track, ssrc: ssrc, lastBytes: track.svcBytes(), lastAt: time.Now(), maxSpatial: -1, maxTemporal: -1}
+}
+
+// Levels mide, como mucho una vez por segundo, el bitrate de cada nivel (todas
+// las capas espaciales y temporales hasta las suyas). La cadena de niveles
+// solo se rehace si la fuente empieza a enviar una capa más alta.
+func (l *svcLadder) Levels() []qualityLevel {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	elapsed := time.Since(l.lastAt)
+	if elapsed < qualityCheckInterval && l.levels != nil {
+		return l.levels
+	}
+	bytes := l.track.svcBytes()
+	var rates [svcMaxLayers][svcMaxLayers]int
+	maxSpatial, maxTemporal := l.maxSpatial, l.maxTemporal
+	for spatial := range bytes {
+		for temporal := range bytes[spatial] {
+			rates[spatial][temporal] = int(float64(bytes[spatial][temporal]-l.lastBytes[spatial][temporal]) * 8 / elapsed.Seconds())
+			if bytes[spatial][temporal] > 0 {
+				maxSpatial, maxTemporal = max(maxSpatial, spatial), max(maxTemporal, temporal)
+			}
+		}
+	}
+	l.lastBytes, l.lastAt = bytes, time.Now()
+	if maxSpatial < 0 {
+		return nil
+	}
+
+	if maxSpatial != l.maxSpatial || maxTemporal != l.maxTemporal {
+		l.maxSpatial, l.maxTemporal = maxSpatial, maxTemporal
+		l.layersOf = nil
+		for spatial := maxSpatial; spatial >= 0; spatial-- {
+			l.layersOf = append(l.layersOf, svcLayers{spatial, maxTemporal})
+		}
+		for temporal := maxTemporal - 1; temporal >= 0; temporal-- {
+			l.layersOf = append(l.layersOf, svcLayers{0, temporal})
+		}
+	}
+	l.levels = make([]qualityLevel, len(l.layersOf))
+	for i, layers := range l.layersOf {
+		total := 0
+		for s := 0; s <= layers.spatial; s++ {
+			for t := 0; t <= layers.temporal; t++ {
+				total += rates[s][t]
+			}
+		}
+		l.levels[i] = qualityLevel{name: fmt.Sprintf("S%dT%d", layers.spatial+1, layers.temporal+1), bitrate: total}
+	}
+	return l.levels
+}
+
+// Current devuelve el nivel que recibe el espectador: el de las capas fijadas
+// por última vez, o el mejor si aún no se ha fijado ninguno.
+func (l *svcLadder) Current() (int, FanoutBindingStats, bool) {
+	stats, ok := l.track.BindingStats(l.ssrc)
+	if !ok {
+		return 0, stats, false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.hasCurrent {
+		return 0, stats, len(l.levels) > 0
+	}
+	for i, layers := range l.layersOf {
+		if layers == l.current {
+			return i, stats, true
+		}
+	}
+	return 0, stats, false
+}
+
+func (l *svcLadder) SwitchTo(level int) {
+	l.mutex.Lock()
+	if level < 0 || level >= len(l.layersOf) {
+		l.mutex.Unlock()
+		return
+	}
+	layers := l.layersOf[level]
+	l.current, l.hasCurrent = layers, true
+	l.mutex.Unlock()
+	// Al subir de capa espacial, SetBindingMaxLayers pide el keyframe en el
+	// que el filtro puede cambiar; sin él la subida esperaría al siguiente.
+	l.track.SetBindingMaxLayers(l.ssrc, layers.spatial, layers.temporal)
+}
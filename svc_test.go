@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseVP9Descriptor(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    vp9Descriptor
+	}{
+		{name: "vacío", payload: nil, want: vp9Descriptor{}},
+		{
+			name:    "PictureID de 7 bits con capas",
+			payload: []byte{0xA8, 0x05, 0x52, 0x00}, // I L B; TID 2, U, SID 1
+			want:    vp9Descriptor{valid: true, hasLayers: true, start: true, temporal: 2, switchingUp: true, spatial: 1},
+		},
+		{
+			name:    "PictureID de 15 bits",
+			payload: []byte{0xA4, 0x81, 0x23, 0x22}, // I L E; TID 1, SID 1
+			want:    vp9Descriptor{valid: true, hasLayers: true, end: true, temporal: 1, spatial: 1},
+		},
+		{
+			name:    "inter sin capas",
+			payload: []byte{0x48, 0xFF},
+			want:    vp9Descriptor{valid: true, interPicture: true, start: true},
+		},
+		{name: "PictureID ausente", payload: []byte{0x80}, want: vp9Descriptor{}},
+		{name: "capas ausentes", payload: []byte{0xA0, 0x01}, want: vp9Descriptor{}},
+	}
+	for _, tt := range tests {
+		if got := parseVP9Descriptor(tt.payload); got != tt.want {
+			t.Errorf("%s: %+v, se esperaba %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/driver"
+	"github.com/pion/mediadevices/pkg/frame"
+	"github.com/pion/mediadevices/pkg/io/video"
+	"github.com/pion/mediadevices/pkg/prop"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Fuentes de video sintéticas: "-v testsrc:<patrón>[:<ancho>x<alto>[@<fps>]]".
+// Se registran como un driver más de mediadevices para que pasen por el mismo
+// camino (GetUserMedia + encoder) que una cámara real.
+const (
+	testSourcePrefix        = "testsrc:"
+	testSourceDefaultWidth  = 1280
+	testSourceDefaultHeight = 720
+	testSourceDefaultFPS    = 30
+)
+
+// testSourceEpoch es el origen de tiempos común de las fuentes sintéticas.
+var testSourceEpoch = time.Now()
+
+type testPattern string
+
+const (
+	testPatternBars  testPattern = "bars"
+	testPatternClock testPattern = "clock"
+	testPatternNoise testPattern = "noise"
+)
+
+type testVideoSpec struct {
+	pattern testPattern
+	width   int
+	height  int
+	fps     int
+}
+
+func isTestSourceIdentifier(identifier string) bool {
+	return strings.HasPrefix(identifier, testSourcePrefix)
+}
+
+// parseTestVideoSpec interpreta "testsrc:bars", "testsrc:clock:640x480" o
+// "testsrc:noise:1920x1080@25".
+func parseTestVideoSpec(identifier string) (testVideoSpec, error) {
+	spec := testVideoSpec{width: testSourceDefaultWidth, height: testSourceDefaultHeight, fps: testSourceDefaultFPS}
+	parts := strings.SplitN(strings.TrimPrefix(identifier, testSourcePrefix), ":", 2)
+
+	spec.pattern = testPattern(parts[0])
+	switch spec.pattern {
+	case testPatternBars, testPatternClock, testPatternNoise:
+	default:
+		return spec, fmt.Errorf("patrón de prueba desconocido '%s' (bars, clock, noise)", parts[0])
+	}
+
+	if len(parts) == 2 {
+		format := parts[1]
+		if at := strings.Index(format, "@"); at >= 0 {
+			fps, err := strconv.Atoi(format[at+1:])
+			if err != nil || fps <= 0 || fps > 120 {
+				return spec, fmt.Errorf("fps inválido en '%s'", identifier)
+			}
+			spec.fps = fps
+			format = format[:at]
+		}
+		if format != "" {
+			if _, err := fmt.Sscanf(format, "%dx%d", &spec.width, &spec.height); err != nil {
+				return spec, fmt.Errorf("resolución inválida en '%s': %w", identifier, err)
+			}
+		}
+	}
+	if spec.width < 64 || spec.height < 64 || spec.width%2 != 0 || spec.height%2 != 0 {
+		return spec, fmt.Errorf("resolución %dx%d no soportada (mínimo 64x64, valores pares)", spec.width, spec.height)
+	}
+	return spec, nil
+}
+
+// registerTestVideoSource registra en mediadevices un driver de patrón de
+// prueba cuyo Label es el propio identificador, de forma que findDevice lo
+// encuentre como a cualquier otro dispositivo.
+func registerTestVideoSource(identifier string) error {
+	spec, err := parseTestVideoSpec(identifier)
+	if err != nil {
+		return err
+	}
+	if err := driver.GetManager().Register(&testVideoSource{spec: spec}, driver.Info{
+		Label:      identifier,
+		DeviceType: driver.Camera,
+		Priority:   driver.PriorityLow,
+	}); err != nil {
+		return err
+	}
+	log.Printf("Fuente de prueba registrada: patrón '%s', %dx%d@%d", spec.pattern, spec.width, spec.height, spec.fps)
+	return nil
+}
+
+// testVideoSource implementa driver.Adapter y driver.VideoRecorder.
+type testVideoSource struct {
+	spec   testVideoSpec
+	mutex  sync.Mutex
+	closed chan struct{}
+}
+
+func (s *testVideoSource) Open() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = make(chan struct{})
+	return nil
+}
+
+func (s *testVideoSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed != nil {
+		close(s.closed)
+		s.closed = nil
+	}
+	return nil
+}
+
+func (s *testVideoSource) Properties() []prop.Media {
+	return []prop.Media{{
+		Video: prop.Video{
+			Width:       s.spec.width,
+			Height:      s.spec.height,
+			FrameRate:   float32(s.spec.fps),
+			FrameFormat: frame.FormatI420,
+		},
+	}}
+}
+
+func (s *testVideoSource) VideoRecord(p prop.Media) (video.Reader, error) {
+	s.mutex.Lock()
+	closed := s.closed
+	s.mutex.Unlock()
+
+	g := newTestPatternGenerator(s.spec)
+	ticker := time.NewTicker(time.Second / time.Duration(s.spec.fps))
+
+	return video.ReaderFunc(func() (image.Image, func(), error) {
+		select {
+		case <-closed:
+			ticker.Stop()
+			return nil, func() {}, io.EOF
+		case <-ticker.C:
+		}
+		return g.next(time.Now()), func() {}, nil
+	}), nil
+}
+
+// testPatternGenerator dibuja los fotogramas en YCbCr 4:2:0. El número de
+// fotograma se deriva del tiempo transcurrido desde testSourceEpoch, así
+// otras fuentes sintéticas pueden alinearse con él.
+type testPatternGenerator struct {
+	spec     testVideoSpec
+	base     *image.YCbCr // Fondo estático (barras o fondo del reloj)
+	random   *rand.Rand
+	textMask *image.Alpha
+}
+
+func newTestPatternGenerator(spec testVideoSpec) *testPatternGenerator {
+	rect := image.Rect(0, 0, spec.width, spec.height)
+	g := &testPatternGenerator{
+		spec:     spec,
+		base:     image.NewYCbCr(rect, image.YCbCrSubsampleRatio420),
+		random:   rand.New(rand.NewSource(1)),
+		textMask: image.NewAlpha(image.Rect(0, 0, 40*basicfont.Face7x13.Advance, basicfont.Face7x13.Height)),
+	}
+	switch spec.pattern {
+	case testPatternBars:
+		g.drawSMPTEBars(g.base)
+	default:
+		g.fillRect(g.base, rect, color.RGBA{R: 24, G: 24, B: 32, A: 255})
+	}
+	return g
+}
+
+func (g *testPatternGenerator) next(now time.Time) *image.YCbCr {
+	w, h := g.spec.width, g.spec.height
+	frameNumber := testSourceFrameNumber(now, g.spec.fps)
+
+	// Cada fotograma usa su propio buffer: el broadcaster de mediadevices puede
+	// entregarlo a varios lectores.
+	img := image.NewYCbCr(g.base.Rect, image.YCbCrSubsampleRatio420)
+	copy(img.Y, g.base.Y)
+	copy(img.Cb, g.base.Cb)
+	copy(img.Cr, g.base.Cr)
+
+	if g.spec.pattern == testPatternNoise {
+		for i := range img.Y {
+			img.Y[i] = uint8(g.random.Intn(256))
+		}
+	}
+
+	// Caja en movimiento: rebota horizontal y verticalmente.
+	box := h / 8
+	period := int64(g.spec.fps) * 4
+	pos := frameNumber % (2 * period)
+	if pos >= period {
+		pos = 2*period - pos
+	}
+	x := int(pos * int64(w-box) / period)
+	y := int(pos * int64(h-box) / period)
+	g.fillRect(img, image.Rect(x, y, x+box, y+box), color.RGBA{R: 255, G: 255, B: 255, A: 255})
+
+	// Marca de sincronía: destello en la esquina mientras suena el pitido de
+	// la fuente de audio "beep" (comienzo de cada segundo).
+	flashFrames := int64(testSourceBeepDuration.Seconds()*float64(g.spec.fps)) + 1
+	if frameNumber%int64(g.spec.fps) < flashFrames {
+		g.fillRect(img, image.Rect(w-box, 0, w, box), color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	}
+
+	// Reloj de pared y contador de fotogramas.
+	text := fmt.Sprintf("%s  #%06d", now.Format("15:04:05.000"), frameNumber)
+	scale := h / 120
+	if g.spec.pattern == testPatternClock {
+		scale = h / 60
+	}
+	if maxScale := w * 9 / 10 / (len(text) * basicfont.Face7x13.Advance); scale > maxScale {
+		scale = maxScale
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	textW := len(text) * basicfont.Face7x13.Advance * scale
+	textH := basicfont.Face7x13.Height * scale
+	textY := h - textH - h/20
+	if g.spec.pattern == testPatternClock {
+		textY = (h - textH) / 2
+	}
+	g.drawText(img, text, (w-textW)/2, textY, scale)
+	return img
+}
+
+// testSourceFrameNumber devuelve el número de fotograma correspondiente a now
+// para una cadencia de fps fotogramas por segundo.
+func testSourceFrameNumber(now time.Time, fps int) int64 {
+	return int64(now.Sub(testSourceEpoch)) * int64(fps) / int64(time.Second)
+}
+
+// drawSMPTEBars dibuja las barras de color SMPTE (ECR 1-1978) simplificadas:
+// barras al 75%, fila de barras invertidas y fila inferior con -I, blanco,
+// +Q y PLUGE.
+func (g *testPatternGenerator) drawSMPTEBars(img *image.YCbCr) {
+	w, h := g.spec.width, g.spec.height
+	top := h * 67 / 100
+	mid := h * 75 / 100
+
+	bars := []color.RGBA{
+		{191, 191, 191, 255}, {191, 191, 0, 255}, {0, 191, 191, 255}, {0, 191, 0, 255},
+		{191, 0, 191, 255}, {191, 0, 0, 255}, {0, 0, 191, 255},
+	}
+	reverse := []color.RGBA{
+		{0, 0, 191, 255}, {19, 19, 19, 255}, {191, 0, 191, 255}, {19, 19, 19, 255},
+		{0, 191, 191, 255}, {19, 19, 19, 255}, {191, 191, 191, 255},
+	}
+	for i := range bars {
+		x0, x1 := w*i/7, w*(i+1)/7
+		g.fillRect(img, image.Rect(x0, 0, x1, top), bars[i])
+		g.fillRect(img, image.Rect(x0, top, x1, mid), reverse[i])
+	}
+
+	bottom := []struct {
+		width int // En sextos de la anchura de las barras superiores (7 barras = 42 sextos)
+		color color.RGBA
+	}{
+		{7, color.RGBA{0, 33, 76, 255}},     // -I
+		{7, color.RGBA{255, 255, 255, 255}}, // Blanco 100%
+		{7, color.RGBA{50, 0, 106, 255}},    // +Q
+		{9, color.RGBA{19, 19, 19, 255}},    // Negro
+		{2, color.RGBA{9, 9, 9, 255}},       // PLUGE: bajo el negro
+		{2, color.RGBA{19, 19, 19, 255}},    // PLUGE: negro
+		{2, color.RGBA{29, 29, 29, 255}},    // PLUGE: sobre el negro
+		{6, color.RGBA{19, 19, 19, 255}},    // Negro
+	}
+	x := 0
+	for _, b := range bottom {
+		x1 := x + w*b.width/42
+		g.fillRect(img, image.Rect(x, mid, x1, h), b.color)
+		x = x1
+	}
+	g.fillRect(img, image.Rect(x, mid, w, h), color.RGBA{19, 19, 19, 255})
+}
+
+func (g *testPatternGenerator) fillRect(img *image.YCbCr, r image.Rectangle, c color.RGBA) {
+	r = r.Intersect(img.Rect)
+	yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := img.Y[y*img.YStride:]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			row[x] = yy
+		}
+	}
+	for y := r.Min.Y / 2; y < (r.Max.Y+1)/2; y++ {
+		for x := r.Min.X / 2; x < (r.Max.X+1)/2; x++ {
+			img.Cb[y*img.CStride+x] = cb
+			img.Cr[y*img.CStride+x] = cr
+		}
+	}
+}
+
+// drawText escribe texto blanco sobre una banda negra, escalando la fuente
+// bitmap por un factor entero para que sea legible a cualquier resolución.
+func (g *testPatternGenerator) drawText(img *image.YCbCr, text string, x0, y0, scale int) {
+	face := basicfont.Face7x13
+	for i := range g.textMask.Pix {
+		g.textMask.Pix[i] = 0
+	}
+	d := font.Drawer{Dst: g.textMask, Src: image.Opaque, Face: face, Dot: fixed.P(0, face.Ascent)}
+	d.DrawString(text)
+
+	textW := len(text) * face.Advance
+	if textW > g.textMask.Rect.Dx() {
+		textW = g.textMask.Rect.Dx()
+	}
+	pad := scale * 2
+	g.fillRect(img, image.Rect(x0-pad, y0-pad, x0+textW*scale+pad, y0+face.Height*scale+pad), color.RGBA{A: 255})
+
+	for ty := 0; ty < face.Height; ty++ {
+		for tx := 0; tx < textW; tx++ {
+			if g.textMask.AlphaAt(tx, ty).A < 128 {
+				continue
+			}
+			for sy := 0; sy < scale; sy++ {
+				py := y0 + ty*scale + sy
+				if py < 0 || py >= g.spec.height {
+					continue
+				}
+				for sx := 0; sx < scale; sx++ {
+					px := x0 + tx*scale + sx
+					if px >= 0 && px < g.spec.width {
+						img.Y[py*img.YStride+px] = 235
+					}
+				}
+			}
+		}
+	}
+}
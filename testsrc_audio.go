@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/driver"
+	"github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/prop"
+	"github.com/pion/mediadevices/pkg/wave"
+)
+
+// Fuentes de audio sintéticas para "-a":
+//
+//	tone:<hz>                 Tono senoidal continuo.
+//	sweep:<desde>-<hasta>[@s] Barrido logarítmico que se repite cada s segundos (10 por defecto).
+//	pink-noise                Ruido rosa.
+//	white-noise               Ruido blanco.
+//	beep[:<hz>]               Pitido al comienzo de cada segundo, alineado con el
+//	                          contador de fotogramas de testsrc (ver testSourceBeepDuration).
+//
+// Igual que el video de prueba, se registran como drivers de mediadevices y
+// pasan por el encoder Opus normal.
+const (
+	testAudioSampleRate    = 48000
+	testAudioLatency       = 20 * time.Millisecond
+	testAudioAmplitude     = 0.25 // -12 dBFS
+	testSourceBeepDuration = 100 * time.Millisecond
+	testAudioDefaultBeepHz = 1000
+	testAudioDefaultSweepS = 10
+)
+
+type testAudioKind string
+
+const (
+	testAudioTone       testAudioKind = "tone"
+	testAudioSweep      testAudioKind = "sweep"
+	testAudioPinkNoise  testAudioKind = "pink-noise"
+	testAudioWhiteNoise testAudioKind = "white-noise"
+	testAudioBeep       testAudioKind = "beep"
+)
+
+type testAudioSpec struct {
+	kind       testAudioKind
+	frequency  float64 // tone y beep
+	sweepFrom  float64
+	sweepTo    float64
+	sweepCycle time.Duration
+}
+
+func isTestAudioSourceIdentifier(identifier string) bool {
+	kind := testAudioKind(strings.SplitN(identifier, ":", 2)[0])
+	switch kind {
+	case testAudioTone, testAudioSweep, testAudioPinkNoise, testAudioWhiteNoise, testAudioBeep:
+		return true
+	}
+	return false
+}
+
+func parseTestAudioSpec(identifier string) (testAudioSpec, error) {
+	parts := strings.SplitN(identifier, ":", 2)
+	spec := testAudioSpec{kind: testAudioKind(parts[0])}
+	arg := ""
+	if len(parts) == 2 {
+		arg = parts[1]
+	}
+
+	parseHz := func(s string) (float64, error) {
+		hz, err := strconv.ParseFloat(s, 64)
+		if err != nil || hz <= 0 || hz >= testAudioSampleRate/2 {
+			return 0, fmt.Errorf("frecuencia inválida '%s' (0 < hz < %d)", s, testAudioSampleRate/2)
+		}
+		return hz, nil
+	}
+
+	var err error
+	switch spec.kind {
+	case testAudioTone:
+		if arg == "" {
+			return spec, fmt.Errorf("falta la frecuencia: tone:<hz>")
+		}
+		spec.frequency, err = parseHz(arg)
+	case testAudioBeep:
+		spec.frequency = testAudioDefaultBeepHz
+		if arg != "" {
+			spec.frequency, err = parseHz(arg)
+		}
+	case testAudioSweep:
+		spec.sweepCycle = testAudioDefaultSweepS * time.Second
+		if at := strings.Index(arg, "@"); at >= 0 {
+			seconds, errCycle := strconv.ParseFloat(arg[at+1:], 64)
+			if errCycle != nil || seconds <= 0 {
+				return spec, fmt.Errorf("duración de barrido inválida en '%s'", identifier)
+			}
+			spec.sweepCycle = time.Duration(seconds * float64(time.Second))
+			arg = arg[:at]
+		}
+		bounds := strings.SplitN(arg, "-", 2)
+		if len(bounds) != 2 {
+			return spec, fmt.Errorf("formato de barrido inválido '%s': sweep:<desde>-<hasta>[@segundos]", identifier)
+		}
+		if spec.sweepFrom, err = parseHz(bounds[0]); err == nil {
+			spec.sweepTo, err = parseHz(bounds[1])
+		}
+	case testAudioPinkNoise, testAudioWhiteNoise:
+		if arg != "" {
+			return spec, fmt.Errorf("'%s' no admite parámetros", spec.kind)
+		}
+	default:
+		return spec, fmt.Errorf("fuente de audio de prueba desconocida '%s'", parts[0])
+	}
+	return spec, err
+}
+
+// registerTestAudioSource registra el generador como micrófono de
+// mediadevices con el identificador como Label.
+func registerTestAudioSource(identifier string) error {
+	spec, err := parseTestAudioSpec(identifier)
+	if err != nil {
+		return err
+	}
+	if err := driver.GetManager().Register(&testAudioSource{spec: spec}, driver.Info{
+		Label:      identifier,
+		DeviceType: driver.Microphone,
+		Priority:   driver.PriorityLow,
+	}); err != nil {
+		return err
+	}
+	log.Printf("Fuente de audio de prueba registrada: '%s'", identifier)
+	return nil
+}
+
+// testAudioSource implementa driver.Adapter y driver.AudioRecorder.
+type testAudioSource struct {
+	spec   testAudioSpec
+	mutex  sync.Mutex
+	closed chan struct{}
+}
+
+func (s *testAudioSource) Open() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = make(chan struct{})
+	return nil
+}
+
+func (s *testAudioSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed != nil {
+		close(s.closed)
+		s.closed = nil
+	}
+	return nil
+}
+
+func (s *testAudioSource) Properties() []prop.Media {
+	var props []prop.Media
+	for _, channels := range []int{1, 2} {
+		props = append(props, prop.Media{
+			Audio: prop.Audio{
+				SampleRate:   testAudioSampleRate,
+				Latency:      testAudioLatency,
+				ChannelCount: channels,
+			},
+		})
+	}
+	return props
+}
+
+func (s *testAudioSource) AudioRecord(p prop.Media) (audio.Reader, error) {
+	s.mutex.Lock()
+	closed := s.closed
+	s.mutex.Unlock()
+
+	if p.SampleRate == 0 {
+		p.SampleRate = testAudioSampleRate
+	}
+	if p.Latency == 0 {
+		p.Latency = testAudioLatency
+	}
+	if p.ChannelCount == 0 {
+		p.ChannelCount = 1
+	}
+	chunkLen := int(int64(p.SampleRate) * int64(p.Latency) / int64(time.Second))
+
+	g := &testAudioGenerator{spec: s.spec, sampleRate: float64(p.SampleRate), random: rand.New(rand.NewSource(1))}
+	// La posición absoluta en muestras se mide desde testSourceEpoch para que
+	// los pitidos coincidan con el contador de fotogramas del video de prueba.
+	start := time.Now()
+	g.position = int64(start.Sub(testSourceEpoch)) * int64(p.SampleRate) / int64(time.Second)
+	nextRead := start
+
+	return audio.ReaderFunc(func() (wave.Audio, func(), error) {
+		select {
+		case <-closed:
+			return nil, func() {}, io.EOF
+		default:
+		}
+		time.Sleep(time.Until(nextRead))
+		nextRead = nextRead.Add(p.Latency)
+
+		chunk := wave.NewFloat32Interleaved(wave.ChunkInfo{
+			Channels:     p.ChannelCount,
+			Len:          chunkLen,
+			SamplingRate: p.SampleRate,
+		})
+		for i := 0; i < chunkLen; i++ {
+			v := wave.Float32Sample(g.next())
+			for ch := 0; ch < p.ChannelCount; ch++ {
+				chunk.SetFloat32(i, ch, v)
+			}
+		}
+		return chunk, func() {}, nil
+	}), nil
+}
+
+// testAudioGenerator produce muestra a muestra la señal configurada.
+type testAudioGenerator struct {
+	spec       testAudioSpec
+	sampleRate float64
+	position   int64   // Muestras transcurridas desde testSourceEpoch
+	phase      float64 // Fase acumulada en ciclos, para barridos sin discontinuidades
+	random     *rand.Rand
+	pink       [7]float64
+}
+
+func (g *testAudioGenerator) next() float32 {
+	var v float64
+	switch g.spec.kind {
+	case testAudioTone:
+		v = g.oscillator(g.spec.frequency)
+	case testAudioBeep:
+		second := int64(g.sampleRate)
+		beepLen := int64(testSourceBeepDuration.Seconds() * g.sampleRate)
+		if g.position%second < beepLen {
+			v = g.oscillator(g.spec.frequency)
+		} else {
+			g.phase = 0
+		}
+	case testAudioSweep:
+		cycle := int64(g.spec.sweepCycle.Seconds() * g.sampleRate)
+		t := float64(g.position%cycle) / float64(cycle)
+		v = g.oscillator(g.spec.sweepFrom * math.Pow(g.spec.sweepTo/g.spec.sweepFrom, t))
+	case testAudioWhiteNoise:
+		v = g.random.Float64()*2 - 1
+	case testAudioPinkNoise:
+		v = g.pinkNoise()
+	}
+	g.position++
+	return float32(v * testAudioAmplitude)
+}
+
+func (g *testAudioGenerator) oscillator(frequency float64) float64 {
+	v := math.Sin(2 * math.Pi * g.phase)
+	g.phase += frequency / g.sampleRate
+	if g.phase >= 1 {
+		g.phase -= math.Floor(g.phase)
+	}
+	return v
+}
+
+// pinkNoise filtra ruido blanco con el filtro "refinado" de Paul Kellet
+// (pendiente de -3 dB/octava con error < 0.05 dB por encima de 9 Hz).
+func (g *testAudioGenerator) pinkNoise() float64 {
+	white := g.random.Float64()*2 - 1
+	b := &g.pink
+	b[0] = 0.99886*b[0] + white*0.0555179
+	b[1] = 0.99332*b[1] + white*0.0750759
+	b[2] = 0.96900*b[2] + white*0.1538520
+	b[3] = 0.86650*b[3] + white*0.3104856
+	b[4] = 0.55000*b[4] + white*0.5329522
+	b[5] = -0.7616*b[5] - white*0.0168980
+	pink := b[0] + b[1] + b[2] + b[3] + b[4] + b[5] + b[6] + white*0.5362
+	b[6] = white * 0.115926
+	return pink * 0.11 // Normaliza aproximadamente a [-1, 1]
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// TURNServer es un servidor TURN embebido (pion/turn) para espectadores detrás
+// de NAT o firewalls restrictivos. No tiene usuarios fijos: el Server genera
+// unas credenciales por sesión al conectar el cliente y las revoca al irse.
+type TURNServer struct {
+	server *turn.Server
+	realm  string
+	urls   []string
+	ttl    time.Duration
+
+	mutex       sync.Mutex
+	credentials map[string]turnCredential // Por nombre de usuario
+}
+
+type turnCredential struct {
+	key     []byte
+	expires time.Time
+}
+
+// NewTURNServer escucha en listenAddr (UDP y TCP en el mismo puerto) y
+// anuncia publicIP como dirección de los relays. Si publicIP está vacío se
+// usa la primera IPv4 no loopback del equipo. Salvo con allowPrivatePeers, los
+// relays solo pueden ir a direcciones públicas: cualquiera que cargue la página
+// recibe credenciales y no debe poder alcanzar la red interna del servidor.
+func NewTURNServer(listenAddr, realm, publicIP string, ttl time.Duration, allowPrivatePeers bool) (*TURNServer, error) {
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("TURNServer: dirección inválida '%s': %w", listenAddr, err)
+	}
+	relayIP, err := turnRelayIP(publicIP)
+	if err != nil {
+		return nil, fmt.Errorf("TURNServer: %w", err)
+	}
+
+	udpConn, err := net.ListenPacket("udp4", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("TURNServer: fallo al escuchar UDP en %s: %w", listenAddr, err)
+	}
+	tcpListener, err := net.Listen("tcp4", listenAddr)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("TURNServer: fallo al escuchar TCP en %s: %w", listenAddr, err)
+	}
+
+	s := &TURNServer{
+		realm:       realm,
+		ttl:         ttl,
+		credentials: make(map[string]turnCredential),
+	}
+	host := net.JoinHostPort(relayIP.String(), port)
+	s.urls = []string{"turn:" + host, "turn:" + host + "?transport=tcp"}
+
+	relayGenerator := &turn.RelayAddressGeneratorStatic{RelayAddress: relayIP, Address: "0.0.0.0"}
+	permissions := turnPublicPeerOnly
+	if allowPrivatePeers {
+		permissions = turn.DefaultPermissionHandler
+	}
+	s.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:       realm,
+		AuthHandler: s.authenticate,
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udpConn,
+			RelayAddressGenerator: relayGenerator,
+			PermissionHandler:     permissions,
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcpListener,
+			RelayAddressGenerator: relayGenerator,
+			PermissionHandler:     permissions,
+		}},
+	})
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return nil, fmt.Errorf("TURNServer: fallo al iniciar: %w", err)
+	}
+	log.Printf("TURNServer: Escuchando en %s (UDP/TCP), realm '%s', relays en %s.", listenAddr, realm, relayIP)
+	return s, nil
+}
+
+// turnRelayIP devuelve la IP que se anunciará en los candidatos relay.
+func turnRelayIP(publicIP string) (net.IP, error) {
+	if publicIP != "" {
+		ip := net.ParseIP(publicIP)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("IP pública inválida '%s' (se espera IPv4)", publicIP)
+		}
+		return ip, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, errors.New("no se encontró una IPv4 local; usa -turn-public-ip")
+}
+
+// turnPublicPeerOnly rechaza los relays hacia direcciones loopback, privadas,
+// link-local o sin especificar.
+func turnPublicPeerOnly(clientAddr net.Addr, peerIP net.IP) bool {
+	if peerIP.IsLoopback() || peerIP.IsPrivate() || peerIP.IsUnspecified() ||
+		peerIP.IsLinkLocalUnicast() || peerIP.IsLinkLocalMulticast() || peerIP.IsInterfaceLocalMulticast() {
+		log.Printf("TURNServer: Relay a %s denegado para %s (dirección no pública; ver -turn-allow-private-peers).", peerIP, clientAddr)
+		return false
+	}
+	return true
+}
+
+func (s *TURNServer) authenticate(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	credential, ok := s.credentials[username]
+	if !ok || realm != s.realm {
+		log.Printf("TURNServer: Usuario desconocido '%s' desde %s.", username, srcAddr)
+		return nil, false
+	}
+	if time.Now().After(credential.expires) {
+		delete(s.credentials, username)
+		log.Printf("TURNServer: Credenciales caducadas para '%s' desde %s.", username, srcAddr)
+		return nil, false
+	}
+	return credential.key, true
+}
+
+// MintCredentials crea unas credenciales válidas durante el TTL configurado
+// para la sesión indicada y devuelve el ICEServer que debe usar el cliente.
+func (s *TURNServer) MintCredentials(sessionID string) webrtc.ICEServer {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+	password := hex.EncodeToString(secret)
+	username := strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10) + ":" + sessionID
+
+	now := time.Now()
+	s.mutex.Lock()
+	// Las credenciales de sesiones que nunca llegaron a revocarse (o que se
+	// usaron tras caducar) se purgan aquí para que el mapa no crezca sin fin.
+	for name, credential := range s.credentials {
+		if now.After(credential.expires) {
+			delete(s.credentials, name)
+		}
+	}
+	s.credentials[username] = turnCredential{
+		key:     turn.GenerateAuthKey(username, s.realm, password),
+		expires: now.Add(s.ttl),
+	}
+	s.mutex.Unlock()
+	return webrtc.ICEServer{URLs: s.urls, Username: username, Credential: password}
+}
+
+// RevokeCredentials invalida las credenciales de la sesión; las asignaciones
+// ya creadas dejan de poder renovarse.
+func (s *TURNServer) RevokeCredentials(sessionID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	suffix := ":" + sessionID
+	for username := range s.credentials {
+		if strings.HasSuffix(username, suffix) {
+			delete(s.credentials, username)
+		}
+	}
+}
+
+func (s *TURNServer) Close() error {
+	log.Println("TURNServer: Cerrando...")
+	return s.server.Close()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/mediadevices/pkg/codec/openh264"
+	"github.com/pion/mediadevices/pkg/codec/vpx"
+	"github.com/pion/sdp/v3"
+)
+
+// Codecs del video capturado (-video-codec): todos se registran en el
+// CodecSelector y en el MediaEngine, y cada espectador recibe el primero de la
+// lista de preferencia que aparezca en su oferta. El encoder de cada codec se
+// arranca la primera vez que un espectador lo necesita, de modo que pueden
+// convivir, por ejemplo, clientes que solo aceptan H.264 con otros que solo
+// aceptan VP8.
+
+// videoCodecOption es un codec con el que se puede codificar el video capturado.
+type videoCodecOption struct {
+	name             string // Como en -video-codec
+	rtpCodec         *codec.RTPCodec
+	keyFrameInterval int // Frames entre keyframes (-keyframe-interval)
+	newParams        func(bitrate, keyFrameInterval int) codec.VideoEncoderBuilder
+}
+
+// params devuelve los parámetros del encoder para el bitrate indicado.
+func (o videoCodecOption) params(bitrate int) codec.VideoEncoderBuilder {
+	return o.newParams(bitrate, o.keyFrameInterval)
+}
+
+// parseVideoCodecs interpreta una lista de preferencia como "h264,vp8". Los
+// encoders generan un keyframe cada keyFrameInterval frames.
+func parseVideoCodecs(list string, keyFrameInterval int) ([]videoCodecOption, error) {
+	var options []videoCodecOption
+	seen := make(map[string]bool)
+	for _, name := range splitList(strings.ToLower(list)) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		option, err := newVideoCodecOption(name)
+		if err != nil {
+			return nil, err
+		}
+		option.keyFrameInterval = keyFrameInterval
+		options = append(options, option)
+	}
+	if len(options) == 0 {
+		return nil, errors.New("-video-codec vacío")
+	}
+	return options, nil
+}
+
+func newVideoCodecOption(name string) (videoCodecOption, error) {
+	switch name {
+	case "vp8":
+		params, err := vpx.NewVP8Params()
+		if err != nil {
+			return videoCodecOption{}, fmt.Errorf("fallo al crear params VP8: %w", err)
+		}
+		return videoCodecOption{name: name, rtpCodec: params.RTPCodec(), newParams: func(bitrate, keyFrameInterval int) codec.VideoEncoderBuilder {
+			p := params
+			p.BitRate, p.KeyFrameInterval = bitrate, keyFrameInterval
+			return &p
+		}}, nil
+	case "vp9":
+		params, err := vpx.NewVP9Params()
+		if err != nil {
+			return videoCodecOption{}, fmt.Errorf("fallo al crear params VP9: %w", err)
+		}
+		return videoCodecOption{name: name, rtpCodec: params.RTPCodec(), newParams: func(bitrate, keyFrameInterval int) codec.VideoEncoderBuilder {
+			p := params
+			p.BitRate, p.KeyFrameInterval = bitrate, keyFrameInterval
+			return &p
+		}}, nil
+	case "h264":
+		params, err := openh264.NewParams()
+		if err != nil {
+			return videoCodecOption{}, fmt.Errorf("fallo al crear params H.264: %w", err)
+		}
+		return videoCodecOption{name: name, rtpCodec: params.RTPCodec(), newParams: func(bitrate, keyFrameInterval int) codec.VideoEncoderBuilder {
+			p := params
+			p.BitRate, p.KeyFrameInterval = bitrate, keyFrameInterval
+			p.IntraPeriod = uint(keyFrameInterval) // OpenH264 usa IntraPeriod
+			return &p
+		}}, nil
+	case "av1":
+		return videoCodecOption{}, errors.New("codec 'av1' no disponible: mediadevices no incluye encoder AV1 (sí se puede reenviar AV1 desde whip/rtp/sdp)")
+	}
+	return videoCodecOption{}, fmt.Errorf("codec de video desconocido '%s' (vp8, vp9, h264)", name)
+}
+
+// offeredVideoCodecs devuelve los MIME types de video que aparecen en una
+// oferta SDP, en su orden. Devuelve nil si la oferta no se puede interpretar.
+func offeredVideoCodecs(offer string) []string {
+	var description sdp.SessionDescription
+	if err := description.UnmarshalString(offer); err != nil {
+		return nil
+	}
+	var mimeTypes []string
+	seen := make(map[string]bool)
+	for _, media := range description.MediaDescriptions {
+		if media.MediaName.Media != "video" {
+			continue
+		}
+		for _, attribute := range media.Attributes {
+			if attribute.Key != "rtpmap" {
+				continue
+			}
+			// a=rtpmap:<pt> <nombre>/<reloj>
+			_, encoding, ok := strings.Cut(attribute.Value, " ")
+			name, _, _ := strings.Cut(encoding, "/")
+			if !ok || name == "" {
+				continue
+			}
+			mimeType := "video/" + name
+			if key := strings.ToLower(mimeType); !seen[key] {
+				seen[key] = true
+				mimeTypes = append(mimeTypes, mimeType)
+			}
+		}
+	}
+	return mimeTypes
+}
+
+// preferredVideoCodec devuelve la primera opción de la lista de preferencia
+// presente entre los MIME types ofrecidos; sin oferta, la primera de la lista.
+func preferredVideoCodec(options []videoCodecOption, offered []string) (videoCodecOption, bool) {
+	if len(offered) == 0 && len(options) > 0 {
+		return options[0], true
+	}
+	for _, option := range options {
+		for _, mimeType := range offered {
+			if strings.EqualFold(mimeType, option.rtpCodec.MimeType) {
+				return option, true
+			}
+		}
+	}
+	return videoCodecOption{}, false
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// Escritura de ficheros WebM (Matroska) para el grabador. El Segment y cada
+// Cluster se escriben con tamaño desconocido, así que un fichero cortado (p.ej.
+// si el proceso muere) sigue siendo reproducible; al cerrar se completan los
+// tamaños, la duración, los Cues (un punto por keyframe de video) y el
+// SeekHead que los localiza.
+
+// IDs de elementos EBML/Matroska.
+const (
+	ebmlIDHeader             = 0x1A45DFA3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42F7
+	ebmlIDMaxIDLength        = 0x42F2
+	ebmlIDMaxSizeLength      = 0x42F3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+	ebmlIDVoid               = 0xEC
+
+	mkvIDSegment            = 0x18538067
+	mkvIDSeekHead           = 0x114D9B74
+	mkvIDSeek               = 0x4DBB
+	mkvIDSeekID             = 0x53AB
+	mkvIDSeekPosition       = 0x53AC
+	mkvIDInfo               = 0x1549A966
+	mkvIDTimecodeScale      = 0x2AD7B1
+	mkvIDMuxingApp          = 0x4D80
+	mkvIDWritingApp         = 0x5741
+	mkvIDDuration           = 0x4489
+	mkvIDDateUTC            = 0x4461
+	mkvIDTracks             = 0x1654AE6B
+	mkvIDTrackEntry         = 0xAE
+	mkvIDTrackNumber        = 0xD7
+	mkvIDTrackUID           = 0x73C5
+	mkvIDTrackType          = 0x83
+	mkvIDFlagLacing         = 0x9C
+	mkvIDCodecID            = 0x86
+	mkvIDCodecPrivate       = 0x63A2
+	mkvIDSeekPreRoll        = 0x56BB
+	mkvIDVideo              = 0xE0
+	mkvIDPixelWidth         = 0xB0
+	mkvIDPixelHeight        = 0xBA
+	mkvIDAudio              = 0xE1
+	mkvIDSamplingFrequency  = 0xB5
+	mkvIDChannels           = 0x9F
+	mkvIDCluster            = 0x1F43B675
+	mkvIDTimecode           = 0xE7
+	mkvIDSimpleBlock        = 0xA3
+	mkvIDCues               = 0x1C53BB6B
+	mkvIDCuePoint           = 0xBB
+	mkvIDCueTime            = 0xB3
+	mkvIDCueTrackPositions  = 0xB7
+	mkvIDCueTrack           = 0xF7
+	mkvIDCueClusterPosition = 0xF1
+)
+
+const (
+	webmSeekHeadSpace   = 96                 // Bytes reservados al principio para el SeekHead
+	webmUnknownSize     = 0x00FFFFFFFFFFFFFF // Tamaño desconocido (vint de 8 bytes)
+	webmClusterMax      = 5 * time.Second    // Duración máxima de un Cluster
+	webmOpusSeekPreRoll = 80 * time.Millisecond
+)
+
+// Tipos de pista Matroska.
+const (
+	webmTrackVideo = 1
+	webmTrackAudio = 2
+)
+
+// webmTrack describe una pista del fichero.
+type webmTrack struct {
+	number       uint64
+	trackType    uint64 // webmTrackVideo o webmTrackAudio
+	codecID      string // V_VP8, V_VP9, A_OPUS
+	codecPrivate []byte
+	width        int // Video
+	height       int
+	sampleRate   float64 // Audio
+	channels     int
+}
+
+// webmCue es un punto de acceso aleatorio (Cluster que empieza en keyframe).
+type webmCue struct {
+	timecode int64 // ms
+	track    uint64
+	position int64 // Desde el inicio de los datos del Segment
+}
+
+// webmWriter escribe un fichero WebM. Los timecodes son milisegundos desde el
+// inicio del fichero y deben crecer dentro de cada pista.
+type webmWriter struct {
+	file   *os.File
+	buffer *bufio.Writer
+	offset int64 // Bytes escritos (posición en el fichero)
+
+	segmentData int64 // Inicio de los datos del Segment
+	infoPos     int64
+	tracksPos   int64
+	durationPos int64 // Posición del float de Duration
+	videoTrack  uint64
+
+	clusterOpen     bool
+	clusterStart    int64 // Posición del ID del Cluster
+	clusterTimecode int64
+	lastTimecode    int64
+	cues            []webmCue
+}
+
+// newWebMWriter crea el fichero y escribe la cabecera con las pistas indicadas.
+func newWebMWriter(path string, tracks []webmTrack, start time.Time) (*webmWriter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &webmWriter{file: file, buffer: bufio.NewWriterSize(file, 256*1024)}
+
+	w.write(ebmlElement(ebmlIDHeader,
+		ebmlUint(ebmlIDVersion, 1),
+		ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4),
+		ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlString(ebmlIDDocType, "webm"),
+		ebmlUint(ebmlIDDocTypeVersion, 4),
+		ebmlUint(ebmlIDDocTypeReadVersion, 2),
+	))
+	w.write(ebmlID(mkvIDSegment), ebmlSizeFixed(webmUnknownSize))
+	w.segmentData = w.offset
+	w.write(ebmlVoid(webmSeekHeadSpace))
+
+	// DateUTC: nanosegundos desde 2001-01-01.
+	millennium := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	info := ebmlElement(mkvIDInfo,
+		ebmlUint(mkvIDTimecodeScale, uint64(time.Millisecond)),
+		ebmlString(mkvIDMuxingApp, "webrtc-streamer"),
+		ebmlString(mkvIDWritingApp, "webrtc-streamer"),
+		ebmlFixedUint(mkvIDDateUTC, uint64(start.Sub(millennium))),
+		ebmlFloat(mkvIDDuration, 0),
+	)
+	w.infoPos = w.offset
+	w.durationPos = w.offset + int64(len(info)) - 8
+	w.write(info)
+
+	var entries [][]byte
+	for _, track := range tracks {
+		entry := [][]byte{
+			ebmlUint(mkvIDTrackNumber, track.number),
+			ebmlUint(mkvIDTrackUID, track.number),
+			ebmlUint(mkvIDTrackType, track.trackType),
+			ebmlUint(mkvIDFlagLacing, 0),
+			ebmlString(mkvIDCodecID, track.codecID),
+		}
+		if len(track.codecPrivate) > 0 {
+			entry = append(entry, ebmlElement(mkvIDCodecPrivate, track.codecPrivate))
+		}
+		if track.trackType == webmTrackVideo {
+			w.videoTrack = track.number
+			entry = append(entry, ebmlElement(mkvIDVideo,
+				ebmlUint(mkvIDPixelWidth, uint64(track.width)),
+				ebmlUint(mkvIDPixelHeight, uint64(track.height)),
+			))
+		} else {
+			entry = append(entry,
+				ebmlUint(mkvIDSeekPreRoll, uint64(webmOpusSeekPreRoll)),
+				ebmlElement(mkvIDAudio,
+					ebmlFloat(mkvIDSamplingFrequency, track.sampleRate),
+					ebmlUint(mkvIDChannels, uint64(track.channels)),
+				))
+		}
+		entries = append(entries, ebmlElement(mkvIDTrackEntry, entry...))
+	}
+	w.tracksPos = w.offset
+	w.write(ebmlElement(mkvIDTracks, entries...))
+
+	if err := w.buffer.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// WriteFrame añade un frame de la pista indicada. Se empieza un Cluster nuevo
+// en cada keyframe de video, si el actual dura más de webmClusterMax o si el
+// timecode no cabe en el desplazamiento de 16 bits del bloque.
+func (w *webmWriter) WriteFrame(track uint64, timecode int64, keyFrame bool, data []byte) error {
+	videoKeyFrame := keyFrame && track == w.videoTrack
+	relative := timecode - w.clusterTimecode
+	if !w.clusterOpen || videoKeyFrame || relative >= int64(webmClusterMax/time.Millisecond) || relative < math.MinInt16 {
+		if err := w.closeCluster(); err != nil {
+			return err
+		}
+		w.clusterOpen, w.clusterStart, w.clusterTimecode, relative = true, w.offset, timecode, 0
+		if videoKeyFrame {
+			w.cues = append(w.cues, webmCue{timecode: timecode, track: track, position: w.clusterStart - w.segmentData})
+		}
+		w.write(ebmlID(mkvIDCluster), ebmlSizeFixed(webmUnknownSize), ebmlUint(mkvIDTimecode, uint64(max(timecode, 0))))
+	}
+
+	flags := byte(0)
+	if keyFrame {
+		flags = 0x80
+	}
+	header := []byte{0x80 | byte(track), 0, 0, flags}
+	binary.BigEndian.PutUint16(header[1:3], uint16(int16(relative)))
+	w.write(ebmlID(mkvIDSimpleBlock), ebmlSize(uint64(len(header)+len(data))), header, data)
+	w.lastTimecode = max(w.lastTimecode, timecode)
+	return nil
+}
+
+// Size devuelve los bytes escritos hasta ahora.
+func (w *webmWriter) Size() int64 { return w.offset }
+
+// Duration devuelve el timecode más alto escrito.
+func (w *webmWriter) Duration() time.Duration {
+	return time.Duration(w.lastTimecode) * time.Millisecond
+}
+
+// Close termina el Cluster en curso, escribe los Cues y completa la cabecera.
+func (w *webmWriter) Close() error {
+	err := w.finalize()
+	if errClose := w.file.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+func (w *webmWriter) finalize() error {
+	if err := w.closeCluster(); err != nil {
+		return err
+	}
+	seeks := [][]byte{webmSeek(mkvIDInfo, w.infoPos-w.segmentData), webmSeek(mkvIDTracks, w.tracksPos-w.segmentData)}
+	if len(w.cues) > 0 {
+		seeks = append(seeks, webmSeek(mkvIDCues, w.offset-w.segmentData))
+		points := make([][]byte, len(w.cues))
+		for i, cue := range w.cues {
+			points[i] = ebmlElement(mkvIDCuePoint,
+				ebmlUint(mkvIDCueTime, uint64(cue.timecode)),
+				ebmlElement(mkvIDCueTrackPositions,
+					ebmlUint(mkvIDCueTrack, cue.track),
+					ebmlUint(mkvIDCueClusterPosition, uint64(cue.position)),
+				))
+		}
+		w.write(ebmlElement(mkvIDCues, points...))
+	}
+	if err := w.buffer.Flush(); err != nil {
+		return err
+	}
+
+	seekHead := ebmlElement(mkvIDSeekHead, seeks...)
+	seekHead = append(seekHead, ebmlVoid(webmSeekHeadSpace-len(seekHead))...)
+	duration := make([]byte, 8)
+	binary.BigEndian.PutUint64(duration, math.Float64bits(float64(w.lastTimecode)))
+	patches := []struct {
+		at   int64
+		data []byte
+	}{
+		{w.segmentData, seekHead},
+		{w.durationPos, duration},
+		{w.segmentData - 8, ebmlSizeFixed(uint64(w.offset - w.segmentData))},
+	}
+	for _, patch := range patches {
+		if _, err := w.file.WriteAt(patch.data, patch.at); err != nil {
+			return fmt.Errorf("completando la cabecera: %w", err)
+		}
+	}
+	return nil
+}
+
+// closeCluster escribe el tamaño real del Cluster en curso.
+func (w *webmWriter) closeCluster() error {
+	if !w.clusterOpen {
+		return nil
+	}
+	w.clusterOpen = false
+	if err := w.buffer.Flush(); err != nil {
+		return err
+	}
+	sizePos := w.clusterStart + 4
+	_, err := w.file.WriteAt(ebmlSizeFixed(uint64(w.offset-sizePos-8)), sizePos)
+	return err
+}
+
+// write añade bytes al fichero. Los errores de escritura se guardan en el
+// bufio.Writer y se devuelven en el siguiente Flush.
+func (w *webmWriter) write(parts ...[]byte) {
+	for _, part := range parts {
+		n, _ := w.buffer.Write(part)
+		w.offset += int64(n)
+	}
+}
+
+func webmSeek(id uint32, position int64) []byte {
+	return ebmlElement(mkvIDSeek,
+		ebmlElement(mkvIDSeekID, ebmlID(id)),
+		ebmlFixedUint(mkvIDSeekPosition, uint64(position)),
+	)
+}
+
+// webmOpusHead construye el CodecPrivate de Opus (RFC 7845, sección 5.1).
+func webmOpusHead(channels int) []byte {
+	head := []byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, byte(channels), 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(head[12:16], 48000)
+	return head
+}
+
+// ebmlID codifica un ID de elemento (ya incluye su marcador de longitud).
+func ebmlID(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id)}
+}
+
+// ebmlSize codifica un tamaño como vint con la longitud mínima.
+func ebmlSize(size uint64) []byte {
+	length := 1
+	for length < 8 && size >= 1<<(7*length)-1 {
+		length++
+	}
+	data := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		data[i] = byte(size)
+		size >>= 8
+	}
+	data[0] |= 0x80 >> (length - 1)
+	return data
+}
+
+// ebmlSizeFixed codifica un tamaño como vint de 8 bytes, para poder
+// sobrescribirlo después.
+func ebmlSizeFixed(size uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, size)
+	data[0] = 0x01
+	return data
+}
+
+func ebmlElement(id uint32, payload ...[]byte) []byte {
+	size := 0
+	for _, part := range payload {
+		size += len(part)
+	}
+	data := append(ebmlID(id), ebmlSize(uint64(size))...)
+	for _, part := range payload {
+		data = append(data, part...)
+	}
+	return data
+}
+
+func ebmlUint(id uint32, value uint64) []byte {
+	length := 1
+	for length < 8 && value>>(8*length) != 0 {
+		length++
+	}
+	data := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		data[i] = byte(value)
+		value >>= 8
+	}
+	return ebmlElement(id, data)
+}
+
+func ebmlFixedUint(id uint32, value uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+	return ebmlElement(id, data)
+}
+
+func ebmlFloat(id uint32, value float64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, math.Float64bits(value))
+	return ebmlElement(id, data)
+}
+
+func ebmlString(id uint32, value string) []byte {
+	return ebmlElement(id, []byte(value))
+}
+
+// ebmlVoid devuelve un elemento Void que ocupa exactamente size bytes (>= 2).
+func ebmlVoid(size int) []byte {
+	data := make([]byte, size)
+	data[0] = ebmlIDVoid
+	copy(data[1:], ebmlSizeFixed(uint64(size-9)))
+	if size < 10 {
+		data[1] = 0x80 | byte(size-2)
+	}
+	return data
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// ebmlTestElement es un elemento leído de un fichero escrito en los tests.
+type ebmlTestElement struct {
+	id   uint32
+	data []byte
+}
+
+// readEBMLTest lee los elementos de un nivel. Falla si algún tamaño es
+// desconocido o se sale de los datos.
+func readEBMLTest(t *testing.T, data []byte) []ebmlTestElement {
+	t.Helper()
+	var elements []ebmlTestElement
+	for pos := 0; pos < len(data); {
+		idLength := readVintLength(data[pos])
+		if idLength > 4 || pos+idLength > len(data) {
+			t.Fatalf("ID EBML inválido en %d", pos)
+		}
+		var id uint32
+		for _, b := range data[pos : pos+idLength] {
+			id = id<<8 | uint32(b)
+		}
+		pos += idLength
+		sizeLength := readVintLength(data[pos])
+		if pos+sizeLength > len(data) {
+			t.Fatalf("tamaño EBML inválido en %d", pos)
+		}
+		size := uint64(data[pos] & (0xFF >> sizeLength))
+		for _, b := range data[pos+1 : pos+sizeLength] {
+			size = size<<8 | uint64(b)
+		}
+		pos += sizeLength
+		if size > uint64(len(data)-pos) {
+			t.Fatalf("elemento %X de %d bytes se sale de los datos (quedan %d)", id, size, len(data)-pos)
+		}
+		elements = append(elements, ebmlTestElement{id: id, data: data[pos : pos+int(size)]})
+		pos += int(size)
+	}
+	return elements
+}
+
+func readVintLength(first byte) int {
+	length := 1
+	for length <= 8 && first&(0x80>>(length-1)) == 0 {
+		length++
+	}
+	return length
+}
+
+func findEBMLTest(elements []ebmlTestElement, id uint32) []ebmlTestElement {
+	var found []ebmlTestElement
+	for _, e := range elements {
+		if e.id == id {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func ebmlTestUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func TestEBMLSize(t *testing.T) {
+	tests := []struct {
+		size uint64
+		want []byte
+	}{
+		{0, []byte{0x80}},
+		{126, []byte{0xFE}},
+		{127, []byte{0x40, 0x7F}}, // 0xFF está reservado (tamaño desconocido)
+		{16382, []byte{0x7F, 0xFE}},
+		{16383, []byte{0x20, 0x3F, 0xFF}},
+	}
+	for _, tt := range tests {
+		if got := ebmlSize(tt.size); !bytes.Equal(got, tt.want) {
+			t.Errorf("ebmlSize(%d) = % X, se esperaba % X", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestEBMLElements(t *testing.T) {
+	tests := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{"uint cero", ebmlUint(mkvIDTrackType, 0), []byte{0x83, 0x81, 0x00}},
+		{"uint de un byte", ebmlUint(mkvIDTrackNumber, 1), []byte{0xD7, 0x81, 0x01}},
+		{"uint con ID de 3 bytes", ebmlUint(mkvIDTimecodeScale, 1000000), []byte{0x2A, 0xD7, 0xB1, 0x83, 0x0F, 0x42, 0x40}},
+		{"uint fijo", ebmlFixedUint(mkvIDSeekPosition, 5), []byte{0x53, 0xAC, 0x88, 0, 0, 0, 0, 0, 0, 0, 0x05}},
+		{"string", ebmlString(mkvIDCodecID, "V_VP8"), []byte{0x86, 0x85, 'V', '_', 'V', 'P', '8'}},
+		{"ID de 4 bytes", ebmlElement(mkvIDCluster), []byte{0x1F, 0x43, 0xB6, 0x75, 0x80}},
+	}
+	for _, tt := range tests {
+		if !bytes.Equal(tt.got, tt.want) {
+			t.Errorf("%s: % X, se esperaba % X", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestEBMLVoid(t *testing.T) {
+	for _, size := range []int{2, 9, 10, 11, webmSeekHeadSpace} {
+		void := ebmlVoid(size)
+		if len(void) != size {
+			t.Errorf("ebmlVoid(%d) ocupa %d bytes", size, len(void))
+			continue
+		}
+		elements := readEBMLTest(t, void)
+		if len(elements) != 1 || elements[0].id != ebmlIDVoid {
+			t.Errorf("ebmlVoid(%d) no es un único Void: %+v", size, elements)
+		}
+	}
+}
+
+func TestWebMWriter(t *testing.T) {
+	type frame struct {
+		track    uint64
+		timecode int64
+		keyFrame bool
+	}
+	tests := []struct {
+		name     string
+		frames   []frame
+		clusters []int64 // Timecode de cada Cluster
+		cues     []int64
+		blocks   int
+		duration float64
+	}{
+		{
+			name: "un Cluster por keyframe de video",
+			frames: []frame{
+				{recorderTrackVideo, 0, true}, {recorderTrackAudio, 10, true}, {recorderTrackVideo, 33, false},
+				{recorderTrackVideo, 1000, true}, {recorderTrackAudio, 1010, true}, {recorderTrackVideo, 1033, false},
+			},
+			clusters: []int64{0, 1000},
+			cues:     []int64{0, 1000},
+			blocks:   6,
+			duration: 1033,
+		},
+		{
+			name: "el Cluster se parte al pasar de webmClusterMax",
+			frames: []frame{
+				{recorderTrackVideo, 0, true}, {recorderTrackVideo, 2500, false},
+				{recorderTrackVideo, 5000, false}, {recorderTrackVideo, 7500, false},
+			},
+			clusters: []int64{0, 5000},
+			cues:     []int64{0},
+			blocks:   4,
+			duration: 7500,
+		},
+		{
+			name:     "solo audio, sin Cues",
+			frames:   []frame{{recorderTrackAudio, 0, true}, {recorderTrackAudio, 20, true}},
+			clusters: []int64{0},
+			blocks:   2,
+			duration: 20,
+		},
+	}
+	tracks := []webmTrack{
+		{number: recorderTrackVideo, trackType: webmTrackVideo, codecID: "V_VP8", width: 640, height: 360},
+		{number: recorderTrackAudio, trackType: webmTrackAudio, codecID: "A_OPUS", codecPrivate: webmOpusHead(2), sampleRate: 48000, channels: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.webm")
+			w, err := newWebMWriter(path, tracks, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, f := range tt.frames {
+				if err := w.WriteFrame(f.track, f.timecode, f.keyFrame, []byte{byte(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			top := readEBMLTest(t, data)
+			if len(top) != 2 || top[0].id != ebmlIDHeader || top[1].id != mkvIDSegment {
+				t.Fatalf("se esperaba cabecera EBML y Segment: %+v", top)
+			}
+			segment := readEBMLTest(t, top[1].data)
+
+			info := findEBMLTest(segment, mkvIDInfo)
+			if len(info) != 1 {
+				t.Fatalf("%d Info", len(info))
+			}
+			durations := findEBMLTest(readEBMLTest(t, info[0].data), mkvIDDuration)
+			if len(durations) != 1 || math.Float64frombits(binary.BigEndian.Uint64(durations[0].data)) != tt.duration {
+				t.Errorf("Duration incorrecta: %+v, se esperaba %v", durations, tt.duration)
+			}
+			if tracks := findEBMLTest(segment, mkvIDTracks); len(tracks) != 1 || len(findEBMLTest(readEBMLTest(t, tracks[0].data), mkvIDTrackEntry)) != 2 {
+				t.Errorf("se esperaban 2 pistas")
+			}
+
+			var clusters []int64
+			blocks, frameIndex := 0, 0
+			for _, cluster := range findEBMLTest(segment, mkvIDCluster) {
+				children := readEBMLTest(t, cluster.data)
+				timecode := int64(ebmlTestUint(findEBMLTest(children, mkvIDTimecode)[0].data))
+				clusters = append(clusters, timecode)
+				for _, block := range findEBMLTest(children, mkvIDSimpleBlock) {
+					if frameIndex == len(tt.frames) {
+						t.Fatalf("más bloques que frames escritos")
+					}
+					f := tt.frames[frameIndex]
+					relative := int64(int16(binary.BigEndian.Uint16(block.data[1:3])))
+					if uint64(block.data[0]&0x7F) != f.track || timecode+relative != f.timecode || (block.data[3]&0x80 != 0) != f.keyFrame || block.data[4] != byte(frameIndex) {
+						t.Errorf("bloque %d incorrecto: % X (Cluster %d)", frameIndex, block.data, timecode)
+					}
+					blocks++
+					frameIndex++
+				}
+			}
+			if !slices.Equal(clusters, tt.clusters) || blocks != tt.blocks {
+				t.Errorf("Clusters %v con %d bloques, se esperaban %v con %d", clusters, blocks, tt.clusters, tt.blocks)
+			}
+
+			var cues []int64
+			for _, list := range findEBMLTest(segment, mkvIDCues) {
+				for _, point := range findEBMLTest(readEBMLTest(t, list.data), mkvIDCuePoint) {
+					cues = append(cues, int64(ebmlTestUint(findEBMLTest(readEBMLTest(t, point.data), mkvIDCueTime)[0].data)))
+				}
+			}
+			if !slices.Equal(cues, tt.cues) {
+				t.Errorf("Cues %v, se esperaban %v", cues, tt.cues)
+			}
+
+			// El SeekHead apunta a Info, Tracks y (si los hay) Cues.
+			seekHead := findEBMLTest(segment, mkvIDSeekHead)
+			if len(seekHead) != 1 {
+				t.Fatalf("%d SeekHead", len(seekHead))
+			}
+			wantSeeks := 2
+			if len(tt.cues) > 0 {
+				wantSeeks = 3
+			}
+			if seeks := findEBMLTest(readEBMLTest(t, seekHead[0].data), mkvIDSeek); len(seeks) != wantSeeks {
+				t.Errorf("%d entradas en el SeekHead, se esperaban %d", len(seeks), wantSeeks)
+			}
+		})
+	}
+}
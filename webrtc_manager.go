@@ -1,33 +1,371 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/pion/mediadevices" // Necesario para el tipo CodecSelector
+	"github.com/pion/ice/v4"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/stun/v3"
 	"github.com/pion/webrtc/v4"
 )
 
 type WebRTCManager struct {
-	api *webrtc.API
+	api    *webrtc.API
+	udpMux ice.UDPMux // Puerto UDP único compartido (opcional)
+	tcpMux ice.TCPMux // Puerto ICE-TCP compartido (opcional)
+
+	iceServerURLs     []string
+	turnUsername      string
+	turnCredential    string
+	turnSecret        string
+	turnCredentialTTL time.Duration
+
+	// El interceptor GCC entrega el estimador de cada PeerConnection durante
+	// api.NewPeerConnection; se recoge aquí con estimatorMutex tomado.
+	estimatorMutex   sync.Mutex
+	pendingEstimator cc.BandwidthEstimator
 }
 
-func NewWebRTCManager(codecSelector *mediadevices.CodecSelector) (*WebRTCManager, error) {
-	if codecSelector == nil {
-		return nil, errors.New("WebRTCManager: CodecSelector no puede ser nil para inicializar")
+func NewWebRTCManager(codecs []webrtc.RTPCodecParameters, cfg *Config) (*WebRTCManager, error) {
+	if len(codecs) == 0 {
+		return nil, errors.New("WebRTCManager: se necesita al menos un codec para inicializar")
 	}
 	mediaEngine := &webrtc.MediaEngine{}
-	codecSelector.Populate(mediaEngine) // Populate usa el valor, aunque codecSelector sea un puntero
+	for _, codec := range codecs {
+		kind := webrtc.RTPCodecTypeVideo
+		if strings.HasPrefix(strings.ToLower(codec.MimeType), "audio/") {
+			kind = webrtc.RTPCodecTypeAudio
+		}
+		if err := mediaEngine.RegisterCodec(codec, kind); err != nil {
+			return nil, fmt.Errorf("WebRTCManager: fallo al registrar codec %s: %w", codec.MimeType, err)
+		}
+	}
 	log.Println("WebRTCManager: MediaEngine populado con codecs.")
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
-	return &WebRTCManager{api: api}, nil
+
+	m := &WebRTCManager{
+		iceServerURLs:     cfg.ICEServerURLs,
+		turnUsername:      cfg.TURNUsername,
+		turnCredential:    cfg.TURNCredential,
+		turnSecret:        cfg.TURNSecret,
+		turnCredentialTTL: cfg.TURNCredentialTTL,
+	}
+	for _, url := range m.iceServerURLs {
+		uri, err := stun.ParseURI(url)
+		if err != nil {
+			return nil, fmt.Errorf("WebRTCManager: servidor ICE inválido '%s': %w", url, err)
+		}
+		if (uri.Scheme == stun.SchemeTypeTURN || uri.Scheme == stun.SchemeTypeTURNS) && m.turnSecret == "" && (m.turnUsername == "" || m.turnCredential == "") {
+			return nil, fmt.Errorf("WebRTCManager: '%s' necesita -turn-username y -turn-credential, o -turn-secret", url)
+		}
+	}
+	if len(m.iceServerURLs) == 0 {
+		log.Println("WebRTCManager: Sin servidores ICE, solo se usarán candidatos host.")
+	} else {
+		log.Printf("WebRTCManager: Servidores ICE: %v", m.iceServerURLs)
+	}
+
+	interceptorRegistry, err := m.newInterceptorRegistry(mediaEngine, codecs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	settingEngine, err := m.newSettingEngine(cfg)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	m.api = webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithInterceptorRegistry(interceptorRegistry),
+	)
+	return m, nil
+}
+
+// newInterceptorRegistry monta la cadena de interceptores y anuncia en el
+// MediaEngine el feedback RTCP correspondiente:
+//   - PLI/FIR siempre, para que los espectadores puedan pedir keyframes.
+//   - NACK: el responder guarda los últimos paquetes enviados a cada espectador
+//     y los retransmite (por RTX si se negocia); el generador los pide a los
+//     publicadores WHIP.
+//   - Sender/Receiver Reports RTCP.
+//   - TWCC: número de secuencia de transporte en los paquetes salientes (el
+//     espectador responde con feedback de congestión) y feedback a los publicadores.
+//   - GCC (con -adaptive-bitrate, -renditions o -svc): estimador de ancho de banda por
+//     PeerConnection a partir del feedback TWCC, más REMB para los clientes que
+//     solo envían REMB.
+//
+// Debe llamarse después de registrar los codecs.
+func (m *WebRTCManager) newInterceptorRegistry(mediaEngine *webrtc.MediaEngine, codecs []webrtc.RTPCodecParameters, cfg *Config) (*interceptor.Registry, error) {
+	registry := &interceptor.Registry{}
+	var enabled []string
+	bandwidthEstimation := cfg.AdaptiveBitrate || cfg.Renditions != "" || cfg.SVC
+
+	if cfg.AudioRED < 0 || cfg.AudioRED > redMaxDistance {
+		return nil, fmt.Errorf("WebRTCManager: -audio-red fuera de rango (0-%d): %d", redMaxDistance, cfg.AudioRED)
+	}
+	if cfg.VideoFEC < 0 || cfg.VideoFEC > flexFECMaxGroup {
+		return nil, fmt.Errorf("WebRTCManager: -video-fec fuera de rango (0-%d): %d", flexFECMaxGroup, cfg.VideoFEC)
+	}
+	// FlexFEC va el primero de la cadena, el más cercano a SRTP: protege los
+	// paquetes tal como salen, con las extensiones que añaden los demás
+	// interceptores, y sus paquetes no entran en el buffer NACK.
+	if cfg.VideoFEC > 0 {
+		registry.Add(&flexFECInterceptor{group: cfg.VideoFEC})
+		enabled = append(enabled, fmt.Sprintf("FlexFEC(1/%d)", cfg.VideoFEC))
+	}
+
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "ccm", Parameter: "fir"}, webrtc.RTPCodecTypeVideo)
+
+	if cfg.NACK {
+		if cfg.NACKBufferSize <= 0 || cfg.NACKBufferSize > 1<<15 {
+			return nil, fmt.Errorf("WebRTCManager: -nack-buffer fuera de rango: %d", cfg.NACKBufferSize)
+		}
+		responder, err := nack.NewResponderInterceptor(nack.ResponderSize(uint16(cfg.NACKBufferSize)))
+		if err != nil {
+			return nil, fmt.Errorf("WebRTCManager: NACK responder inválido (-nack-buffer debe ser potencia de 2): %w", err)
+		}
+		generator, err := nack.NewGeneratorInterceptor()
+		if err != nil {
+			return nil, fmt.Errorf("WebRTCManager: fallo al crear el generador NACK: %w", err)
+		}
+		mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+		registry.Add(responder)
+		registry.Add(generator)
+		enabled = append(enabled, fmt.Sprintf("NACK(%d paquetes)", cfg.NACKBufferSize))
+	}
+
+	if cfg.RTCPReports {
+		receiver, err := report.NewReceiverInterceptor(report.ReceiverInterval(cfg.RTCPReportInterval))
+		if err != nil {
+			return nil, fmt.Errorf("WebRTCManager: fallo al crear Receiver Reports: %w", err)
+		}
+		sender, err := report.NewSenderInterceptor(report.SenderInterval(cfg.RTCPReportInterval))
+		if err != nil {
+			return nil, fmt.Errorf("WebRTCManager: fallo al crear Sender Reports: %w", err)
+		}
+		registry.Add(receiver)
+		registry.Add(sender)
+		enabled = append(enabled, fmt.Sprintf("SR/RR(%v)", cfg.RTCPReportInterval))
+	}
+
+	if cfg.TWCC {
+		for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+			if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.TransportCCURI}, kind); err != nil {
+				return nil, fmt.Errorf("WebRTCManager: fallo al registrar la extensión TWCC: %w", err)
+			}
+			mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC}, kind)
+		}
+		// GCC va antes que la extensión TWCC para ver el número de secuencia de
+		// transporte de cada paquete. El ritmo de envío lo marcan los encoders,
+		// así que no se usa pacer.
+		if bandwidthEstimation {
+			// Con -renditions, los límites salen de la escalera en lugar de
+			// -min-bitrate y -max-bitrate.
+			minBitrate, maxBitrate := cfg.MinBitrate, cfg.MaxBitrate
+			if cfg.Renditions != "" {
+				renditions, err := parseRenditions(cfg.Renditions)
+				if err != nil {
+					return nil, fmt.Errorf("WebRTCManager: %w", err)
+				}
+				minBitrate, maxBitrate = renditionBitrateRange(renditions)
+			}
+			initialBitrate := min(max(cfg.VideoBitrate, minBitrate), maxBitrate)
+			congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+				return gcc.NewSendSideBWE(
+					gcc.SendSideBWEInitialBitrate(initialBitrate),
+					gcc.SendSideBWEMinBitrate(minBitrate),
+					gcc.SendSideBWEMaxBitrate(maxBitrate),
+					gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+				)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("WebRTCManager: fallo al crear el estimador GCC: %w", err)
+			}
+			congestionController.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+				m.pendingEstimator = estimator
+			})
+			registry.Add(congestionController)
+			enabled = append(enabled, fmt.Sprintf("GCC(%d-%d kbps)", minBitrate/1000, maxBitrate/1000))
+		}
+		headerExtension, err := twcc.NewHeaderExtensionInterceptor()
+		if err != nil {
+			return nil, fmt.Errorf("WebRTCManager: fallo al crear el interceptor TWCC: %w", err)
+		}
+		feedback, err := twcc.NewSenderInterceptor()
+		if err != nil {
+			return nil, fmt.Errorf("WebRTCManager: fallo al crear el feedback TWCC: %w", err)
+		}
+		registry.Add(headerExtension)
+		registry.Add(feedback)
+		enabled = append(enabled, "TWCC")
+	}
+
+	if bandwidthEstimation {
+		mediaEngine.RegisterFeedback(webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBGoogREMB}, webrtc.RTPCodecTypeVideo)
+		if !cfg.TWCC {
+			log.Println("WebRTCManager: Sin -twcc solo se usarán los REMB de los espectadores para estimar su ancho de banda.")
+		}
+	}
+
+	if cfg.AudioRED > 0 {
+		registry.Add(&redInterceptor{distance: cfg.AudioRED})
+		enabled = append(enabled, fmt.Sprintf("RED(%d)", cfg.AudioRED))
+	}
+
+	// Los codecs de redundancia y RTX se registran al final para que no
+	// hereden el feedback de los codecs de video.
+	used := make(map[webrtc.PayloadType]bool)
+	for _, codec := range codecs {
+		used[codec.PayloadType] = true
+	}
+	if err := registerRedundancyCodecs(mediaEngine, codecs, used, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.NACK && cfg.RTX {
+		for _, codec := range codecs {
+			if !strings.HasPrefix(strings.ToLower(codec.MimeType), "video/") {
+				continue
+			}
+			rtxPayloadType := codec.PayloadType + 1
+			if used[rtxPayloadType] {
+				log.Printf("WebRTCManager: Sin RTX para %s (payload type %d ocupado).", codec.MimeType, rtxPayloadType)
+				continue
+			}
+			used[rtxPayloadType] = true
+			rtx := webrtc.RTPCodecParameters{
+				RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeRTX, ClockRate: codec.ClockRate, SDPFmtpLine: fmt.Sprintf("apt=%d", codec.PayloadType)},
+				PayloadType:        rtxPayloadType,
+			}
+			if err := mediaEngine.RegisterCodec(rtx, webrtc.RTPCodecTypeVideo); err != nil {
+				return nil, fmt.Errorf("WebRTCManager: fallo al registrar RTX para %s: %w", codec.MimeType, err)
+			}
+		}
+		enabled = append(enabled, "RTX")
+	}
+
+	if len(enabled) == 0 {
+		log.Println("WebRTCManager: Sin interceptores (solo PLI/FIR).")
+	} else {
+		log.Printf("WebRTCManager: Interceptores: %s.", strings.Join(enabled, ", "))
+	}
+	return registry, nil
+}
+
+// newSettingEngine configura la red de ICE: todos los PeerConnections por un
+// único puerto UDP (y opcionalmente uno TCP) en lugar de puertos efímeros, y
+// las IPs públicas a anunciar cuando el servidor está detrás de NAT 1:1.
+func (m *WebRTCManager) newSettingEngine(cfg *Config) (webrtc.SettingEngine, error) {
+	settingEngine := webrtc.SettingEngine{}
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+
+	if cfg.ICEUDPPort != 0 {
+		udpMux, err := ice.NewMultiUDPMuxFromPort(cfg.ICEUDPPort)
+		if err != nil {
+			return settingEngine, fmt.Errorf("WebRTCManager: fallo al abrir el puerto UDP %d: %w", cfg.ICEUDPPort, err)
+		}
+		m.udpMux = udpMux
+		settingEngine.SetICEUDPMux(udpMux)
+		log.Printf("WebRTCManager: Tráfico ICE/media multiplexado en el puerto UDP %d.", cfg.ICEUDPPort)
+	}
+	if cfg.ICETCPPort != 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: cfg.ICETCPPort})
+		if err != nil {
+			return settingEngine, fmt.Errorf("WebRTCManager: fallo al abrir el puerto TCP %d: %w", cfg.ICETCPPort, err)
+		}
+		m.tcpMux = webrtc.NewICETCPMux(nil, listener, 8)
+		settingEngine.SetICETCPMux(m.tcpMux)
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+		log.Printf("WebRTCManager: ICE-TCP habilitado en el puerto %d.", cfg.ICETCPPort)
+	}
+	settingEngine.SetNetworkTypes(networkTypes)
+
+	if len(cfg.NAT1To1IPs) > 0 {
+		settingEngine.SetNAT1To1IPs(cfg.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+		log.Printf("WebRTCManager: Candidatos host anunciados con IPs públicas %v.", cfg.NAT1To1IPs)
+	}
+	return settingEngine, nil
+}
+
+// Close libera los puertos compartidos de ICE.
+func (m *WebRTCManager) Close() {
+	if m.udpMux != nil {
+		m.udpMux.Close()
+	}
+	if m.tcpMux != nil {
+		m.tcpMux.Close()
+	}
+}
+
+// ICEServers devuelve los servidores STUN/TURN configurados. Con -turn-secret
+// genera en cada llamada credenciales temporales (REST API de TURN, compatible
+// con use-auth-secret de coturn): usuario "<expiración unix>[:<usuario>]" y
+// contraseña base64(HMAC-SHA1(secreto, usuario)).
+func (m *WebRTCManager) ICEServers() []webrtc.ICEServer {
+	var stunURLs, turnURLs []string
+	for _, url := range m.iceServerURLs {
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			turnURLs = append(turnURLs, url)
+		} else {
+			stunURLs = append(stunURLs, url)
+		}
+	}
+
+	servers := []webrtc.ICEServer{}
+	if len(stunURLs) > 0 {
+		servers = append(servers, webrtc.ICEServer{URLs: stunURLs})
+	}
+	if len(turnURLs) > 0 {
+		username, credential := m.turnUsername, m.turnCredential
+		if m.turnSecret != "" {
+			username = strconv.FormatInt(time.Now().Add(m.turnCredentialTTL).Unix(), 10)
+			if m.turnUsername != "" {
+				username += ":" + m.turnUsername
+			}
+			mac := hmac.New(sha1.New, []byte(m.turnSecret))
+			mac.Write([]byte(username))
+			credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		}
+		servers = append(servers, webrtc.ICEServer{URLs: turnURLs, Username: username, Credential: credential})
+	}
+	return servers
 }
 
 func (m *WebRTCManager) NewPeerConnection() (*webrtc.PeerConnection, error) {
+	pc, _, err := m.NewViewerPeerConnection()
+	return pc, err
+}
+
+// NewViewerPeerConnection crea un PeerConnection y devuelve también su
+// estimador de ancho de banda (nil sin -adaptive-bitrate/-renditions o sin -twcc).
+func (m *WebRTCManager) NewViewerPeerConnection() (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
 	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{URLs: []string{"stun:stun.l.google.com:19302"}},
-		},
+		ICEServers: m.ICEServers(),
+	}
+	m.estimatorMutex.Lock()
+	defer m.estimatorMutex.Unlock()
+	m.pendingEstimator = nil
+	pc, err := m.api.NewPeerConnection(config)
+	estimator := m.pendingEstimator
+	m.pendingEstimator = nil
+	if err != nil {
+		return nil, nil, err
 	}
-	return m.api.NewPeerConnection(config)
-}
\ No newline at end of file
+	return pc, estimator, nil
+}
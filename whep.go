@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pion/webrtc/v4"
+)
+
+// Reproducción WHEP (WebRTC-HTTP Egress Protocol): alternativa estándar a la
+// señalización por WebSocket para reproductores y herramientas que hablan WHEP.
+//
+//	POST   /whep       oferta SDP -> 201, respuesta SDP y Location: /whep/<id>
+//	PATCH  /whep/<id>  candidatos ICE del cliente (trickle, application/trickle-ice-sdpfrag)
+//	DELETE /whep/<id>  termina la sesión
+//
+// Cada sesión es un Client más del servidor, sin conexión WebSocket.
+const (
+	whepEndpointPath      = "/whep"
+	trickleICEContentType = "application/trickle-ice-sdpfrag"
+)
+
+// handleWHEP atiende POST /whep.
+func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpContentType) {
+		http.Error(w, "se esperaba Content-Type: application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, ok := readSDPBody(w, r, "la oferta")
+	if !ok {
+		return
+	}
+
+	clientID := uuid.NewString()
+	log.Printf("[%s] WHEP: Nueva oferta de %s.", clientID, r.RemoteAddr)
+
+	peerConnection, estimator, err := s.webRTCManager.NewViewerPeerConnection()
+	if err != nil {
+		log.Printf("[%s] Fallo al crear PeerConnection: %v", clientID, err)
+		http.Error(w, "error interno", http.StatusInternalServerError)
+		return
+	}
+	client := &Client{id: clientID, peerConnection: peerConnection}
+	s.addSharedTracks(client, estimator, string(offer))
+	// Las credenciales TURN se crean antes de registrar el cliente para que
+	// removeClient, que puede llegar en cualquier momento, siempre las revoque.
+	iceServers := s.iceServersFor(clientID)
+	s.addClient(client)
+
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("[%s] PeerConnection state: %s", clientID, state.String())
+		if state == webrtc.PeerConnectionStateConnected {
+			requestJoinKeyFrames(peerConnection)
+		}
+		// Disconnected es transitorio: si ICE no se recupera, pion pasa a Failed.
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.removeClient(clientID)
+		}
+	})
+
+	answer, err := answerOffer(peerConnection, string(offer), s.mediaManager.OpusFmtpLine())
+	if err != nil {
+		log.Printf("[%s] WHEP: %v", clientID, err)
+		s.removeClient(clientID)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	setICEServerLinks(w, iceServers)
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", whepEndpointPath+"/"+clientID)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+	log.Printf("[%s] WHEP: Respuesta SDP enviada.", clientID)
+}
+
+// handleWHEPPatch atiende PATCH /whep/{id} con candidatos ICE del cliente.
+func (s *Server) handleWHEPPatch(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.getClient(r.PathValue("id"))
+	if !ok || client.conn != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), trickleICEContentType) {
+		http.Error(w, "se esperaba Content-Type: "+trickleICEContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	fragment, ok := readSDPBody(w, r, "el fragmento SDP")
+	if !ok {
+		return
+	}
+
+	candidates, ufrag := parseTrickleICEFragment(string(fragment))
+	if remote := client.peerConnection.RemoteDescription(); ufrag != "" && remote != nil && !strings.Contains(remote.SDP, "a=ice-ufrag:"+ufrag) {
+		http.Error(w, "reinicio ICE no soportado", http.StatusUnprocessableEntity)
+		return
+	}
+	for _, candidate := range candidates {
+		if err := client.peerConnection.AddICECandidate(candidate); err != nil {
+			log.Printf("[%s] Fallo AddICECandidate: %v", client.id, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	log.Printf("[%s] WHEP: %d candidatos ICE remotos añadidos.", client.id, len(candidates))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleWHEPDelete atiende DELETE /whep/{id}.
+func (s *Server) handleWHEPDelete(w http.ResponseWriter, r *http.Request) {
+	client, ok := s.getClient(r.PathValue("id"))
+	if !ok || client.conn != nil {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("[%s] WHEP: Sesión terminada por el cliente.", client.id)
+	s.removeClient(client.id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// parseTrickleICEFragment extrae los candidatos (con su mid) y el ice-ufrag
+// de un fragmento SDP de trickle ICE (RFC 8840).
+func parseTrickleICEFragment(fragment string) ([]webrtc.ICECandidateInit, string) {
+	var (
+		candidates []webrtc.ICECandidateInit
+		ufrag      string
+		mid        *string
+	)
+	for _, line := range strings.Split(fragment, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a="), SDPMid: mid})
+		}
+	}
+	return candidates, ufrag
+}
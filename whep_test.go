@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestParseTrickleICEFragment(t *testing.T) {
+	mid := func(value string) *string { return &value }
+	tests := []struct {
+		name       string
+		fragment   string
+		candidates []webrtc.ICECandidateInit
+		ufrag      string
+	}{
+		{name: "vacío"},
+		{
+			name: "un candidato con mid (CRLF)",
+			fragment: "a=ice-ufrag:abc\r\na=ice-pwd:secret\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\n" +
+				"a=candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host\r\na=end-of-candidates\r\n",
+			candidates: []webrtc.ICECandidateInit{{Candidate: "candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host", SDPMid: mid("0")}},
+			ufrag:      "abc",
+		},
+		{
+			name: "varias secciones",
+			fragment: "a=ice-ufrag:xyz\na=mid:0\na=candidate:1 1 udp 1 192.0.2.1 5000 typ host\n" +
+				"a=mid:1\na=candidate:2 1 udp 1 192.0.2.1 5002 typ host\n",
+			candidates: []webrtc.ICECandidateInit{
+				{Candidate: "candidate:1 1 udp 1 192.0.2.1 5000 typ host", SDPMid: mid("0")},
+				{Candidate: "candidate:2 1 udp 1 192.0.2.1 5002 typ host", SDPMid: mid("1")},
+			},
+			ufrag: "xyz",
+		},
+		{
+			name:       "candidato sin mid",
+			fragment:   "a=candidate:1 1 udp 1 192.0.2.1 5000 typ host",
+			candidates: []webrtc.ICECandidateInit{{Candidate: "candidate:1 1 udp 1 192.0.2.1 5000 typ host"}},
+		},
+	}
+	for _, tt := range tests {
+		candidates, ufrag := parseTrickleICEFragment(tt.fragment)
+		if !reflect.DeepEqual(candidates, tt.candidates) || ufrag != tt.ufrag {
+			t.Errorf("%s: %+v, %q; se esperaba %+v, %q", tt.name, candidates, ufrag, tt.candidates, tt.ufrag)
+		}
+	}
+}
+
+func TestHandleWHEPBodyTooLarge(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, whepEndpointPath, strings.NewReader(strings.Repeat("a", sdpMaxBodySize+1)))
+	request.Header.Set("Content-Type", sdpContentType)
+	recorder := httptest.NewRecorder()
+	(&Server{}).handleWHEP(recorder, request)
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("código %d, se esperaba %d", recorder.Code, http.StatusRequestEntityTooLarge)
+	}
+}
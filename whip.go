@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Ingesta WHIP (WebRTC-HTTP Ingestion Protocol): "-v whip[:<vp8|vp9|h264>]" y
+// "-a whip" hacen que la fuente compartida sea lo que publique un cliente WHIP
+// (OBS, navegador, GStreamer whipsink...) con POST /whip. Los paquetes se
+// reenvían sin decodificar, igual que en la ingesta RTP.
+const (
+	whipSourceIdentifier = "whip"
+	whipEndpointPath     = "/whip"
+	whipDefaultVideo     = "vp8"
+	sdpContentType       = "application/sdp"
+	sdpMaxBodySize       = 64 << 10 // Tamaño máximo de una oferta SDP o un fragmento trickle ICE
+)
+
+var errWHIPBusy = errors.New("ya hay un publicador WHIP activo")
+
+func isWHIPSourceIdentifier(identifier string) bool {
+	return identifier == whipSourceIdentifier || strings.HasPrefix(identifier, whipSourceIdentifier+":")
+}
+
+// parseWHIPCodec devuelve el codec que se aceptará del publicador.
+func parseWHIPCodec(identifier string, kind webrtc.RTPCodecType) (*codec.RTPCodec, error) {
+	name := strings.TrimPrefix(strings.TrimPrefix(identifier, whipSourceIdentifier), ":")
+	if name == "" {
+		name = whipDefaultVideo
+		if kind == webrtc.RTPCodecTypeAudio {
+			name = "opus"
+		}
+	}
+	rtpCodec, err := rtpIngestCodec(name, "")
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(strings.ToLower(rtpCodec.MimeType), kind.String()+"/") {
+		return nil, fmt.Errorf("el codec %s no es de %s", rtpCodec.MimeType, kind)
+	}
+	return rtpCodec, nil
+}
+
+// whipIngest recibe las pistas del publicador WHIP activo y las escribe en
+// las FanoutTrack compartidas. Solo se admite un publicador a la vez.
+type whipIngest struct {
+	token string // Bearer token exigido en POST/DELETE (vacío = sin autenticación)
+
+	mutex     sync.Mutex
+	tracks    map[webrtc.RTPCodecType]*FanoutTrack
+	sessionID string
+	pc        *webrtc.PeerConnection
+	videoSSRC uint32 // SSRC de la pista de video del publicador, para enviarle PLI
+	onDetach  func() // Revoca las credenciales TURN de la sesión
+}
+
+func newWHIPIngest(token string) *whipIngest {
+	return &whipIngest{token: token, tracks: make(map[webrtc.RTPCodecType]*FanoutTrack)}
+}
+
+// addTrack crea la FanoutTrack del tipo indicado; la alimentará el publicador.
+func (w *whipIngest) addTrack(rtpCodec *codec.RTPCodec, kind webrtc.RTPCodecType) *FanoutTrack {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	out := NewFanoutTrack(rtpCodec.RTPCodecCapability, kind.String(), streamID)
+	if kind == webrtc.RTPCodecTypeVideo {
+		out.OnKeyFrameRequest(w.requestKeyFrame)
+	}
+	w.tracks[kind] = out
+	return out
+}
+
+func (w *whipIngest) authorized(r *http.Request) bool {
+	return w.token == "" || bearerTokenMatches(r, w.token)
+}
+
+// bearerTokenMatches compara en tiempo constante el token de la cabecera
+// Authorization con el esperado.
+func bearerTokenMatches(r *http.Request, token string) bool {
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// attach registra pc como publicador activo y conecta sus pistas entrantes.
+// onDetach se llama una vez al cerrar la sesión.
+func (w *whipIngest) attach(sessionID string, pc *webrtc.PeerConnection, onDetach func()) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.pc != nil {
+		return errWHIPBusy
+	}
+	w.sessionID, w.pc, w.videoSSRC, w.onDetach = sessionID, pc, 0, onDetach
+
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		w.mutex.Lock()
+		out, ok := w.tracks[remote.Kind()]
+		if ok && remote.Kind() == webrtc.RTPCodecTypeVideo {
+			w.videoSSRC = uint32(remote.SSRC())
+		}
+		w.mutex.Unlock()
+		if !ok {
+			log.Printf("[%s] WHIP: Ignorando pista de %s (no configurada como fuente).", sessionID, remote.Kind())
+			return
+		}
+		log.Printf("[%s] WHIP: Recibiendo %s (%s, SSRC=%d).", sessionID, remote.Kind(), remote.Codec().MimeType, remote.SSRC())
+		if remote.Kind() == webrtc.RTPCodecTypeVideo {
+			w.requestKeyFrame()
+		}
+		for {
+			pkt, _, err := remote.ReadRTP()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					log.Printf("[%s] WHIP: Pista de %s terminada: %v", sessionID, remote.Kind(), err)
+				}
+				return
+			}
+			out.WriteRTP(pkt)
+		}
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("[%s] WHIP: PeerConnection state: %s", sessionID, state.String())
+		// Disconnected es transitorio (ICE puede recuperarse); si no se
+		// recupera, pion pasa a Failed. Soltar antes dejaría sin fuente a
+		// todos los espectadores por un corte breve.
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			w.detach(sessionID)
+		}
+	})
+	return nil
+}
+
+// detach cierra la sesión indicada si sigue siendo la activa.
+func (w *whipIngest) detach(sessionID string) bool {
+	w.mutex.Lock()
+	if w.pc == nil || w.sessionID != sessionID {
+		w.mutex.Unlock()
+		return false
+	}
+	pc, onDetach := w.pc, w.onDetach
+	w.pc, w.sessionID, w.videoSSRC, w.onDetach = nil, "", 0, nil
+	w.mutex.Unlock()
+
+	log.Printf("[%s] WHIP: Publicador desconectado.", sessionID)
+	if onDetach != nil {
+		onDetach()
+	}
+	if err := pc.Close(); err != nil {
+		log.Printf("[%s] WHIP: Error cerrando PeerConnection: %v", sessionID, err)
+	}
+	return true
+}
+
+// requestKeyFrame reenvía al publicador las peticiones de keyframe de los espectadores.
+func (w *whipIngest) requestKeyFrame() {
+	w.mutex.Lock()
+	pc, ssrc := w.pc, w.videoSSRC
+	w.mutex.Unlock()
+	if pc == nil || ssrc == 0 {
+		return
+	}
+	if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}}); err != nil {
+		log.Printf("WHIP: Error enviando PLI al publicador: %v", err)
+	}
+}
+
+func (w *whipIngest) Close() error {
+	w.mutex.Lock()
+	sessionID := w.sessionID
+	w.mutex.Unlock()
+	w.detach(sessionID)
+	return nil
+}
+
+// readSDPBody lee el cuerpo SDP de la petición hasta sdpMaxBodySize. Si no
+// puede, responde 413 (demasiado grande) o 400 y devuelve false.
+func readSDPBody(w http.ResponseWriter, r *http.Request, what string) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, sdpMaxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("cuerpo demasiado grande (máximo %d bytes)", sdpMaxBodySize), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "no se pudo leer "+what, http.StatusBadRequest)
+		}
+		return nil, false
+	}
+	return body, true
+}
+
+// handleWHIP atiende POST /whip: recibe la oferta SDP del publicador y
+// responde 201 con la respuesta SDP y la URL del recurso de la sesión.
+func (s *Server) handleWHIP(w http.ResponseWriter, r *http.Request) {
+	ingest, ok := s.mediaManager.GetWHIPIngest()
+	if !ok {
+		http.Error(w, "WHIP no está habilitado (usa -v whip y/o -a whip)", http.StatusNotFound)
+		return
+	}
+	if !ingest.authorized(r) {
+		http.Error(w, "no autorizado", http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpContentType) {
+		http.Error(w, "se esperaba Content-Type: application/sdp", http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, ok := readSDPBody(w, r, "la oferta")
+	if !ok {
+		return
+	}
+
+	sessionID := uuid.NewString()
+	log.Printf("[%s] WHIP: Nueva oferta de %s.", sessionID, r.RemoteAddr)
+
+	peerConnection, err := s.webRTCManager.NewPeerConnection()
+	if err != nil {
+		log.Printf("[%s] WHIP: Fallo al crear PeerConnection: %v", sessionID, err)
+		http.Error(w, "error interno", http.StatusInternalServerError)
+		return
+	}
+	// Las credenciales TURN se crean antes de registrar la sesión para que
+	// detach, que puede llegar en cualquier momento, siempre las revoque.
+	iceServers := s.iceServersFor(sessionID)
+	revoke := func() { s.revokeICECredentials(sessionID) }
+	if err := ingest.attach(sessionID, peerConnection, revoke); err != nil {
+		revoke()
+		peerConnection.Close()
+		log.Printf("[%s] WHIP: Rechazado: %v", sessionID, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	answer, err := answerOffer(peerConnection, string(offer), "")
+	if err != nil {
+		ingest.detach(sessionID)
+		log.Printf("[%s] WHIP: %v", sessionID, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	setICEServerLinks(w, iceServers)
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", whipEndpointPath+"/"+sessionID)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+	log.Printf("[%s] WHIP: Respuesta SDP enviada.", sessionID)
+}
+
+// handleWHIPResource atiende DELETE /whip/{id}, que termina la publicación.
+func (s *Server) handleWHIPResource(w http.ResponseWriter, r *http.Request) {
+	ingest, ok := s.mediaManager.GetWHIPIngest()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !ingest.authorized(r) {
+		http.Error(w, "no autorizado", http.StatusUnauthorized)
+		return
+	}
+	if !ingest.detach(r.PathValue("id")) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}